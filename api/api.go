@@ -5,9 +5,13 @@ package api
 type API interface {
 	GetNodeInfo() (nodeInfo *NodeInfo, err error)
 	GetTransitNode() (nodeInfo *RelayNodeInfo, err error)
+	GetTransitNodes() (nodeInfos []*RelayNodeInfo, err error)
+	GetNodeRules() (blockingRules *BlockingRules, err error)
 	GetSubscriptionList() (subscriptionList *[]SubscriptionInfo, err error)
 	ReportOnlineIPs(onlineIP *[]OnlineIP) (err error)
 	ReportTraffic(subscriptionTraffic *[]SubscriptionTraffic) (err error)
+	ReportNodeStatus(nodeStatus *NodeStatus) (err error)
 	Describe() ClientInfo
+	ResetETags()
 	Debug()
 }
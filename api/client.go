@@ -14,7 +14,7 @@ type Client struct {
 	client           *resty.Client
 	APIHost          string
 	NodeID           int
-	Key              string
+	credentials      *Credentials
 	resp             atomic.Value
 	eTags            map[string]string
 	LastReportOnline map[int]int
@@ -28,6 +28,12 @@ type ClientInfo struct {
 }
 
 func New(apiConfig *Config) *Client {
+	return NewWithCredentials(apiConfig, NewCredentials(apiConfig.Key))
+}
+
+// NewWithCredentials returns a client using the shared credentials instead of
+// the key of the config
+func NewWithCredentials(apiConfig *Config, credentials *Credentials) *Client {
 	client := resty.New()
 	client.SetRetryCount(5)
 	if apiConfig.Timeout > 0 {
@@ -51,7 +57,7 @@ func New(apiConfig *Config) *Client {
 	apiClient := &Client{
 		client:           client,
 		NodeID:           apiConfig.NodeID,
-		Key:              apiConfig.Key,
+		credentials:      credentials,
 		APIHost:          apiConfig.APIHost,
 		LastReportOnline: make(map[int]int),
 		eTags:            make(map[string]string),
@@ -61,7 +67,23 @@ func New(apiConfig *Config) *Client {
 }
 
 func (c *Client) Describe() ClientInfo {
-	return ClientInfo{APIHost: c.APIHost, NodeID: c.NodeID, Key: c.Key}
+	return ClientInfo{APIHost: c.APIHost, NodeID: c.NodeID, Key: c.apiKey()}
+}
+
+// Credentials returns the key holder of the client, to be shared with the
+// other clients of the same panel server
+func (c *Client) Credentials() *Credentials {
+	return c.credentials
+}
+
+func (c *Client) apiKey() string {
+	return c.credentials.Key()
+}
+
+// ResetETags forgets the ETags of the previous responses, so that the next
+// requests return the full data even if it did not change
+func (c *Client) ResetETags() {
+	c.eTags = make(map[string]string)
 }
 
 func (c *Client) Debug() {
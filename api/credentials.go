@@ -0,0 +1,50 @@
+package api
+
+import (
+	"sync"
+)
+
+// Credentials holds the api key of a panel server. Every client of the
+// server shares it, so a key rotated through one node is used by all of them.
+type Credentials struct {
+	access   sync.RWMutex
+	key      string
+	handlers []func(key string)
+}
+
+func NewCredentials(key string) *Credentials {
+	return &Credentials{key: key}
+}
+
+// Key returns the current api key
+func (c *Credentials) Key() string {
+	c.access.RLock()
+	defer c.access.RUnlock()
+	return c.key
+}
+
+// OnRotated adds a callback invoked after the panel re-issued the key and
+// the clients switched to it, so that the new key can be persisted
+func (c *Credentials) OnRotated(handler func(key string)) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	c.handlers = append(c.handlers, handler)
+}
+
+// set switches to a new key. The callbacks only run once per key, when
+// several nodes confirm the same rotation.
+func (c *Credentials) set(key string) bool {
+	c.access.Lock()
+	if c.key == key {
+		c.access.Unlock()
+		return false
+	}
+	c.key = key
+	handlers := append([]func(key string){}, c.handlers...)
+	c.access.Unlock()
+
+	for _, handler := range handlers {
+		handler(key)
+	}
+	return true
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// Enroll registers this server on the panel with a one-time token and
+// returns the api key and the node IDs assigned to it
+func Enroll(panelURL string, token string, timeout int) (*Enrollment, error) {
+	client := resty.New()
+	client.SetRetryCount(3)
+	if timeout > 0 {
+		client.SetTimeout(time.Duration(timeout) * time.Second)
+	} else {
+		client.SetTimeout(30 * time.Second)
+	}
+	client.SetBaseURL(panelURL)
+
+	hostname, _ := os.Hostname()
+
+	res, err := client.R().
+		SetBody(map[string]string{"token": token, "hostname": hostname}).
+		ForceContentType("application/json").
+		Post("/api/server/enroll")
+	if err != nil {
+		return nil, fmt.Errorf("enroll request failed: %s", err)
+	}
+	if res.StatusCode() >= 400 {
+		return nil, fmt.Errorf("enroll request failed: %s", res.String())
+	}
+
+	response := new(enrollResponse)
+	if err := json.Unmarshal(res.Body(), response); err != nil {
+		return nil, fmt.Errorf("failed to parse enroll response: %s", res.String())
+	}
+	if response.Key == "" || len(response.Nodes) == 0 {
+		return nil, fmt.Errorf("panel returned no credentials for this server")
+	}
+
+	return &Enrollment{
+		ApiKey:  response.Key,
+		NodeIDs: response.Nodes,
+	}, nil
+}
+
+// rotateKey confirms a key re-issued by the panel using the new key, then
+// switches every client sharing the credentials to it
+func (c *Client) rotateKey(key string) error {
+	res, err := c.client.R().
+		SetBody(map[string]string{"key": key}).
+		SetPathParam("serverId", strconv.Itoa(c.NodeID)).
+		ForceContentType("application/json").
+		Post("/api/server/credentials/confirm/{serverId}")
+
+	_, err = c.checkResponse(res, err)
+	if err != nil {
+		return err
+	}
+
+	if c.credentials.set(key) {
+		log.Printf("[%s] (NodeID=%d) Api key rotated", c.APIHost, c.NodeID)
+	}
+
+	return nil
+}
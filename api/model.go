@@ -4,10 +4,35 @@ import (
 	"encoding/json"
 )
 
+const (
+	RuleActionBlock    = "block"
+	RuleActionRedirect = "redirect"
+	RuleActionThrottle = "throttle"
+	RuleActionAudit    = "audit"
+	RuleActionDNS      = "dns"
+)
+
+// RelayType of a node
+const (
+	RelayTypeNone     = 0
+	RelayTypeTransit  = 1 // subscriptions are relayed through the transit servers
+	RelayTypeOutbound = 2 // node traffic goes through an outbound of OutboundConfigPath
+	RelayTypePortal   = 3 // node traffic goes through the reverse tunnel of a bridge
+	RelayTypeBridge   = 4 // the node dials out to the portal on the transit server
+)
+
+const (
+	RelayStrategyLeastLatency = "least-latency"
+	RelayStrategyRoundRobin   = "round-robin"
+	RelayStrategySticky       = "sticky"
+)
+
 const (
 	SubscriptionNotModified = "subscriptions not modified"
 	NodeNotModified = "node not modified"
 	RuleNotModified = "rules not modified"
+	RuleNotSupported = "rules not supported"
+	ServerNodesNotModified = "server nodes not modified"
 )
 
 // Config API config
@@ -30,10 +55,33 @@ type PostData struct {
 type serverConfig struct {
 	server          `json:"server"`
 	transitServer   `json:"transit_server"`
+	TransitServers  []transitServer `json:"transit_servers"`
+	TransitStrategy string `json:"transit_strategy"`
+	TransitOutbound string `json:"transit_outbound"`
+	Reverse         *reverse `json:"reverse"`
+	Credentials     *credentials `json:"credentials"`
 	UpdateInterval   int `json:"update_interval"`
 	apiVersion       string  `json:"version"`
 }
 
+type serverNodesResponse struct {
+	Nodes []int `json:"nodes"`
+}
+
+type reverse struct {
+	Domain string `json:"domain"`
+	Passwd string `json:"passwd"`
+}
+
+type credentials struct {
+	Key string `json:"key"`
+}
+
+type enrollResponse struct {
+	Key   string `json:"key"`
+	Nodes []int  `json:"nodes"`
+}
+
 type server struct {
 	Type        string `json:"type"`
 	Cipher      string `json:"cipher"`
@@ -45,6 +93,20 @@ type server struct {
 	NetworkSettings  *json.RawMessage `json:"transportSettings"`
 	SecuritySettings *json.RawMessage `json:"securitySettings"`
 	Rules            *json.RawMessage `json:"rules"`
+	Inbounds         []serverInbound `json:"inbounds"`
+	XraySettings     *xraySettings `json:"xraySettings"`
+}
+
+type serverInbound struct {
+	NetworkSettings  *json.RawMessage `json:"transportSettings"`
+	SecuritySettings *json.RawMessage `json:"securitySettings"`
+	XraySettings     *xraySettings `json:"xraySettings"`
+}
+
+type xraySettings struct {
+	Settings       json.RawMessage `json:"settings"`
+	StreamSettings json.RawMessage `json:"streamSettings"`
+	Sniffing       json.RawMessage `json:"sniffing"`
 }
 
 type transitServer struct {
@@ -55,6 +117,7 @@ type transitServer struct {
 	RServerKey   string `json:"server_key"`
 	RNetworkSettings  *json.RawMessage `json:"transportSettings"`
 	RSecuritySettings *json.RawMessage `json:"securitySettings"`
+	Chain        []transitServer `json:"chain"`
 }
 
 type SubscriptionResponse struct {
@@ -67,6 +130,24 @@ type Traffic struct {
 	Download   int64 `json:"d"`
 }
 
+type Status struct {
+	Uptime        uint64  `json:"uptime"`
+	CPU           float64 `json:"cpu"`
+	MemTotal      uint64  `json:"mem_total"`
+	MemUsed       uint64  `json:"mem_used"`
+	Load1         float64 `json:"load1"`
+	Load5         float64 `json:"load5"`
+	Load15        float64 `json:"load15"`
+	NetIn         uint64  `json:"net_in"`
+	NetOut        uint64  `json:"net_out"`
+	Connections   int     `json:"connections"`
+	CoreVersion   string  `json:"core_version"`
+	CertExpiry    int64   `json:"cert_expiry"`
+	LastSyncError string  `json:"last_sync_error"`
+	State         string  `json:"state"`
+	Restarts      int     `json:"restarts"`
+}
+
 type AliveIP struct {
 	Id int    `json:"subscription_id"`
 	IP  string `json:"ip"`
@@ -78,6 +159,9 @@ type Subscription struct {
 	Passwd     string `json:"passwd"`
 	Speedlimit int    `json:"speed_limit"`
 	Iplimit    int    `json:"ip_limit"`
+	RuleSets   []int  `json:"rule_sets"`
+	GroupId    int    `json:"group_id"`
+	PublicKey  string `json:"public_key"`
 }
 
 type BlockingRules struct {
@@ -85,6 +169,28 @@ type BlockingRules struct {
 	IP          []string
 	Port        string
 	Protocol    []string
+	Actions     []RuleAction
+	RuleSets    []RuleSet
+}
+
+// RuleSet is a rule action applied only to the subscriptions that list its ID
+// or belong to one of its plan groups
+type RuleSet struct {
+	ID     int
+	Groups []int
+	RuleAction
+}
+
+// RuleAction is a panel rule with its own action, matched in the order sent
+type RuleAction struct {
+	Action         string   // block, redirect, throttle, audit or dns
+	Outbound       string   // redirect: tag of an outbound from OutboundConfigPath
+	SpeedLimit     uint64   // throttle: Byte/s
+	DomainStrategy string   // dns: AsIs, UseIP, UseIPv4, UseIPv6 ...
+	Domain         []string
+	IP             []string
+	Port           string
+	Protocol       []string
 }
 
 type TlsSettings struct {
@@ -97,6 +203,10 @@ type TlsSettings struct {
 	RejectUnknownSni   bool  
 	VerifyPeerCertInNames []string 
 	Alpn               []string
+	PinnedPeerCertSha256 string
+	CaCertificate      string
+	ClientCertificate  string // PEM certificate and key a relay presents to its transit
+	ClientKey          string
 }
 
 type RealitySettings struct {
@@ -135,6 +245,15 @@ type XhttpSettings struct {
 	Mode           string
 	NoSSEHeader    bool
 	NoGRPCHeader   bool
+	Headers        map[string]string
+	XPaddingBytes        string // ranges like "100-1000"
+	ScMaxEachPostBytes   string
+	ScMinPostsIntervalMs string
+	ScMaxBufferedPosts   int64
+	ScStreamUpServerSecs string
+	Xmux           json.RawMessage
+	DownloadSettings json.RawMessage // stream settings of a separate download connection, only used by the relay outbound
+	Extra          json.RawMessage // overrides every setting but host, path and mode
 }
 
 type RawSettings struct {
@@ -146,22 +265,84 @@ type WsSettings struct {
 	Host                string
 	Path                string
 	HeartbeatPeriod     uint32
+	Headers             map[string]string
 }
 
 type HttpSettings struct {
 	Host                string
 	Path                string
+	Headers             map[string]string
+}
+
+type WireguardSettings struct {
+	SecretKey      string
+	Address        []string
+	PeerNetwork    string
+	Mtu            int32
+}
+
+// Fallback of a vless or trojan node, Dest is a port, an address or a unix
+// socket path
+type Fallback struct {
+	SNI            string
+	Alpn           string
+	Path           string
+	Dest           string
+	Xver           uint64
+}
+
+// FrontSettings puts the node inbound behind the listener shared on Port, the
+// listener picks the node by TLS server name, ALPN or HTTP path
+type FrontSettings struct {
+	Port           uint32
+	SNI            string
+	Alpn           string
+	Path           string
+}
+
+// SniffingSettings are the sniffing options of the node inbound
+type SniffingSettings struct {
+	DestOverride    []string
+	DomainsExcluded []string
+	MetadataOnly    bool
+	RouteOnly       bool
+}
+
+// XraySettings holds raw xray inbound json, merged over the generated settings,
+// streamSettings and sniffing of the node inbound
+type XraySettings struct {
+	Settings       json.RawMessage
+	StreamSettings json.RawMessage
+	Sniffing       json.RawMessage
+}
+
+type MuxSettings struct {
+	Concurrency         int16
+	XudpConcurrency     int16
+	XudpProxyUDP443     string
 }
 
 type GrpcSettings struct {
 	ServiceName    string
 	Authority      string
+	MultiMode      bool
+	IdleTimeout    int32
+	HealthCheckTimeout  int32
+	PermitWithoutStream bool
+	InitialWindowsSize  int32
+	UserAgent      string
 }
 
 type KcpSettings struct {
 	Seed           string
 	Congestion     bool
 	Header         json.RawMessage
+	Mtu            uint32
+	Tti            uint32
+	UplinkCapacity   uint32
+	DownlinkCapacity uint32
+	ReadBufferSize   uint32
+	WriteBufferSize  uint32
 }
 
 type NodeInfo struct {
@@ -169,9 +350,14 @@ type NodeInfo struct {
 	NodeID          int
 	RelayNodeID     int
 	RelayType       int
+	RelayStrategy   string
+	RelayOutbound   string
+	ReverseDomain   string
+	ReversePasswd   string
 	SpeedLimit      uint64
 	UpdateTime      int
 	Sniffing        bool
+	SniffingSettings *SniffingSettings
 	ListeningIP     string
 	ListeningPort   string
 	SendThroughIP   string
@@ -192,8 +378,13 @@ type NodeInfo struct {
 	SocketSettings  *SocketSettings
 	RealitySettings *RealitySettings
 	TlsSettings     *TlsSettings
+	WireguardSettings *WireguardSettings
+	FrontSettings   *FrontSettings
+	Fallbacks       []*Fallback
 	RelayNodeInfo   *RelayNodeInfo
 	BlockingRules   *BlockingRules
+	Inbounds        []*NodeInfo // extra listeners sharing the users and rules of the node
+	XraySettings    *XraySettings
 }
 
 type RelayNodeInfo struct {
@@ -217,6 +408,13 @@ type RelayNodeInfo struct {
 	XhttpSettings   *XhttpSettings
 	RealitySettings *RealitySettings
 	TlsSettings     *TlsSettings
+	MuxSettings     *MuxSettings
+	Chain           []*RelayNodeInfo // next hops in order, the last one is the exit
+}
+
+type Enrollment struct {
+	ApiKey  string
+	NodeIDs []int
 }
 
 type SubscriptionInfo struct {
@@ -225,6 +423,9 @@ type SubscriptionInfo struct {
 	Passwd       string
 	SpeedLimit   uint64
 	IPLimit      int
+	RuleSets     []int
+	GroupId      int // plan group, matched by the rule sets listing it
+	PublicKey    string
 }
 
 type OnlineIP struct {
@@ -236,4 +437,22 @@ type SubscriptionTraffic struct {
 	Id  int
 	Upload   int64
 	Download   int64
-}
\ No newline at end of file
+}
+
+type NodeStatus struct {
+	Uptime        uint64  // seconds since the controller started
+	CPU           float64 // percent
+	MemTotal      uint64  // bytes
+	MemUsed       uint64  // bytes
+	Load1         float64
+	Load5         float64
+	Load15        float64
+	NetIn         uint64  // bytes per second
+	NetOut        uint64  // bytes per second
+	Connections   int
+	CoreVersion   string
+	CertExpiry    int64   // unix timestamp, 0 when no certificate is managed
+	LastSyncError string
+	State         string  // controller state: starting, running, failed, stopped
+	Restarts      int
+}
@@ -3,6 +3,7 @@ package api
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"strings"
 	"errors"
 	"math/rand"
@@ -14,7 +15,7 @@ import (
 func (c *Client) GetNodeInfo() (nodeInfo *NodeInfo, err error) {
 	server := new(serverConfig)
 	res, err := c.client.R().
-		SetBody(map[string]string{"key": c.Key}).
+		SetBody(map[string]string{"key": c.apiKey()}).
 		ForceContentType("application/json").
 		SetPathParam("serverId", strconv.Itoa(c.NodeID)).
 		SetHeader("If-None-Match", c.eTags["server"]).
@@ -41,6 +42,13 @@ func (c *Client) GetNodeInfo() (nodeInfo *NodeInfo, err error) {
 	}
 
 	c.resp.Store(server)
+	
+	// The panel re-issued the credentials of this node
+	if server.Credentials != nil && server.Credentials.Key != "" && server.Credentials.Key != c.apiKey() {
+		if err := c.rotateKey(server.Credentials.Key); err != nil {
+			log.Printf("Rotate api key failed: %s", err)
+		}
+	}
 
 	nodeInfo, err = c.NodeResponse(server)
 	if err != nil {
@@ -63,13 +71,34 @@ func (c *Client) NodeResponse(s *serverConfig) (*NodeInfo, error) {
 		
 		nodeInfo.NetworkType = ""
 		nodeInfo.NodeType = strings.ToLower(s.Type)
+		if nodeInfo.NodeType == "shadowsocks-plugin" {
+			nodeInfo.NodeType = "Shadowsocks-Plugin"
+		}
 		nodeInfo.NodeID = c.NodeID
 		nodeInfo.RelayNodeID = int(s.RelayNodeId)
 		nodeInfo.RelayType = int(s.RelayType)
+		nodeInfo.RelayStrategy = s.TransitStrategy
+		nodeInfo.RelayOutbound = s.TransitOutbound
+		if s.Reverse != nil {
+			nodeInfo.ReverseDomain = s.Reverse.Domain
+			nodeInfo.ReversePasswd = s.Reverse.Passwd
+		}
 		nodeInfo.SpeedLimit = uint64(s.Speedlimit * 1000000 / 8)
 		nodeInfo.UpdateTime = int(s.UpdateInterval)
 		
-		nodeInfo.Sniffing = transportData.Get("sniffing").MustBool()
+		// sniffing is either a switch or an object with the sniffing options
+		sniffing := transportData.Get("sniffing")
+		if enabled, err := sniffing.Bool(); err == nil {
+			nodeInfo.Sniffing = enabled
+		} else if _, err := sniffing.Map(); err == nil {
+			nodeInfo.Sniffing = sniffing.Get("enabled").MustBool()
+			nodeInfo.SniffingSettings = &SniffingSettings{
+				DestOverride: sniffing.Get("destOverride").MustStringArray(),
+				DomainsExcluded: sniffing.Get("domainsExcluded").MustStringArray(),
+				MetadataOnly: sniffing.Get("metadataOnly").MustBool(),
+				RouteOnly: sniffing.Get("routeOnly").MustBool(),
+			}
+		}
 		nodeInfo.ListeningIP = transportData.Get("listeningIP").MustString()
 		nodeInfo.ListeningPort = transportData.Get("listeningPort").MustString()
 		nodeInfo.SendThroughIP = transportData.Get("sendThroughIP").MustString()
@@ -78,20 +107,18 @@ func (c *Client) NodeResponse(s *serverConfig) (*NodeInfo, error) {
 			nodeInfo.Decryption = transportData.Get("decryption").MustString()
 		}
 		
-		if nodeInfo.NodeType == "shadowsocks" {
+		if nodeInfo.NodeType == "shadowsocks" || nodeInfo.NodeType == "Shadowsocks-Plugin" {
 			nodeInfo.Cipher = s.Cipher
 			nodeInfo.ServerKey = s.ServerKey
 		}
 		
 		if xhttpSettings, ok := transportData.CheckGet("xhttpSettings"); ok {
 			nodeInfo.NetworkType = "xhttp"
-			nodeInfo.XhttpSettings = &XhttpSettings{} 
-			
-			nodeInfo.XhttpSettings.Host = xhttpSettings.Get("host").MustString()
-			nodeInfo.XhttpSettings.Path = xhttpSettings.Get("path").MustString()
-			nodeInfo.XhttpSettings.Mode = xhttpSettings.Get("mode").MustString()
-			nodeInfo.XhttpSettings.NoSSEHeader = xhttpSettings.Get("NoSSEHeader").MustBool()
-			nodeInfo.XhttpSettings.NoGRPCHeader = xhttpSettings.Get("NoGRPCHeader").MustBool()
+			xhttp, err := parseXhttpSettings(xhttpSettings)
+			if err != nil {
+				return nil, err
+			}
+			nodeInfo.XhttpSettings = xhttp
 		}
 		
 		if rawSettings, ok := transportData.CheckGet("rawSettings"); ok {
@@ -117,34 +144,21 @@ func (c *Client) NodeResponse(s *serverConfig) (*NodeInfo, error) {
 		
 		if kcpSettings, ok := transportData.CheckGet("kcpSettings"); ok {
 			nodeInfo.NetworkType = "kcp"
-			nodeInfo.KcpSettings = &KcpSettings{} 
-			
-			nodeInfo.KcpSettings.Seed = kcpSettings.Get("seed").MustString()
-			nodeInfo.KcpSettings.Congestion = kcpSettings.Get("congestion").MustBool()
-			if header, headerExist := kcpSettings.CheckGet("header"); headerExist {
-				headerBytes, err := header.MarshalJSON()
-				if err != nil {
-					return nil, err
-				}
-				nodeInfo.KcpSettings.Header = headerBytes
+			kcp, err := parseKcpSettings(kcpSettings)
+			if err != nil {
+				return nil, err
 			}
+			nodeInfo.KcpSettings = kcp
 		}
 		
 		if grpcSettings, ok := transportData.CheckGet("grpcSettings"); ok {
 			nodeInfo.NetworkType = "grpc"
-			nodeInfo.GrpcSettings = &GrpcSettings{} 
-			
-			nodeInfo.GrpcSettings.ServiceName = grpcSettings.Get("servicename").MustString()
-			nodeInfo.GrpcSettings.Authority = grpcSettings.Get("authority").MustString()
+			nodeInfo.GrpcSettings = parseGrpcSettings(grpcSettings)
 		}
 		
 		if wsSettings, ok := transportData.CheckGet("wsSettings"); ok {
 			nodeInfo.NetworkType = "ws"
-			nodeInfo.WsSettings = &WsSettings{} 
-			
-			nodeInfo.WsSettings.Host = wsSettings.Get("host").MustString()
-			nodeInfo.WsSettings.Path = wsSettings.Get("path").MustString()
-			nodeInfo.WsSettings.HeartbeatPeriod = uint32(wsSettings.Get("heartbeat").MustInt())
+			nodeInfo.WsSettings = parseWsSettings(wsSettings)
 			if _, proxyProtocolExists := transportData.CheckGet("acceptProxyProtocol"); proxyProtocolExists {
 				nodeInfo.AcceptProxyProtocol = transportData.Get("acceptProxyProtocol").MustBool()
 			}
@@ -152,15 +166,50 @@ func (c *Client) NodeResponse(s *serverConfig) (*NodeInfo, error) {
 		
 		if httpupgradeSettings, ok := transportData.CheckGet("httpupgradeSettings"); ok {
 			nodeInfo.NetworkType = "httpupgrade"
-			nodeInfo.HttpSettings = &HttpSettings{}  
-			
-			nodeInfo.HttpSettings.Host = httpupgradeSettings.Get("host").MustString()
-			nodeInfo.HttpSettings.Path = httpupgradeSettings.Get("path").MustString()
+			nodeInfo.HttpSettings = parseHttpSettings(httpupgradeSettings)
 			if _, proxyProtocolExists := transportData.CheckGet("acceptProxyProtocol"); proxyProtocolExists {
 				nodeInfo.AcceptProxyProtocol = transportData.Get("acceptProxyProtocol").MustBool()
 			}
 		}
 		
+		// A wireguard node has no stream settings, its peers are the subscriptions
+		if wireguardSettings, ok := transportData.CheckGet("wireguardSettings"); ok && nodeInfo.NodeType == "wireguard" {
+			nodeInfo.NetworkType = "wireguard"
+			nodeInfo.WireguardSettings = &WireguardSettings{}
+			
+			nodeInfo.WireguardSettings.SecretKey = wireguardSettings.Get("secretKey").MustString()
+			nodeInfo.WireguardSettings.Address = wireguardSettings.Get("address").MustStringArray()
+			nodeInfo.WireguardSettings.PeerNetwork = wireguardSettings.Get("peerNetwork").MustString()
+			nodeInfo.WireguardSettings.Mtu = int32(wireguardSettings.Get("mtu").MustInt())
+		}
+		
+		if fallbacks, err := transportData.Get("fallbacks").Array(); err == nil {
+			for i := range fallbacks {
+				fallbackData := transportData.Get("fallbacks").GetIndex(i)
+				fallback := &Fallback{}
+				
+				fallback.SNI = fallbackData.Get("sni").MustString()
+				fallback.Alpn = fallbackData.Get("alpn").MustString()
+				fallback.Path = fallbackData.Get("path").MustString()
+				fallback.Xver = uint64(fallbackData.Get("xver").MustInt())
+				if dest, err := fallbackData.Get("dest").String(); err == nil {
+					fallback.Dest = dest
+				} else if dest, err := fallbackData.Get("dest").Int(); err == nil {
+					fallback.Dest = strconv.Itoa(dest)
+				}
+				nodeInfo.Fallbacks = append(nodeInfo.Fallbacks, fallback)
+			}
+		}
+		
+		if frontSettings, ok := transportData.CheckGet("frontSettings"); ok {
+			nodeInfo.FrontSettings = &FrontSettings{}
+			
+			nodeInfo.FrontSettings.Port = uint32(frontSettings.Get("port").MustInt())
+			nodeInfo.FrontSettings.SNI = frontSettings.Get("sni").MustString()
+			nodeInfo.FrontSettings.Alpn = frontSettings.Get("alpn").MustString()
+			nodeInfo.FrontSettings.Path = frontSettings.Get("path").MustString()
+		}
+		
 		if nodeInfo.NetworkType == "" {
 			return nil, fmt.Errorf("Unable to parse transport protocol")
 		}
@@ -293,28 +342,35 @@ func (c *Client) NodeResponse(s *serverConfig) (*NodeInfo, error) {
 			return nil, err
 		}
 		
-		nodeInfo.BlockingRules = &BlockingRules{}
-		
-		if ipData, ipKeyExists := ruleData.CheckGet("ip"); ipKeyExists {
-			if ipArray, err := ipData.StringArray(); err == nil {
-				nodeInfo.BlockingRules.IP = ipArray
-			}
-		}
-		if domainData, domainKeyExists := ruleData.CheckGet("domain"); domainKeyExists {
-			if domainArray, err := domainData.StringArray(); err == nil {
-				nodeInfo.BlockingRules.Domain = domainArray
-			}
+		nodeInfo.BlockingRules = parseBlockingRules(ruleData)
+	}
+	
+	if x := s.XraySettings; x != nil && (len(x.Settings) > 0 || len(x.StreamSettings) > 0 || len(x.Sniffing) > 0) {
+		nodeInfo.XraySettings = &XraySettings{
+			Settings: x.Settings,
+			StreamSettings: x.StreamSettings,
+			Sniffing: x.Sniffing,
 		}
-		if portData, portKeyExists := ruleData.CheckGet("port"); portKeyExists {
-			if portStr, err := portData.String(); err == nil {
-				nodeInfo.BlockingRules.Port = portStr
-			}
+	}
+	
+	// Extra listeners only have their own transport, security and xray settings
+	for i, inbound := range s.Inbounds {
+		if inbound.NetworkSettings == nil || inbound.SecuritySettings == nil {
+			return nil, fmt.Errorf("Inbound %d of the server misses its settings", i+1)
 		}
-		if protocolData, protocolKeyExists := ruleData.CheckGet("protocol"); protocolKeyExists {
-			if protocolArray, err := protocolData.StringArray(); err == nil {
-				nodeInfo.BlockingRules.Protocol = protocolArray
-			}
+		
+		inboundConfig := *s
+		inboundConfig.server.NetworkSettings = inbound.NetworkSettings
+		inboundConfig.server.SecuritySettings = inbound.SecuritySettings
+		inboundConfig.server.XraySettings = inbound.XraySettings
+		inboundConfig.server.Inbounds = nil
+		
+		inboundInfo, err := c.NodeResponse(&inboundConfig)
+		if err != nil {
+			return nil, fmt.Errorf("Inbound %d of the server: %w", i+1, err)
 		}
+		inboundInfo.BlockingRules = nil
+		nodeInfo.Inbounds = append(nodeInfo.Inbounds, inboundInfo)
 	}
 
 	return nodeInfo, nil
@@ -322,11 +378,38 @@ func (c *Client) NodeResponse(s *serverConfig) (*NodeInfo, error) {
 
 func (c *Client) GetTransitNode() (*RelayNodeInfo, error) {
 	s := c.resp.Load().(*serverConfig)
+	return parseTransitServer(s, &s.transitServer)
+}
+
+// GetTransitNodes returns every transit server of the node, a panel sending a
+// single transit_server gives a list of one
+func (c *Client) GetTransitNodes() ([]*RelayNodeInfo, error) {
+	s := c.resp.Load().(*serverConfig)
+	
+	if len(s.TransitServers) == 0 {
+		nodeInfo, err := parseTransitServer(s, &s.transitServer)
+		if err != nil {
+			return nil, err
+		}
+		return []*RelayNodeInfo{nodeInfo}, nil
+	}
 	
+	nodeInfos := make([]*RelayNodeInfo, 0, len(s.TransitServers))
+	for i := range s.TransitServers {
+		nodeInfo, err := parseTransitServer(s, &s.TransitServers[i])
+		if err != nil {
+			return nil, fmt.Errorf("transit server %d: %w", s.TransitServers[i].NodeId, err)
+		}
+		nodeInfos = append(nodeInfos, nodeInfo)
+	}
+	return nodeInfos, nil
+}
+
+func parseTransitServer(s *serverConfig, ts *transitServer) (*RelayNodeInfo, error) {
 	nodeInfo := &RelayNodeInfo{}
 	
 	// transport settings
-	if transport, err := s.RNetworkSettings.MarshalJSON(); err != nil {
+	if transport, err := ts.RNetworkSettings.MarshalJSON(); err != nil {
 		return nil, err
 	} else {
 		transportData, err := simplejson.NewJson(transport)
@@ -335,9 +418,9 @@ func (c *Client) GetTransitNode() (*RelayNodeInfo, error) {
 		}
 		
 		nodeInfo.NetworkType = ""
-		nodeInfo.NodeType = s.RType
-		nodeInfo.NodeID = s.NodeId
-		nodeInfo.Address = s.RAddress
+		nodeInfo.NodeType = ts.RType
+		nodeInfo.NodeID = ts.NodeId
+		nodeInfo.Address = ts.RAddress
 		
 		listeningPortStr := transportData.Get("listeningPort").MustString()
 		listeningPortInt := 0
@@ -360,19 +443,22 @@ func (c *Client) GetTransitNode() (*RelayNodeInfo, error) {
 		}
 		
 		if nodeInfo.NodeType == "shadowsocks" {
-			nodeInfo.Cipher = s.Cipher
-			nodeInfo.ServerKey = s.ServerKey
+			nodeInfo.Cipher = ts.RCipher
+			nodeInfo.ServerKey = ts.RServerKey
+			// Older panels only send the cipher of the node
+			if nodeInfo.Cipher == "" {
+				nodeInfo.Cipher = s.Cipher
+				nodeInfo.ServerKey = s.ServerKey
+			}
 		}
 		
 		if xhttpSettings, ok := transportData.CheckGet("xhttpSettings"); ok {
 			nodeInfo.NetworkType = "xhttp"
-			nodeInfo.XhttpSettings = &XhttpSettings{} 
-			
-			nodeInfo.XhttpSettings.Host = xhttpSettings.Get("host").MustString()
-			nodeInfo.XhttpSettings.Path = xhttpSettings.Get("path").MustString()
-			nodeInfo.XhttpSettings.Mode = xhttpSettings.Get("mode").MustString()
-			nodeInfo.XhttpSettings.NoSSEHeader = xhttpSettings.Get("NoSSEHeader").MustBool()
-			nodeInfo.XhttpSettings.NoGRPCHeader = xhttpSettings.Get("NoGRPCHeader").MustBool()
+			xhttp, err := parseXhttpSettings(xhttpSettings)
+			if err != nil {
+				return nil, err
+			}
+			nodeInfo.XhttpSettings = xhttp
 		}
 		
 		if rawSettings, ok := transportData.CheckGet("rawSettings"); ok {
@@ -396,34 +482,21 @@ func (c *Client) GetTransitNode() (*RelayNodeInfo, error) {
 		
 		if kcpSettings, ok := transportData.CheckGet("kcpSettings"); ok {
 			nodeInfo.NetworkType = "kcp"
-			nodeInfo.KcpSettings = &KcpSettings{} 
-			
-			nodeInfo.KcpSettings.Seed = kcpSettings.Get("seed").MustString()
-			nodeInfo.KcpSettings.Congestion = kcpSettings.Get("congestion").MustBool()
-			if header, headerExist := kcpSettings.CheckGet("header"); headerExist {
-				headerBytes, err := header.MarshalJSON()
-				if err != nil {
-					return nil, err
-				}
-				nodeInfo.KcpSettings.Header = headerBytes
+			kcp, err := parseKcpSettings(kcpSettings)
+			if err != nil {
+				return nil, err
 			}
+			nodeInfo.KcpSettings = kcp
 		}
 		
 		if grpcSettings, ok := transportData.CheckGet("grpcSettings"); ok {
 			nodeInfo.NetworkType = "grpc"
-			nodeInfo.GrpcSettings = &GrpcSettings{} 
-			
-			nodeInfo.GrpcSettings.ServiceName = grpcSettings.Get("servicename").MustString()
-			nodeInfo.GrpcSettings.Authority = grpcSettings.Get("authority").MustString()
+			nodeInfo.GrpcSettings = parseGrpcSettings(grpcSettings)
 		}
 		
 		if wsSettings, ok := transportData.CheckGet("wsSettings"); ok {
 			nodeInfo.NetworkType = "ws"
-			nodeInfo.WsSettings = &WsSettings{} 
-			
-			nodeInfo.WsSettings.Host = wsSettings.Get("host").MustString()
-			nodeInfo.WsSettings.Path = wsSettings.Get("path").MustString()
-			nodeInfo.WsSettings.HeartbeatPeriod = uint32(wsSettings.Get("heartbeat").MustInt())
+			nodeInfo.WsSettings = parseWsSettings(wsSettings)
 			if _, proxyProtocolExists := transportData.CheckGet("acceptProxyProtocol"); proxyProtocolExists {
 				nodeInfo.AcceptProxyProtocol = transportData.Get("acceptProxyProtocol").MustBool()
 			}
@@ -431,15 +504,20 @@ func (c *Client) GetTransitNode() (*RelayNodeInfo, error) {
 		
 		if httpupgradeSettings, ok := transportData.CheckGet("httpupgradeSettings"); ok {
 			nodeInfo.NetworkType = "httpupgrade"
-			nodeInfo.HttpSettings = &HttpSettings{}  
-			
-			nodeInfo.HttpSettings.Host = httpupgradeSettings.Get("host").MustString()
-			nodeInfo.HttpSettings.Path = httpupgradeSettings.Get("path").MustString()
+			nodeInfo.HttpSettings = parseHttpSettings(httpupgradeSettings)
 			if _, proxyProtocolExists := transportData.CheckGet("acceptProxyProtocol"); proxyProtocolExists {
 				nodeInfo.AcceptProxyProtocol = transportData.Get("acceptProxyProtocol").MustBool()
 			}
 		}
 		
+		if muxSettings, ok := transportData.CheckGet("muxSettings"); ok && muxSettings.Get("enabled").MustBool() {
+			nodeInfo.MuxSettings = &MuxSettings{}
+			
+			nodeInfo.MuxSettings.Concurrency = int16(muxSettings.Get("concurrency").MustInt())
+			nodeInfo.MuxSettings.XudpConcurrency = int16(muxSettings.Get("xudpConcurrency").MustInt())
+			nodeInfo.MuxSettings.XudpProxyUDP443 = muxSettings.Get("xudpProxyUDP443").MustString()
+		}
+		
 		if nodeInfo.NetworkType == "" {
 			return nil, fmt.Errorf("Unable to parse relay transport protocol")
 		}
@@ -450,7 +528,7 @@ func (c *Client) GetTransitNode() (*RelayNodeInfo, error) {
 	}
 	
 	// security settings
-	if security, err := s.RSecuritySettings.MarshalJSON(); err != nil {
+	if security, err := ts.RSecuritySettings.MarshalJSON(); err != nil {
 		return nil, err
 	} else {
 		securityData, err := simplejson.NewJson(security)
@@ -466,6 +544,27 @@ func (c *Client) GetTransitNode() (*RelayNodeInfo, error) {
 			if fingerprint, err := tlsSettings.Get("fingerprint").String(); err == nil {
 				nodeInfo.TlsSettings.FingerPrint = fingerprint
 			}
+			if serverName, err := tlsSettings.Get("serverName").String(); err == nil {
+				nodeInfo.TlsSettings.ServerName = serverName
+			}
+			if allowInsecure, err := tlsSettings.Get("allowInsecure").Bool(); err == nil {
+				nodeInfo.TlsSettings.AllowInsecure = allowInsecure
+			}
+			if pinnedPeerCertSha256, err := tlsSettings.Get("pinnedPeerCertSha256").String(); err == nil {
+				nodeInfo.TlsSettings.PinnedPeerCertSha256 = pinnedPeerCertSha256
+			}
+			if caCertificate, err := tlsSettings.Get("caCertificate").String(); err == nil {
+				nodeInfo.TlsSettings.CaCertificate = caCertificate
+			}
+			if clientCertificate, err := tlsSettings.Get("clientCertificate").String(); err == nil {
+				nodeInfo.TlsSettings.ClientCertificate = clientCertificate
+			}
+			if clientKey, err := tlsSettings.Get("clientKey").String(); err == nil {
+				nodeInfo.TlsSettings.ClientKey = clientKey
+			}
+			if (nodeInfo.TlsSettings.ClientCertificate == "") != (nodeInfo.TlsSettings.ClientKey == "") {
+				return nil, fmt.Errorf("clientCertificate and clientKey must be set together")
+			}
 			if verifyPeerData, verifyPeerExists := tlsSettings.CheckGet("verifyPeerCertInNames"); verifyPeerExists {
 				if verifyPeerArray, err := verifyPeerData.StringArray(); err == nil {
 					nodeInfo.TlsSettings.VerifyPeerCertInNames = verifyPeerArray
@@ -501,6 +600,108 @@ func (c *Client) GetTransitNode() (*RelayNodeInfo, error) {
 			}  	
 		}
 	}
+	
+	// Further hops of a relay chain, ordered towards the exit server
+	for i := range ts.Chain {
+		hop, err := parseTransitServer(s, &ts.Chain[i])
+		if err != nil {
+			return nil, fmt.Errorf("chain hop %d: %w", i+1, err)
+		}
+		nodeInfo.Chain = append(nodeInfo.Chain, hop)
+		nodeInfo.Chain = append(nodeInfo.Chain, hop.Chain...)
+		hop.Chain = nil
+	}
 
 	return nodeInfo, nil
 }
+
+// GetNodeRules returns the blocking rules of the node, they are served by their
+// own endpoint so that a rule change does not invalidate the node info
+func (c *Client) GetNodeRules() (*BlockingRules, error) {
+	res, err := c.client.R().
+		SetBody(map[string]string{"key": c.apiKey()}).
+		ForceContentType("application/json").
+		SetPathParam("serverId", strconv.Itoa(c.NodeID)).
+		SetHeader("If-None-Match", c.eTags["rules"]).
+		Post("/api/server/rules/{serverId}")
+
+	if res != nil && res.StatusCode() == 304 {
+		return nil, errors.New(RuleNotModified)
+	}
+	// A panel without the rules endpoint sends them with the node info
+	if res != nil && (res.StatusCode() == 404 || res.StatusCode() == 405 || res.StatusCode() == 501) {
+		return nil, errors.New(RuleNotSupported)
+	}
+
+	response, err := c.checkResponse(res, err)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Header().Get("Etag") != "" && res.Header().Get("Etag") != c.eTags["rules"] {
+		c.eTags["rules"] = res.Header().Get("Etag")
+	}
+
+	return parseBlockingRules(response.Get("rules")), nil
+}
+
+func parseBlockingRules(ruleData *simplejson.Json) *BlockingRules {
+	blockingRules := &BlockingRules{}
+	
+	if ipData, ipKeyExists := ruleData.CheckGet("ip"); ipKeyExists {
+		if ipArray, err := ipData.StringArray(); err == nil {
+			blockingRules.IP = ipArray
+		}
+	}
+	if domainData, domainKeyExists := ruleData.CheckGet("domain"); domainKeyExists {
+		if domainArray, err := domainData.StringArray(); err == nil {
+			blockingRules.Domain = domainArray
+		}
+	}
+	if portData, portKeyExists := ruleData.CheckGet("port"); portKeyExists {
+		if portStr, err := portData.String(); err == nil {
+			blockingRules.Port = portStr
+		}
+	}
+	if protocolData, protocolKeyExists := ruleData.CheckGet("protocol"); protocolKeyExists {
+		if protocolArray, err := protocolData.StringArray(); err == nil {
+			blockingRules.Protocol = protocolArray
+		}
+	}
+	if actionsData, actionsKeyExists := ruleData.CheckGet("actions"); actionsKeyExists {
+		actions, _ := actionsData.Array()
+		for i := range actions {
+			blockingRules.Actions = append(blockingRules.Actions, parseRuleAction(actionsData.GetIndex(i)))
+		}
+	}
+	if ruleSetsData, ruleSetsKeyExists := ruleData.CheckGet("rule_sets"); ruleSetsKeyExists {
+		ruleSets, _ := ruleSetsData.Array()
+		for i := range ruleSets {
+			ruleSetData := ruleSetsData.GetIndex(i)
+			ruleSet := RuleSet{
+				ID:         ruleSetData.Get("id").MustInt(),
+				RuleAction: parseRuleAction(ruleSetData),
+			}
+			groups, _ := ruleSetData.Get("groups").Array()
+			for j := range groups {
+				ruleSet.Groups = append(ruleSet.Groups, ruleSetData.Get("groups").GetIndex(j).MustInt())
+			}
+			blockingRules.RuleSets = append(blockingRules.RuleSets, ruleSet)
+		}
+	}
+	
+	return blockingRules
+}
+
+func parseRuleAction(actionData *simplejson.Json) RuleAction {
+	return RuleAction{
+		Action:         strings.ToLower(actionData.Get("action").MustString()),
+		Outbound:       actionData.Get("outbound").MustString(),
+		SpeedLimit:     uint64(actionData.Get("speed_limit").MustInt() * 1000000 / 8),
+		DomainStrategy: actionData.Get("dns_strategy").MustString(),
+		Domain:         actionData.Get("domain").MustStringArray(),
+		IP:             actionData.Get("ip").MustStringArray(),
+		Port:           actionData.Get("port").MustString(),
+		Protocol:       actionData.Get("protocol").MustStringArray(),
+	}
+}
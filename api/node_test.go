@@ -0,0 +1,166 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bitly/go-simplejson"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseBlockingRules(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		data     string
+		expected *BlockingRules
+	}{
+		{
+			desc:     "empty",
+			data:     `{}`,
+			expected: &BlockingRules{},
+		},
+		{
+			desc: "blackhole rule",
+			data: `{"ip": ["geoip:private"], "domain": ["geosite:ads"], "port": "25,465", "protocol": ["bittorrent"]}`,
+			expected: &BlockingRules{
+				IP:       []string{"geoip:private"},
+				Domain:   []string{"geosite:ads"},
+				Port:     "25,465",
+				Protocol: []string{"bittorrent"},
+			},
+		},
+		{
+			desc: "wrong types are ignored",
+			data: `{"ip": "geoip:private", "port": 25}`,
+			expected: &BlockingRules{},
+		},
+		{
+			desc: "actions and rule sets",
+			data: `{
+				"actions": [{"action": "Redirect", "outbound": "warp", "domain": ["geosite:netflix"]}],
+				"rule_sets": [{"id": 3, "action": "throttle", "speed_limit": 8, "port": "443"}]
+			}`,
+			expected: &BlockingRules{
+				Actions: []RuleAction{
+					{Action: RuleActionRedirect, Outbound: "warp", Domain: []string{"geosite:netflix"}},
+				},
+				RuleSets: []RuleSet{
+					{ID: 3, RuleAction: RuleAction{Action: RuleActionThrottle, SpeedLimit: 1000000, Port: "443"}},
+				},
+			},
+		},
+		{
+			desc: "rule set of plan groups",
+			data: `{
+				"rule_sets": [{"id": 4, "groups": [1, 2], "action": "block", "domain": ["geosite:category-ads"]}]
+			}`,
+			expected: &BlockingRules{
+				RuleSets: []RuleSet{
+					{ID: 4, Groups: []int{1, 2}, RuleAction: RuleAction{Action: RuleActionBlock, Domain: []string{"geosite:category-ads"}}},
+				},
+			},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			ruleData, err := simplejson.NewJson([]byte(test.data))
+			require.NoError(t, err)
+
+			assert.Equal(t, test.expected, parseBlockingRules(ruleData))
+		})
+	}
+}
+
+func Test_parseRuleAction(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		data     string
+		expected RuleAction
+	}{
+		{
+			desc:     "empty",
+			data:     `{}`,
+			expected: RuleAction{},
+		},
+		{
+			desc:     "action is lower cased",
+			data:     `{"action": "BLOCK", "ip": ["1.1.1.1"], "protocol": ["http"]}`,
+			expected: RuleAction{Action: RuleActionBlock, IP: []string{"1.1.1.1"}, Protocol: []string{"http"}},
+		},
+		{
+			desc:     "speed limit in mbps",
+			data:     `{"action": "throttle", "speed_limit": 100}`,
+			expected: RuleAction{Action: RuleActionThrottle, SpeedLimit: 12500000},
+		},
+		{
+			desc:     "dns strategy",
+			data:     `{"action": "dns", "dns_strategy": "UseIPv4", "domain": ["example.com"]}`,
+			expected: RuleAction{Action: RuleActionDNS, DomainStrategy: "UseIPv4", Domain: []string{"example.com"}},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			actionData, err := simplejson.NewJson([]byte(test.data))
+			require.NoError(t, err)
+
+			assert.Equal(t, test.expected, parseRuleAction(actionData))
+		})
+	}
+}
+
+func TestClient_GetNodeRules(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		status   int
+		body     string
+		expected *BlockingRules
+		err      string
+	}{
+		{
+			desc:     "rules",
+			status:   200,
+			body:     `{"rules":{"domain":["example.com"]}}`,
+			expected: &BlockingRules{Domain: []string{"example.com"}},
+		},
+		{
+			desc:   "not modified",
+			status: 304,
+			err:    RuleNotModified,
+		},
+		{
+			desc:   "no rules endpoint",
+			status: 404,
+			err:    RuleNotSupported,
+		},
+		{
+			desc:   "method not allowed",
+			status: 405,
+			err:    RuleNotSupported,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(test.status)
+				w.Write([]byte(test.body))
+			}))
+			defer server.Close()
+
+			client := New(&Config{APIHost: server.URL, NodeID: 1, Key: "key"})
+			rules, err := client.GetNodeRules()
+			if test.err != "" {
+				require.Error(t, err)
+				assert.Equal(t, test.err, err.Error())
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, rules)
+		})
+	}
+}
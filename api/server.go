@@ -0,0 +1,39 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// GetServerNodes returns the node IDs the panel assigned to this server, the
+// client must be created with the server key. NodeID of the config is ignored.
+func (c *Client) GetServerNodes() (nodeIDs []int, err error) {
+	res, err := c.client.R().
+		SetBody(map[string]string{"key": c.apiKey()}).
+		SetHeader("If-None-Match", c.eTags["nodes"]).
+		ForceContentType("application/json").
+		Post("/api/server/nodes")
+
+	if res != nil && res.StatusCode() == 304 {
+		return nil, errors.New(ServerNodesNotModified)
+	}
+
+	response, err := c.checkResponse(res, err)
+	if err != nil {
+		return nil, err
+	}
+
+	b, _ := response.Encode()
+	serverNodes := new(serverNodesResponse)
+	if err := json.Unmarshal(b, serverNodes); err != nil {
+		return nil, fmt.Errorf("parse server nodes failed: %s", res.String())
+	}
+
+	// Only remember the ETag once the response has been accepted
+	if res.Header().Get("Etag") != "" && res.Header().Get("Etag") != c.eTags["nodes"] {
+		c.eTags["nodes"] = res.Header().Get("Etag")
+	}
+
+	return serverNodes.Nodes, nil
+}
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"strconv"
+)
+
+func (c *Client) ReportNodeStatus(nodeStatus *NodeStatus) error {
+	data := Status{
+		Uptime:        nodeStatus.Uptime,
+		CPU:           nodeStatus.CPU,
+		MemTotal:      nodeStatus.MemTotal,
+		MemUsed:       nodeStatus.MemUsed,
+		Load1:         nodeStatus.Load1,
+		Load5:         nodeStatus.Load5,
+		Load15:        nodeStatus.Load15,
+		NetIn:         nodeStatus.NetIn,
+		NetOut:        nodeStatus.NetOut,
+		Connections:   nodeStatus.Connections,
+		CoreVersion:   nodeStatus.CoreVersion,
+		CertExpiry:    nodeStatus.CertExpiry,
+		LastSyncError: nodeStatus.LastSyncError,
+		State:         nodeStatus.State,
+		Restarts:      nodeStatus.Restarts,
+	}
+
+	postData := &PostData{
+		Key:  c.apiKey(),
+		Data: data,
+	}
+	res, err := c.client.R().
+		SetBody(postData).
+		SetPathParam("serverId", strconv.Itoa(c.NodeID)).
+		ForceContentType("application/json").
+		Post("/api/server/status/{serverId}")
+
+	_, err = c.checkResponse(res, err)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -26,7 +26,7 @@ func (c *Client) parseSubscriptionResponse(res *resty.Response, err error) (*Sub
 
 func (c *Client) GetSubscriptionList() (SubscriptionList *[]SubscriptionInfo, err error) {
 	res, err := c.client.R().
-		SetBody(map[string]string{"key": c.Key}).
+		SetBody(map[string]string{"key": c.apiKey()}).
 		SetHeader("If-None-Match", c.eTags["subscriptions"]).
 		SetPathParam("serverId", strconv.Itoa(c.NodeID)).
 		SetResult(&SubscriptionResponse{}).
@@ -74,6 +74,9 @@ func (c *Client) ParseSubscriptionList(subscriptionResponse *[]Subscription) (*[
 			Passwd:     subscription.Passwd,
 			IPLimit:    ipLimit,
 			SpeedLimit: speedLimit,
+			RuleSets:   subscription.RuleSets,
+			GroupId:    subscription.GroupId,
+			PublicKey:  subscription.PublicKey,
 		})
 	}
 
@@ -91,7 +94,7 @@ func (c *Client) ReportTraffic(subscriptionTraffic *[]SubscriptionTraffic) error
 	}
 	
 	postData := &PostData{
-		Key:  c.Key,
+		Key:  c.apiKey(),
 		Data: data,
 	}
 	res, err := c.client.R().
@@ -129,7 +132,7 @@ func (c *Client) ReportOnlineIPs(onlineSubscriptionList *[]OnlineIP) error {
 	c.LastReportOnline = reportOnline 
 
 	postData := &PostData{
-		Key:  c.Key,
+		Key:  c.apiKey(),
 		Data: data,
 	}
 	
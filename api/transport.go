@@ -0,0 +1,127 @@
+package api
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/bitly/go-simplejson"
+)
+
+// The transport parsers are shared by the node and its transit servers, the
+// keys follow the xray config except for the ones older panels already send
+
+func parseXhttpSettings(xhttpSettings *simplejson.Json) (*XhttpSettings, error) {
+	settings := &XhttpSettings{}
+	
+	settings.Host = xhttpSettings.Get("host").MustString()
+	settings.Path = xhttpSettings.Get("path").MustString()
+	settings.Mode = xhttpSettings.Get("mode").MustString()
+	settings.NoSSEHeader = xhttpSettings.Get("NoSSEHeader").MustBool()
+	settings.NoGRPCHeader = xhttpSettings.Get("NoGRPCHeader").MustBool()
+	settings.Headers = parseHeaders(xhttpSettings)
+	settings.XPaddingBytes = parseRange(xhttpSettings.Get("xPaddingBytes"))
+	settings.ScMaxEachPostBytes = parseRange(xhttpSettings.Get("scMaxEachPostBytes"))
+	settings.ScMinPostsIntervalMs = parseRange(xhttpSettings.Get("scMinPostsIntervalMs"))
+	settings.ScMaxBufferedPosts = xhttpSettings.Get("scMaxBufferedPosts").MustInt64()
+	settings.ScStreamUpServerSecs = parseRange(xhttpSettings.Get("scStreamUpServerSecs"))
+	
+	var err error
+	if settings.Xmux, err = parseRaw(xhttpSettings, "xmux"); err != nil {
+		return nil, err
+	}
+	if settings.DownloadSettings, err = parseRaw(xhttpSettings, "downloadSettings"); err != nil {
+		return nil, err
+	}
+	if settings.Extra, err = parseRaw(xhttpSettings, "extra"); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+func parseKcpSettings(kcpSettings *simplejson.Json) (*KcpSettings, error) {
+	settings := &KcpSettings{}
+	
+	settings.Seed = kcpSettings.Get("seed").MustString()
+	settings.Congestion = kcpSettings.Get("congestion").MustBool()
+	settings.Mtu = uint32(kcpSettings.Get("mtu").MustInt())
+	settings.Tti = uint32(kcpSettings.Get("tti").MustInt())
+	settings.UplinkCapacity = uint32(kcpSettings.Get("uplinkCapacity").MustInt())
+	settings.DownlinkCapacity = uint32(kcpSettings.Get("downlinkCapacity").MustInt())
+	settings.ReadBufferSize = uint32(kcpSettings.Get("readBufferSize").MustInt())
+	settings.WriteBufferSize = uint32(kcpSettings.Get("writeBufferSize").MustInt())
+	
+	var err error
+	if settings.Header, err = parseRaw(kcpSettings, "header"); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+func parseGrpcSettings(grpcSettings *simplejson.Json) *GrpcSettings {
+	settings := &GrpcSettings{}
+	
+	settings.ServiceName = grpcSettings.Get("servicename").MustString()
+	settings.Authority = grpcSettings.Get("authority").MustString()
+	settings.MultiMode = grpcSettings.Get("multiMode").MustBool()
+	settings.IdleTimeout = int32(grpcSettings.Get("idle_timeout").MustInt())
+	settings.HealthCheckTimeout = int32(grpcSettings.Get("health_check_timeout").MustInt())
+	settings.PermitWithoutStream = grpcSettings.Get("permit_without_stream").MustBool()
+	settings.InitialWindowsSize = int32(grpcSettings.Get("initial_windows_size").MustInt())
+	settings.UserAgent = grpcSettings.Get("user_agent").MustString()
+	return settings
+}
+
+func parseWsSettings(wsSettings *simplejson.Json) *WsSettings {
+	settings := &WsSettings{}
+	
+	settings.Host = wsSettings.Get("host").MustString()
+	settings.Path = wsSettings.Get("path").MustString()
+	settings.HeartbeatPeriod = uint32(wsSettings.Get("heartbeat").MustInt())
+	settings.Headers = parseHeaders(wsSettings)
+	return settings
+}
+
+func parseHttpSettings(httpupgradeSettings *simplejson.Json) *HttpSettings {
+	settings := &HttpSettings{}
+	
+	settings.Host = httpupgradeSettings.Get("host").MustString()
+	settings.Path = httpupgradeSettings.Get("path").MustString()
+	settings.Headers = parseHeaders(httpupgradeSettings)
+	return settings
+}
+
+// parseHeaders reads the custom request headers of a transport
+func parseHeaders(settings *simplejson.Json) map[string]string {
+	headerData, err := settings.Get("headers").Map()
+	if err != nil || len(headerData) == 0 {
+		return nil
+	}
+	
+	headers := make(map[string]string, len(headerData))
+	for name, value := range headerData {
+		if v, ok := value.(string); ok {
+			headers[name] = v
+		}
+	}
+	return headers
+}
+
+// parseRange reads a range like "100-1000", the panel may send a number
+func parseRange(value *simplejson.Json) string {
+	if v, err := value.String(); err == nil {
+		return v
+	}
+	if v, err := value.Int(); err == nil {
+		return strconv.Itoa(v)
+	}
+	return ""
+}
+
+// parseRaw keeps a nested object as it is, for the builders to decode
+func parseRaw(settings *simplejson.Json, key string) (json.RawMessage, error) {
+	value, ok := settings.CheckGet(key)
+	if !ok {
+		return nil, nil
+	}
+	return value.MarshalJSON()
+}
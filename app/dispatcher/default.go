@@ -5,9 +5,11 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"fmt"
 
+	"github.com/xtls/xray-core/app/router"
 	"github.com/xtls/xray-core/common"
 	"github.com/xtls/xray-core/common/buf"
 	"github.com/xtls/xray-core/common/errors"
@@ -103,6 +105,38 @@ type DefaultDispatcher struct {
 	stats  stats.Manager
 	fdns   dns.FakeDNSEngine
 	Limiter *limiter.Limiter
+	AuditRules *sync.Map // Key: Rule tag
+	RelayOutbounds *sync.Map // Key: Email, value: *RelayGroup
+	InboundUsers *sync.Map // Key: Tag|username or Tag|tunnel IP, value: *protocol.MemoryUser
+	InboundAliases *sync.Map // Key: tag of an extra inbound, value: Tag of its node
+	DefaultOutbounds *sync.Map // Key: Tag, value: outbound of the traffic no rule matched
+	RuleSets *sync.Map // Key: rule set tag, value: *RuleSet
+	RuleSetUsers *sync.Map // Key: Email, value: []string rule set and plan group tags of the subscription
+	RuleSetGroups *sync.Map // Key: plan group tag, value: []string rule set tags of the group
+	Connections *sync.Map // Key: Tag, value: *atomic.Int64 links still open
+}
+
+// RelayGroup holds the relay outbounds of a subscription, a group with several
+// outbounds is used round-robin
+type RelayGroup struct {
+	Tags []string
+	next uint32
+}
+
+// Pick returns the relay outbound for a new connection
+func (g *RelayGroup) Pick() string {
+	if len(g.Tags) == 1 {
+		return g.Tags[0]
+	}
+	n := atomic.AddUint32(&g.next, 1)
+	return g.Tags[int(n)%len(g.Tags)]
+}
+
+// RuleSet is a panel rule applied only to the subscriptions using it. A nil
+// Condition matches every destination.
+type RuleSet struct {
+	OutboundTag string
+	Condition   router.Condition
 }
 
 func init() {
@@ -127,6 +161,15 @@ func (d *DefaultDispatcher) Init(config *Config, om outbound.Manager, router rou
 	d.policy = pm
 	d.stats = sm
 	d.Limiter = limiter.New()
+	d.AuditRules = new(sync.Map)
+	d.RelayOutbounds = new(sync.Map)
+	d.InboundUsers = new(sync.Map)
+	d.InboundAliases = new(sync.Map)
+	d.DefaultOutbounds = new(sync.Map)
+	d.RuleSets = new(sync.Map)
+	d.RuleSetUsers = new(sync.Map)
+	d.RuleSetGroups = new(sync.Map)
+	d.Connections = new(sync.Map)
 	return nil
 }
 
@@ -143,6 +186,67 @@ func (*DefaultDispatcher) Start() error {
 // Close implements common.Closable.
 func (*DefaultDispatcher) Close() error { return nil }
 
+// inboundAlias gives a connection to an extra inbound of a node the node tag,
+// so that the rules, limiter and users of the node apply to it
+func (d *DefaultDispatcher) inboundAlias(ctx context.Context) {
+	sessionInbound := session.InboundFromContext(ctx)
+	if sessionInbound == nil {
+		return
+	}
+	
+	if tag, ok := d.InboundAliases.Load(sessionInbound.Tag); ok {
+		sessionInbound.Tag = tag.(string)
+	}
+}
+
+// ActiveConnections returns the number of links of an inbound that are still open
+func (d *DefaultDispatcher) ActiveConnections(tag string) int64 {
+	if count, ok := d.Connections.Load(tag); ok {
+		return count.(*atomic.Int64).Load()
+	}
+	return 0
+}
+
+// TotalConnections returns the number of links of every inbound that are still open
+func (d *DefaultDispatcher) TotalConnections() int64 {
+	var total int64
+	d.Connections.Range(func(_, count any) bool {
+		total += count.(*atomic.Int64).Load()
+		return true
+	})
+	return total
+}
+
+// inboundUser sets the subscription of a connection to an inbound without
+// user manager. The socks and http inbounds only know the username, the
+// wireguard inbound only knows the tunnel IP of the peer.
+func (d *DefaultDispatcher) inboundUser(ctx context.Context) {
+	sessionInbound := session.InboundFromContext(ctx)
+	if sessionInbound == nil {
+		return
+	}
+	
+	var key string
+	switch sessionInbound.Name {
+		case "socks", "http":
+			if sessionInbound.User == nil || sessionInbound.User.Email == "" {
+				return
+			}
+			key = sessionInbound.Tag + "|" + sessionInbound.User.Email
+		case "wireguard":
+			if sessionInbound.User != nil || !sessionInbound.Source.Address.Family().IsIP() {
+				return
+			}
+			key = sessionInbound.Tag + "|" + sessionInbound.Source.Address.IP().String()
+		default:
+			return
+	}
+	
+	if user, ok := d.InboundUsers.Load(key); ok {
+		sessionInbound.User = user.(*protocol.MemoryUser)
+	}
+}
+
 func (d *DefaultDispatcher) getLink(ctx context.Context) (*transport.Link, *transport.Link, error) {
 	opt := pipe.OptionsFromContext(ctx)
 	uplinkReader, uplinkWriter := pipe.New(opt...)
@@ -295,6 +399,12 @@ func (d *DefaultDispatcher) WrapLink(ctx context.Context, policyManager policy.M
 			}
 		}
 	}
+	
+	// Counted last so the close or interrupt of the outbound reaches it first
+	if sessionInbound != nil && sessionInbound.Tag != "" {
+		count, _ := d.Connections.LoadOrStore(sessionInbound.Tag, new(atomic.Int64))
+		link.Writer = newConnWriter(link.Writer, count.(*atomic.Int64))
+	}
 
 	return link, nil
 }
@@ -304,6 +414,8 @@ func (d *DefaultDispatcher) shouldOverride(ctx context.Context, result SniffResu
 	if domain == "" {
 		return false
 	}
+	// The excluded domains and patterns are lowercased by the sniffing config
+	lowerDomain := strings.ToLower(domain)
 	for _, d := range request.ExcludeForDomain {
 		if strings.HasPrefix(d, "regexp:") {
 			pattern := d[7:]
@@ -312,11 +424,11 @@ func (d *DefaultDispatcher) shouldOverride(ctx context.Context, result SniffResu
 				errors.LogInfo(ctx, "Unable to compile regex")
 				continue
 			}
-			if re.MatchString(domain) {
+			if re.MatchString(lowerDomain) {
 				return false
 			}
 		} else {
-			if strings.ToLower(domain) == d {
+			if lowerDomain == d {
 				return false
 			}
 		}
@@ -344,11 +456,47 @@ func (d *DefaultDispatcher) shouldOverride(ctx context.Context, result SniffResu
 	return false
 }
 
+// sniffDestination sniffs a link with the sniffing options of its inbound and
+// returns the destination to route, Dispatch and DispatchLink both use it so
+// every option behaves the same for a node
+func (d *DefaultDispatcher) sniffDestination(ctx context.Context, cReader *cachedReader, content *session.Content, ob *session.Outbound, destination net.Destination) net.Destination {
+	sniffingRequest := content.SniffingRequest
+	result, err := sniffer(ctx, cReader, sniffingRequest.MetadataOnly, destination.Network)
+	if err != nil {
+		return destination
+	}
+	content.Protocol = result.Protocol()
+	if !d.shouldOverride(ctx, result, sniffingRequest, destination) {
+		return destination
+	}
+	
+	domain := result.Domain()
+	errors.LogInfo(ctx, "sniffed domain: ", domain)
+	destination.Address = net.ParseAddress(domain)
+	protocol := result.Protocol()
+	if resComp, ok := result.(SnifferResultComposite); ok {
+		protocol = resComp.ProtocolForDomainResult()
+	}
+	isFakeIP := false
+	if fkr0, ok := d.fdns.(dns.FakeDNSEngineRev0); ok && fkr0.IsIPInIPPool(ob.Target.Address) {
+		isFakeIP = true
+	}
+	// A route only override keeps the client target unless it is a fake IP
+	if sniffingRequest.RouteOnly && protocol != "fakedns" && protocol != "fakedns+others" && !isFakeIP {
+		ob.RouteTarget = destination
+	} else {
+		ob.Target = destination
+	}
+	return destination
+}
+
 // Dispatch implements routing.Dispatcher.
 func (d *DefaultDispatcher) Dispatch(ctx context.Context, destination net.Destination) (*transport.Link, error) {
 	if !destination.IsValid() {
 		panic("Dispatcher: Invalid destination.")
 	}
+	d.inboundAlias(ctx)
+	d.inboundUser(ctx)
 	outbounds := session.OutboundsFromContext(ctx)
 	if len(outbounds) == 0 {
 		outbounds = []*session.Outbound{{}}
@@ -376,28 +524,7 @@ func (d *DefaultDispatcher) Dispatch(ctx context.Context, destination net.Destin
 				reader: outbound.Reader.(*pipe.Reader),
 			}
 			outbound.Reader = cReader
-			result, err := sniffer(ctx, cReader, sniffingRequest.MetadataOnly, destination.Network)
-			if err == nil {
-				content.Protocol = result.Protocol()
-			}
-			if err == nil && d.shouldOverride(ctx, result, sniffingRequest, destination) {
-				domain := result.Domain()
-				errors.LogInfo(ctx, "sniffed domain: ", domain)
-				destination.Address = net.ParseAddress(domain)
-				protocol := result.Protocol()
-				if resComp, ok := result.(SnifferResultComposite); ok {
-					protocol = resComp.ProtocolForDomainResult()
-				}
-				isFakeIP := false
-				if fkr0, ok := d.fdns.(dns.FakeDNSEngineRev0); ok && fkr0.IsIPInIPPool(ob.Target.Address) {
-					isFakeIP = true
-				}
-				if sniffingRequest.RouteOnly && protocol != "fakedns" && protocol != "fakedns+others" && !isFakeIP {
-					ob.RouteTarget = destination
-				} else {
-					ob.Target = destination
-				}
-			}
+			destination = d.sniffDestination(ctx, cReader, content, ob, destination)
 			d.routedDispatch(ctx, outbound, destination)
 		}()
 	}
@@ -409,6 +536,8 @@ func (d *DefaultDispatcher) DispatchLink(ctx context.Context, destination net.De
 	if !destination.IsValid() {
 		return errors.New("Dispatcher: Invalid destination.")
 	}
+	d.inboundAlias(ctx)
+	d.inboundUser(ctx)
 	outbounds := session.OutboundsFromContext(ctx)
 	if len(outbounds) == 0 {
 		outbounds = []*session.Outbound{{}}
@@ -435,28 +564,7 @@ func (d *DefaultDispatcher) DispatchLink(ctx context.Context, destination net.De
 			reader: outbound.Reader.(buf.TimeoutReader),
 		}
 		outbound.Reader = cReader
-		result, err := sniffer(ctx, cReader, sniffingRequest.MetadataOnly, destination.Network)
-		if err == nil {
-			content.Protocol = result.Protocol()
-		}
-		if err == nil && d.shouldOverride(ctx, result, sniffingRequest, destination) {
-			domain := result.Domain()
-			errors.LogInfo(ctx, "sniffed domain: ", domain)
-			destination.Address = net.ParseAddress(domain)
-			protocol := result.Protocol()
-			if resComp, ok := result.(SnifferResultComposite); ok {
-				protocol = resComp.ProtocolForDomainResult()
-			}
-			isFakeIP := false
-			if fkr0, ok := d.fdns.(dns.FakeDNSEngineRev0); ok && fkr0.IsIPInIPPool(ob.Target.Address) {
-				isFakeIP = true
-			}
-			if sniffingRequest.RouteOnly && protocol != "fakedns" && protocol != "fakedns+others" && !isFakeIP {
-				ob.RouteTarget = destination
-			} else {
-				ob.Target = destination
-			}
-		}
+		destination = d.sniffDestination(ctx, cReader, content, ob, destination)
 		d.routedDispatch(ctx, outbound, destination)
 	}
 
@@ -527,6 +635,7 @@ func (d *DefaultDispatcher) routedDispatch(ctx context.Context, link *transport.
 
 	routingLink := routing_session.AsRoutingContext(ctx)
 	inTag := routingLink.GetInboundTag()
+	ruleTag := ""
 	isPickRoute := 0
 	if forcedOutboundTag := session.GetForcedOutboundTagFromContext(ctx); forcedOutboundTag != "" {
 		ctx = session.SetForcedOutboundTagToContext(ctx, "")
@@ -543,6 +652,7 @@ func (d *DefaultDispatcher) routedDispatch(ctx context.Context, link *transport.
 	} else if d.router != nil {
 		if route, err := d.router.PickRoute(routingLink); err == nil {
 			outTag := route.GetOutboundTag()
+			ruleTag = route.GetRuleTag()
 			if h := d.ohm.GetHandler(outTag); h != nil {
 				isPickRoute = 2
 				if route.GetRuleTag() == "" {
@@ -562,6 +672,49 @@ func (d *DefaultDispatcher) routedDispatch(ctx context.Context, link *transport.
 		}
 	}
 
+	// The rule sets of the subscription apply when no router rule matched
+	if isPickRoute == 0 {
+		if ruleSetTag, ruleSet := d.matchRuleSet(ctx, routingLink); ruleSet != nil {
+			if h := d.ohm.GetHandler(ruleSet.OutboundTag); h != nil {
+				isPickRoute = 2
+				ruleTag = ruleSetTag
+				errors.LogInfo(ctx, "Hit rule set: [", ruleSetTag, "] so taking detour [", ruleSet.OutboundTag, "] for [", destination, "]")
+				handler = h
+			} else {
+				errors.LogWarning(ctx, "non existing rule set outTag: ", ruleSet.OutboundTag)
+				common.Close(link.Writer)
+				common.Interrupt(link.Reader)
+				return
+			}
+		}
+	}
+
+	// Relayed subscriptions leave through their own relay outbound, unless a
+	// rule sent the traffic somewhere else than the node egress
+	if isPickRoute != 1 && (handler == nil || handler.Tag() == inTag) {
+		if h := d.relayHandler(ctx); h != nil {
+			isPickRoute = 2
+			handler = h
+		}
+	}
+
+	// The traffic of a node no rule matched leaves through the node outbound.
+	// It is not a router rule, so that the rules of the node added later are
+	// still matched first.
+	if handler == nil {
+		if tag, ok := d.DefaultOutbounds.Load(inTag); ok {
+			if h := d.ohm.GetHandler(tag.(string)); h != nil {
+				isPickRoute = 2
+				handler = h
+			} else {
+				errors.LogWarning(ctx, "non existing default outTag: ", tag)
+				common.Close(link.Writer)
+				common.Interrupt(link.Reader)
+				return
+			}
+		}
+	}
+
 	if handler == nil {
 		handler = d.ohm.GetDefaultHandler()
 	}
@@ -589,5 +742,83 @@ func (d *DefaultDispatcher) routedDispatch(ctx context.Context, link *transport.
 		log.Record(accessMessage)
 	}
 
+	if ruleTag != "" {
+		d.applyRuleActions(ctx, link, destination, ruleTag)
+	}
+
 	handler.Dispatch(ctx, link)
 }
+
+// matchRuleSet returns the first rule set of the session user matching the
+// connection, the membership is a single lookup by email
+func (d *DefaultDispatcher) matchRuleSet(ctx context.Context, routingLink routing.Context) (string, *RuleSet) {
+	sessionInbound := session.InboundFromContext(ctx)
+	if sessionInbound == nil || sessionInbound.User == nil || len(sessionInbound.User.Email) == 0 {
+		return "", nil
+	}
+
+	tags, ok := d.RuleSetUsers.Load(sessionInbound.User.Email)
+	if !ok {
+		return "", nil
+	}
+	for _, tag := range tags.([]string) {
+		// A plan group tag stands for the rule sets of the group
+		groupTags := []string{tag}
+		if value, ok := d.RuleSetGroups.Load(tag); ok {
+			groupTags = value.([]string)
+		}
+		for _, ruleSetTag := range groupTags {
+			value, ok := d.RuleSets.Load(ruleSetTag)
+			if !ok {
+				continue
+			}
+			ruleSet := value.(*RuleSet)
+			if ruleSet.Condition == nil || ruleSet.Condition.Apply(routingLink) {
+				return ruleSetTag, ruleSet
+			}
+		}
+	}
+	return "", nil
+}
+
+// relayHandler looks up the relay outbound of the session user
+func (d *DefaultDispatcher) relayHandler(ctx context.Context) outbound.Handler {
+	sessionInbound := session.InboundFromContext(ctx)
+	if sessionInbound == nil || sessionInbound.User == nil || len(sessionInbound.User.Email) == 0 {
+		return nil
+	}
+
+	if group, ok := d.RelayOutbounds.Load(sessionInbound.User.Email); ok {
+		relayGroup := group.(*RelayGroup)
+		if len(relayGroup.Tags) == 0 {
+			return nil
+		}
+		tag := relayGroup.Pick()
+		if h := d.ohm.GetHandler(tag); h != nil {
+			return h
+		}
+		errors.LogWarning(ctx, "non existing relay outTag: ", tag)
+	}
+	return nil
+}
+
+// applyRuleActions audits and throttles the traffic matched by panel rules
+func (d *DefaultDispatcher) applyRuleActions(ctx context.Context, link *transport.Link, destination net.Destination, ruleTag string) {
+	var email string
+	if sessionInbound := session.InboundFromContext(ctx); sessionInbound != nil && sessionInbound.User != nil {
+		email = sessionInbound.User.Email
+	}
+
+	if _, ok := d.AuditRules.Load(ruleTag); ok {
+		errors.LogWarning(ctx, "audit rule [", ruleTag, "] matched [", destination, "] for user [", email, "]")
+	}
+
+	if bucket, ok := d.Limiter.GetRuleLimiter(ruleTag, email); ok {
+		link.Writer = d.Limiter.RateWriter(link.Writer, bucket)
+		if reader, ok := link.Reader.(buf.TimeoutReader); ok {
+			link.Reader = d.Limiter.RateTimeoutReader(reader, bucket)
+		} else {
+			link.Reader = d.Limiter.RateReader(link.Reader, bucket)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package dispatcher
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRelayGroup_Pick(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		tags     []string
+		expected []string
+	}{
+		{
+			desc:     "single outbound",
+			tags:     []string{"a"},
+			expected: []string{"a", "a", "a"},
+		},
+		{
+			desc:     "round robin",
+			tags:     []string{"a", "b", "c"},
+			expected: []string{"b", "c", "a", "b"},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			group := &RelayGroup{Tags: test.tags}
+
+			var picked []string
+			for range test.expected {
+				picked = append(picked, group.Pick())
+			}
+			assert.Equal(t, test.expected, picked)
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package dispatcher
 
 import (
+	"sync"
+	"sync/atomic"
+
 	"github.com/xtls/xray-core/common"
 	"github.com/xtls/xray-core/common/buf"
 	"github.com/xtls/xray-core/features/stats"
@@ -22,4 +25,32 @@ func (w *SizeStatWriter) Close() error {
 
 func (w *SizeStatWriter) Interrupt() {
 	common.Interrupt(w.Writer)
-}
\ No newline at end of file
+}
+// connWriter keeps a link counted as open until the outbound closes or
+// interrupts its downlink
+type connWriter struct {
+	buf.Writer
+	count *atomic.Int64
+	once  sync.Once
+}
+
+func newConnWriter(writer buf.Writer, count *atomic.Int64) *connWriter {
+	count.Add(1)
+	return &connWriter{Writer: writer, count: count}
+}
+
+func (w *connWriter) done() {
+	w.once.Do(func() {
+		w.count.Add(-1)
+	})
+}
+
+func (w *connWriter) Close() error {
+	w.done()
+	return common.Close(w.Writer)
+}
+
+func (w *connWriter) Interrupt() {
+	w.done()
+	common.Interrupt(w.Writer)
+}
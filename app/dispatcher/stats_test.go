@@ -0,0 +1,61 @@
+package dispatcher
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xtls/xray-core/common/buf"
+)
+
+func Test_connWriter(t *testing.T) {
+	testCases := []struct {
+		desc  string
+		close func(w *connWriter)
+	}{
+		{
+			desc:  "close",
+			close: func(w *connWriter) { w.Close() },
+		},
+		{
+			desc:  "interrupt",
+			close: func(w *connWriter) { w.Interrupt() },
+		},
+		{
+			desc: "close after interrupt",
+			close: func(w *connWriter) {
+				w.Interrupt()
+				w.Close()
+			},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			count := new(atomic.Int64)
+			w := newConnWriter(buf.Discard, count)
+			assert.Equal(t, int64(1), count.Load())
+			test.close(w)
+			assert.Equal(t, int64(0), count.Load())
+		})
+	}
+}
+
+func TestTotalConnections(t *testing.T) {
+	d := &DefaultDispatcher{Connections: new(sync.Map)}
+	assert.Equal(t, int64(0), d.TotalConnections())
+
+	first, second := new(atomic.Int64), new(atomic.Int64)
+	d.Connections.Store("a", first)
+	d.Connections.Store("b", second)
+	w1 := newConnWriter(buf.Discard, first)
+	newConnWriter(buf.Discard, second)
+	newConnWriter(buf.Discard, second)
+	assert.Equal(t, int64(3), d.TotalConnections())
+	assert.Equal(t, int64(2), d.ActiveConnections("b"))
+
+	w1.Close()
+	assert.Equal(t, int64(2), d.TotalConnections())
+	assert.Equal(t, int64(0), d.ActiveConnections("c"))
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"reflect"
+	"sync"
 	"time"
 	
 	"github.com/xtls/xray-core/core"
@@ -12,7 +13,9 @@ import (
 	"github.com/xmplusdev/xmplus-server/node"
 	"github.com/xmplusdev/xmplus-server/subscription"
 	"github.com/xmplusdev/xmplus-server/helper/cert"
+	"github.com/xmplusdev/xmplus-server/helper/probe"
 	"github.com/xmplusdev/xmplus-server/helper/task"
+	"github.com/xmplusdev/xmplus-server/helper/sysinfo"
 )
 
 type ManagerInterface interface {
@@ -25,30 +28,46 @@ type Controller struct {
 	clientInfo   api.ClientInfo
 	client       api.API
 	nodeInfo     *api.NodeInfo
-	relaynodeInfo *api.RelayNodeInfo
+	relayNodes   []*api.RelayNodeInfo
+	relayHealth  map[string]probe.Result
+	relaySelection string
+	relaySubscriptions *[]api.SubscriptionInfo
+	relayLock    sync.Mutex
+	rules        *api.BlockingRules
 	Tag          string
 	LogPrefix    string
-	RelayTag     string
+	RelayTags    []string
 	Relay        bool
+	bridge       bool
 	subscriptionList  *[]api.SubscriptionInfo
 	taskManager  *task.Manager
 	startAt      time.Time
 	manager      ManagerInterface
 	nodeManager  *node.Manager 
 	subManager   *subscription.Manager
+	sysCollector *sysinfo.Collector
+	syncLock     sync.RWMutex
+	lastSyncError string
+	restarts     int
+	state        func() string
+	onFailure    func(err error)
+	transitRetry bool // the transit servers are fetched again on the next sync
 }
 
-// New return a Controller service with default parameters.
-func New(server *core.Instance, api api.API, config *node.Config) *Controller {
+// New return a Controller service with default parameters, the node manager
+// is shared by the controllers on the same core.
+func New(server *core.Instance, nodeManager *node.Manager, api api.API, config *node.Config) *Controller {
 	controller := &Controller{
 		server:      server,
 		config:      config,
 		client:      api,
 		startAt:     time.Now(),
 		taskManager: task.NewManager(), 
-		nodeManager: node.NewManager(server),
+		nodeManager: nodeManager,
 		subManager:  subscription.NewManager(server, api),
+		sysCollector: sysinfo.NewCollector(),
 	}
+	controller.taskManager.SetErrorHandler(controller.taskFailed)
 
 	return controller
 }
@@ -71,6 +90,8 @@ func (c *Controller) RestartManager() error {
 // Start implement the Start() function of the service interface
 func (c *Controller) Start() error {
 	c.clientInfo = c.client.Describe()
+	// A restarted controller uses the client of the one it replaces
+	c.client.ResetETags()
 	
 	newNodeInfo, err := c.client.GetNodeInfo() 
 	if err != nil {
@@ -79,6 +100,14 @@ func (c *Controller) Start() error {
 	c.nodeInfo = newNodeInfo
 	c.Tag = c.buildNodeTag()
 	
+	// Blocking rules served by the rules endpoint take precedence
+	if rules, err := c.client.GetNodeRules(); err == nil {
+		c.rules = rules
+		c.nodeInfo.BlockingRules = rules
+	} else if err.Error() != api.RuleNotModified && err.Error() != api.RuleNotSupported {
+		log.Print(err)
+	}
+	
 	// Update Subscription
 	subscriptionInfo, err := c.client.GetSubscriptionList() 
 	if err != nil {
@@ -87,35 +116,27 @@ func (c *Controller) Start() error {
 	c.subscriptionList = subscriptionInfo
 	
 	c.Relay = false
-	// Add new relay tag
-	if c.nodeInfo.RelayType == 1 && c.nodeInfo.RelayNodeID > 0 {
-		newRelayNodeInfo, err := c.client.GetTransitNode()
+	// Add new relay tags
+	if c.nodeInfo.RelayType == api.RelayTypeTransit && c.nodeInfo.RelayNodeID > 0 {
+		newRelayNodes, err := c.client.GetTransitNodes()
 		if err != nil {
-			log.Panic(err)
-			return nil
-		}	
-		c.relaynodeInfo = newRelayNodeInfo
-		c.RelayTag = c.buildRNodeTag()
+			return fmt.Errorf("get transit node failed: %w", err)
+		}
 		
-		err = c.nodeManager.AddRelayTag(
-			newRelayNodeInfo,
-			c.RelayTag,
-			c.Tag,
-			c.subscriptionList,
-		)
+		c.relayLock.Lock()
+		err = c.addRelay(newRelayNodes, c.subscriptionList)
+		c.relayLock.Unlock()
 		if err != nil {
-			log.Panic(err)
 			return err
 		}
-		c.Relay = true
 	}
 	
 	err = c.nodeManager.AddRuleTag(
 		c.nodeInfo, 
 		c.Tag,
+		c.subscriptionList,
 	)
 	if err != nil {
-		log.Panic(err)
 		return err
 	}
 	
@@ -126,19 +147,25 @@ func (c *Controller) Start() error {
 		c.config,
 	)
 	if err != nil {
-		log.Panic(err)
+		return err
+	}
+	
+	c.bridge = false
+	if err := c.bridgeMonitor(c.Tag, false); err != nil {
 		return err
 	}
 	
 	// Add user Subscriptions
-	err = c.subManager.AddNewSubscription(
+	err = c.addSubscriptions(
 		subscriptionInfo, 
 		newNodeInfo,
-		c.Tag,
 	)
 	if err != nil {
 		return err
 	}
+	if err := c.addReverseUser(newNodeInfo); err != nil {
+		return err
+	}
 	
 	// Add Limiter
 	err = c.nodeManager.AddInboundLimiter(
@@ -168,14 +195,27 @@ func (c *Controller) Start() error {
 		},
 	))
 	
+	c.taskManager.Add(task.NewWithInterval(
+		"status",
+		time.Duration(c.nodeInfo.UpdateTime)*time.Second,
+		c.statusMonitor,
+	))
+	
+	c.taskManager.Add(task.NewWithInterval(
+		"transit health",
+		transitProbeInterval,
+		c.transitMonitor,
+	))
+	
 	// Check cert service if needed
-	if c.nodeInfo.SecurityType == "tls" { 
-		if c.nodeInfo.TlsSettings.CertMode != "none" {
+	for _, inboundInfo := range append([]*api.NodeInfo{c.nodeInfo}, c.nodeInfo.Inbounds...) {
+		if inboundInfo.SecurityType == "tls" && inboundInfo.TlsSettings.CertMode != "none" {
 			c.taskManager.Add(task.NewWithInterval(
 				"cert renew",
 				time.Duration(c.nodeInfo.UpdateTime)*time.Second*60,
 				c.certMonitor,
 			))
+			break
 		}
 	}
 
@@ -185,6 +225,15 @@ func (c *Controller) Start() error {
 }
 
 func (c *Controller) nodeInfoMonitor() (err error) {
+	var syncErr error
+	defer func() {
+		if err != nil {
+			syncErr = err
+		}
+		c.setSyncError(syncErr)
+	}()
+	
+	oldTag := c.Tag
 	var nodeInfoChanged = true
 	newNodeInfo, err := c.client.GetNodeInfo()
 	if err != nil {
@@ -192,6 +241,7 @@ func (c *Controller) nodeInfoMonitor() (err error) {
 			nodeInfoChanged = false
 			newNodeInfo = c.nodeInfo
 		} else {
+			syncErr = err
 			log.Print(err)
 			return nil
 		}
@@ -205,57 +255,62 @@ func (c *Controller) nodeInfoMonitor() (err error) {
 			subscriptionChanged = false
 			newSubscriptionInfo = c.subscriptionList
 		} else {
+			syncErr = err
 			log.Print(err)
 			return nil
 		}
 	}	
 	
-	var InfoUpdated = false	
-	if subscriptionChanged || nodeInfoChanged {
-		InfoUpdated = true
+	// The transit node is part of the node info payload
+	transitChanged := nodeInfoChanged
+	
+	// Blocking rules have their own endpoint and ETag
+	newRules, err := c.client.GetNodeRules()
+	if err != nil {
+		switch err.Error() {
+			case api.RuleNotModified:
+				newRules = c.rules
+			case api.RuleNotSupported:
+				// The rules of the node info payload apply
+				newRules = nil
+			default:
+				syncErr = err
+				log.Print(err)
+				newRules = c.rules
+		}
 	}
+	c.rules = newRules
 	
-	if c.Relay && InfoUpdated {
-		err := c.nodeManager.RemoveRelayRules(
-			c.RelayTag, 
-			c.subscriptionList,
-		)
-		if err != nil {
-			log.Print(err)
-		}	
+	rules := newNodeInfo.BlockingRules
+	if newRules != nil {
+		rules = newRules
+	}
 	
-	    // Remove relay tag
-		err = c.nodeManager.RemoveRelayTag(
-			c.RelayTag, 
-			c.subscriptionList,
-		)
-		if err != nil {
-			return err
+	// A rule change alone does not rebuild the inbound
+	if nodeInfoChanged {
+		candidate := *newNodeInfo
+		candidate.BlockingRules = c.nodeInfo.BlockingRules
+		if reflect.DeepEqual(c.nodeInfo, &candidate) {
+			nodeInfoChanged = false
+			newNodeInfo = c.nodeInfo
+		} else {
+			newNodeInfo.BlockingRules = rules
 		}
-		c.Relay = false
 	}
 	
-	// Update new Relay tag
-	if newNodeInfo.RelayType == 1 && newNodeInfo.RelayNodeID > 0 && InfoUpdated {
-		newRelayNodeInfo, err := c.client.GetTransitNode()
-		if err != nil {
-			log.Panic(err)
-			return nil
-		}	
-		c.relaynodeInfo = newRelayNodeInfo
-		c.RelayTag = c.buildRNodeTag()
-		
-		err = c.nodeManager.AddRelayTag(
-			newRelayNodeInfo,
-			c.RelayTag,
-			c.Tag,
-			newSubscriptionInfo,
-		)
-		if err != nil {
-			log.Panic(err)
-			return err
+	if !nodeInfoChanged && !reflect.DeepEqual(c.nodeInfo.BlockingRules, rules) {
+		if err := c.nodeManager.UpdateBlockingRules(rules, c.Tag); err != nil {
+			syncErr = err
+			log.Print(err)
+		} else {
+			c.nodeInfo.BlockingRules = rules
+			log.Printf("%s Blocking rules updated", c.LogPrefix)
 		}
-		c.Relay = true
+	}
+	
+	var InfoUpdated = false	
+	if subscriptionChanged || nodeInfoChanged {
+		InfoUpdated = true
 	}
 	
 	// If nodeInfo changed
@@ -265,19 +320,18 @@ func (c *Controller) nodeInfoMonitor() (err error) {
 			oldTag := c.Tag
 			err := c.nodeManager.RemoveTag(oldTag)
 			if err != nil {
-				log.Print(err)
-				return nil
+				return fmt.Errorf("rebuild node failed: %w", err)
 			}
 			err = c.nodeManager.RemoveBlockingRules(oldTag)
 			if err != nil {
+				syncErr = err
 				log.Print(err)
 			}
 			if c.nodeInfo.NodeType == "Shadowsocks-Plugin" {
-				err = c.nodeManager.RemoveTag(fmt.Sprintf("dokodemo-door_%s+1", c.Tag))
+				err = c.nodeManager.RemoveTag(node.PluginTag(c.Tag))
 			}
 			if err != nil {
-				log.Print(err)
-				return nil
+				return fmt.Errorf("rebuild node failed: %w", err)
 			}
 			
 			// Add new tag
@@ -287,24 +341,22 @@ func (c *Controller) nodeInfoMonitor() (err error) {
 			err = c.nodeManager.AddRuleTag(
 				newNodeInfo, 
 				c.Tag, 
+				newSubscriptionInfo,
 			)
 			if err != nil {
-				log.Print(err)
-				return nil
+				return c.rebuildFailed(oldTag, err)
 			}
 		
 			err = c.nodeManager.AddTag(newNodeInfo, c.Tag, c.config)
 			if err != nil {
-				log.Print(err)
-				return nil
+				return c.rebuildFailed(oldTag, err)
 			}
 			//nodeInfoChanged = true
 		
 			// Remove Old limiter
 			err = c.nodeManager.DeleteInboundLimiter(oldTag)
 			if err != nil {
-				log.Print(err)
-				return nil
+				return c.rebuildFailed(oldTag, err)
 			}
 		} else {
 			nodeInfoChanged = false
@@ -312,14 +364,15 @@ func (c *Controller) nodeInfoMonitor() (err error) {
 	}
 	
 	if nodeInfoChanged {
-		err := c.subManager.AddNewSubscription(
+		err := c.addSubscriptions(
 			newSubscriptionInfo, 
 			newNodeInfo, 
-			c.Tag,
 		)
 		if err != nil {
-			log.Print(err)
-			return nil
+			return c.rebuildFailed(oldTag, err)
+		}
+		if err := c.addReverseUser(newNodeInfo); err != nil {
+			return c.rebuildFailed(oldTag, err)
 		}
 		
 		err = c.nodeManager.AddInboundLimiter(
@@ -329,8 +382,7 @@ func (c *Controller) nodeInfoMonitor() (err error) {
 			c.config.RedisConfig,
 		)
 		if err != nil {
-			log.Print(err)
-			return nil
+			return c.rebuildFailed(oldTag, err)
 		}	
 	}else {
 		if subscriptionChanged {
@@ -340,24 +392,50 @@ func (c *Controller) nodeInfoMonitor() (err error) {
 			log.Printf("%s Subscription Monitoring - Deleted: %d, Added: %d, Modified: %d", 
 				c.LogPrefix, len(deleted), len(added), len(modified))
 			
+			// Throttle buckets and rule sets follow the subscriptions
+			c.nodeManager.DeleteRuleBuckets(subscription.FormatEmails(deleted, c.Tag))
+			c.nodeManager.UpdateRuleSetUsers(c.Tag, newSubscriptionInfo)
+			
+			// An inbound without user manager gets the whole list
+			if node.StaticInbound(c.nodeInfo.NodeType) {
+				if err := c.nodeManager.UpdateInboundUsers(c.nodeInfo, c.Tag, c.config, newSubscriptionInfo); err != nil {
+					syncErr = err
+					log.Printf("%s Error updating inbound users: %v", c.LogPrefix, err)
+				}
+				deleted = nil
+				if len(added) > 0 {
+					log.Printf("%s Updating limiter for %d added subscription(s)", c.LogPrefix, len(added))
+					if err := c.nodeManager.UpdateInboundLimiter(c.Tag, &added); err != nil {
+						syncErr = err
+						log.Printf("%s Error updating limiter for new subscriptions: %v", c.LogPrefix, err)
+					}
+				}
+				added = nil
+			}
+			
 			// Handle deleted subscriptions
 			if len(deleted) > 0 {
 				deletedEmail := subscription.FormatEmails(deleted, c.Tag)
-				if err := c.subManager.Remove(deletedEmail, c.Tag); err != nil {
-					log.Printf("%s Error removing subscriptions: %v", c.LogPrefix, err)
+				for _, inboundTag := range c.nodeManager.InboundTags(c.Tag) {
+					if err := c.subManager.Remove(deletedEmail, inboundTag); err != nil {
+						syncErr = err
+						log.Printf("%s Error removing subscriptions: %v", c.LogPrefix, err)
+					}
 				}
 			}
 			
 			// Handle added subscriptions
 			if len(added) > 0 {
-				err := c.subManager.AddNewSubscription(&added, c.nodeInfo, c.Tag)
+				err := c.addSubscriptions(&added, c.nodeInfo)
 				if err != nil {
+					syncErr = err
 					log.Printf("%s Error adding subscriptions: %v", c.LogPrefix, err)
 				} else {
 					//log.Printf("%s Successfully added %d subscriptions", c.LogPrefix, len(added))
 					// Update Limiter for new subscriptions
 					log.Printf("%s Updating limiter for %d added subscription(s)", c.LogPrefix, len(added))
 					if err := c.nodeManager.UpdateInboundLimiter(c.Tag, &added); err != nil {
+						syncErr = err
 						log.Printf("%s Error updating limiter for new subscriptions: %v", c.LogPrefix, err)
 					}
 				}
@@ -368,38 +446,241 @@ func (c *Controller) nodeInfoMonitor() (err error) {
 				log.Printf("%s Updating limiter for %d modified subscription(s)", c.LogPrefix, len(modified))
 				// Update Limiter for modified subscriptions without removing/re-adding them
 				if err := c.nodeManager.UpdateInboundLimiter(c.Tag, &modified); err != nil {
+					syncErr = err
 					log.Printf("%s Error updating limiter for modified subscriptions: %v", c.LogPrefix, err)
 				}
 			}
 		}
 	}
 	
+	// A failed transit request is retried on the next sync
+	if InfoUpdated || c.transitRetry {
+		retry := false
+		if err := c.relayMonitor(oldTag, transitChanged, newSubscriptionInfo); err != nil {
+			if !isTransient(err) {
+				return err
+			}
+			retry = true
+			syncErr = err
+			log.Printf("%s %s, retrying on the next sync", c.LogPrefix, err)
+		}
+		if err := c.bridgeMonitor(oldTag, transitChanged); err != nil {
+			if !isTransient(err) {
+				return err
+			}
+			retry = true
+			syncErr = err
+			log.Printf("%s %s, retrying on the next sync", c.LogPrefix, err)
+		}
+		c.transitRetry = retry
+	}
+	
 	c.subscriptionList = newSubscriptionInfo
 	return nil
 }
 
+// rebuildFailed fails the controller with a node half rebuilt, the supervisor
+// removes the new tag and restarts it. What is still keyed by the old tag is
+// removed here.
+func (c *Controller) rebuildFailed(oldTag string, err error) error {
+	if oldTag != c.Tag {
+		c.relayLock.Lock()
+		if c.Relay {
+			c.removeRelay(oldTag)
+		}
+		c.relayLock.Unlock()
+		c.nodeManager.PurgeTag(oldTag)
+	}
+	return fmt.Errorf("rebuild node failed: %w", err)
+}
+
+// addSubscriptions adds the subscriptions to the node inbounds, an inbound
+// without user manager gets the whole list
+func (c *Controller) addSubscriptions(subscriptionInfo *[]api.SubscriptionInfo, nodeInfo *api.NodeInfo) error {
+	if node.StaticInbound(nodeInfo.NodeType) {
+		return c.nodeManager.UpdateInboundUsers(nodeInfo, c.Tag, c.config, subscriptionInfo)
+	}
+	for _, inboundTag := range c.nodeManager.InboundTags(c.Tag) {
+		if err := c.subManager.AddNewSubscription(subscriptionInfo, nodeInfo, c.Tag, inboundTag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addReverseUser adds the user the bridge of a portal node connects with
+func (c *Controller) addReverseUser(nodeInfo *api.NodeInfo) error {
+	if nodeInfo.RelayType != api.RelayTypePortal {
+		return nil
+	}
+	return c.addSubscriptions(&[]api.SubscriptionInfo{*node.ReverseSubscription(nodeInfo)}, nodeInfo)
+}
+
 // Close implement the Close() function of the service interface
 func (c *Controller) Close() error {
 	log.Printf("%s Closing %d task schedulers", c.logPrefix(), c.taskManager.Count())
 	return c.taskManager.CloseAll()
 }
 
+// Drain stops accepting new connections on the node inbound, established
+// connections keep running until the core is closed
+func (c *Controller) Drain() error {
+	if c.nodeInfo == nil {
+		return nil
+	}
+	
+	if err := c.nodeManager.RemoveInbound(c.Tag); err != nil {
+		return err
+	}
+	
+	if c.nodeInfo.NodeType == "Shadowsocks-Plugin" {
+		if err := c.nodeManager.RemoveInbound(node.PluginTag(c.Tag)); err != nil {
+			return err
+		}
+	}
+	
+	return nil
+}
+
+// Flush reports the traffic and online IPs accumulated since the last
+// subscription monitor run
+func (c *Controller) Flush() error {
+	if c.subscriptionList == nil {
+		return nil
+	}
+	
+	log.Printf("%s Reporting final traffic usage", c.LogPrefix)
+	return c.subManager.SubscriptionMonitor(c.subscriptionList, c.Tag, c.LogPrefix)
+}
+
+// Remove stops the controller, reports the pending traffic and removes
+// everything it added to the core, used when a node is unassigned at runtime
+func (c *Controller) Remove() error {
+	if err := c.Close(); err != nil {
+		return err
+	}
+	if err := c.Flush(); err != nil {
+		log.Printf("%s Report final traffic failed: %s", c.logPrefix(), err)
+	}
+	c.cleanup()
+	return nil
+}
+
+// taskFailed is called when a periodic task returns an error or panics, the
+// task is no longer scheduled so the controller is reported as failed
+func (c *Controller) taskFailed(tag string, err error) {
+	log.Printf("%s Task %s stopped: %s", c.logPrefix(), tag, err)
+	if c.onFailure != nil {
+		c.onFailure(fmt.Errorf("task %s failed: %w", tag, err))
+	}
+}
+
+// cleanup removes the inbounds, outbounds, rules and limiter the controller
+// added to the core, so that it can be started again on the same instance
+func (c *Controller) cleanup() {
+	if c.nodeInfo == nil {
+		return
+	}
+	
+	c.relayLock.Lock()
+	if c.Relay {
+		c.removeRelay(c.Tag)
+	}
+	c.relayLock.Unlock()
+	
+	if c.nodeInfo.NodeType == "Shadowsocks-Plugin" {
+		c.nodeManager.PurgeTag(node.PluginTag(c.Tag))
+	}
+	c.nodeManager.PurgeTag(c.Tag)
+	c.bridge = false
+}
+
+// certMonitor renews the certificates of the node and of its extra inbounds
 func (c *Controller) certMonitor() error {
-	switch c.nodeInfo.TlsSettings.CertMode {
-	case "dns", "http":
-		lego, err := cert.New(c.config.CertConfig)
-		if err != nil {
-			log.Print(err)
+	for _, inboundInfo := range append([]*api.NodeInfo{c.nodeInfo}, c.nodeInfo.Inbounds...) {
+		if inboundInfo.SecurityType != "tls" {
+			continue
 		}
-		_, _, _, err = lego.RenewCert(c.nodeInfo.TlsSettings.CertMode, c.nodeInfo.TlsSettings.CertDomainName)
+		switch inboundInfo.TlsSettings.CertMode {
+		case "dns", "http":
+			lego, err := cert.New(c.config.CertConfig)
+			if err != nil {
+				log.Print(err)
+				continue
+			}
+			_, _, _, err = lego.RenewCert(inboundInfo.TlsSettings.CertMode, inboundInfo.TlsSettings.CertDomainName)
+			if err != nil {
+				log.Print(err)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Controller) statusMonitor() error {
+	nodeStatus := &api.NodeStatus{
+		Uptime:        uint64(time.Since(c.startAt).Seconds()),
+		CoreVersion:   core.Version(),
+		LastSyncError: c.getSyncError(),
+		State:         StateRunning,
+		Restarts:      c.restarts,
+	}
+	if c.state != nil {
+		nodeStatus.State = c.state()
+	}
+	
+	if stat, err := c.sysCollector.Collect(); err != nil {
+		log.Printf("%s Collect system status failed: %s", c.LogPrefix, err)
+	} else {
+		nodeStatus.CPU = stat.CPU
+		nodeStatus.MemTotal = stat.MemTotal
+		nodeStatus.MemUsed = stat.MemUsed
+		nodeStatus.Load1 = stat.Load1
+		nodeStatus.Load5 = stat.Load5
+		nodeStatus.Load15 = stat.Load15
+		nodeStatus.NetIn = stat.NetIn
+		nodeStatus.NetOut = stat.NetOut
+	}
+	nodeStatus.Connections = int(c.nodeManager.ActiveConnections(c.Tag))
+	
+	if c.nodeInfo.SecurityType == "tls" && c.nodeInfo.TlsSettings.CertMode != "none" {
+		certFile := cert.CertFile(c.config.CertConfig, c.nodeInfo.TlsSettings.CertMode, c.nodeInfo.TlsSettings.CertDomainName)
+		expiry, err := cert.CertExpiry(certFile)
 		if err != nil {
-			log.Print(err)
+			log.Printf("%s Read certificate expiry failed: %s", c.LogPrefix, err)
+		} else {
+			nodeStatus.CertExpiry = expiry.Unix()
 		}
 	}
+	
+	if err := c.client.ReportNodeStatus(nodeStatus); err != nil {
+		log.Print(err)
+	}
+	
 	return nil
 }
 
+func (c *Controller) setSyncError(err error) {
+	c.syncLock.Lock()
+	defer c.syncLock.Unlock()
+	
+	if err != nil {
+		c.lastSyncError = err.Error()
+	} else {
+		c.lastSyncError = ""
+	}
+}
+
+func (c *Controller) getSyncError() string {
+	c.syncLock.RLock()
+	defer c.syncLock.RUnlock()
+	return c.lastSyncError
+}
+
 func (c *Controller) logPrefix() string {
+	if c.nodeInfo == nil {
+		return fmt.Sprintf("[%s] (NodeID=%d)", c.clientInfo.APIHost, c.clientInfo.NodeID)
+	}
 	return fmt.Sprintf("[%s] %s(NodeID=%d)", 
 		c.clientInfo.APIHost, 
 		c.nodeInfo.NodeType, 
@@ -413,9 +694,9 @@ func (c *Controller) buildNodeTag() string {
 		c.nodeInfo.NodeID)
 }
 
-func (c *Controller) buildRNodeTag() string {
+func buildRNodeTag(relayNodeInfo *api.RelayNodeInfo) string {
 	return fmt.Sprintf("Relay_%s_%d_%d", 
-		c.relaynodeInfo.NodeType, 
-		c.relaynodeInfo.ListeningPort, 
-		c.relaynodeInfo.NodeID)
+		relayNodeInfo.NodeType, 
+		relayNodeInfo.ListeningPort, 
+		relayNodeInfo.NodeID)
 }
\ No newline at end of file
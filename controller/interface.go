@@ -4,6 +4,9 @@ package controller
 type ControllerInterface interface {
 	Start() error
 	Close() error
+	Drain() error
+	Flush() error
+	Remove() error
 	Restart
 }
 
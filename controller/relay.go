@@ -0,0 +1,331 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xmplusdev/xmplus-server/api"
+	"github.com/xmplusdev/xmplus-server/helper/probe"
+	"github.com/xmplusdev/xmplus-server/subscription"
+)
+
+const (
+	transitProbeInterval = 30 * time.Second
+	transitProbeTimeout  = 5 * time.Second
+)
+
+// relayMonitor applies the subscription diff to the relay outbounds, they are
+// only rebuilt all at once when the transit servers or the node tag change
+func (c *Controller) relayMonitor(oldTag string, transitChanged bool, newSubscriptionInfo *[]api.SubscriptionInfo) error {
+	rebuilt, err := c.updateRelay(oldTag, transitChanged, newSubscriptionInfo)
+	if err != nil {
+		return err
+	}
+	// New transits are probed right away instead of on the next health check
+	if rebuilt {
+		c.transitMonitor()
+	}
+	return nil
+}
+
+// updateRelay reports whether the relay outbounds were rebuilt
+func (c *Controller) updateRelay(oldTag string, transitChanged bool, newSubscriptionInfo *[]api.SubscriptionInfo) (bool, error) {
+	c.relayLock.Lock()
+	defer c.relayLock.Unlock()
+
+	relayEnabled := c.nodeInfo.RelayType == api.RelayTypeTransit && c.nodeInfo.RelayNodeID > 0
+
+	newRelayNodes := c.relayNodes
+	if relayEnabled && (transitChanged || !c.Relay || c.transitRetry) {
+		relayNodes, err := c.client.GetTransitNodes()
+		if err != nil {
+			return false, transient(fmt.Errorf("get transit node failed: %w", err))
+		}
+		newRelayNodes = relayNodes
+	}
+
+	if !relayEnabled || !c.Relay || oldTag != c.Tag || !reflect.DeepEqual(c.relayNodes, newRelayNodes) {
+		if c.Relay {
+			c.removeRelay(oldTag)
+		}
+		if !relayEnabled {
+			return false, nil
+		}
+
+		if err := c.addRelay(newRelayNodes, newSubscriptionInfo); err != nil {
+			return false, err
+		}
+		log.Printf("%s Relay outbounds rebuilt for %s", c.LogPrefix, strings.Join(c.RelayTags, ", "))
+		return true, nil
+	}
+
+	deleted, added, modified := subscription.Compare(c.relaySubscriptions, newSubscriptionInfo)
+	if len(deleted) == 0 && len(added) == 0 && len(modified) == 0 {
+		c.relaySubscriptions = newSubscriptionInfo
+		return false, nil
+	}
+
+	// A modified subscription is removed with its old email and added again
+	removed := deleted
+	if len(modified) > 0 {
+		oldSubscriptions := make(map[int]api.SubscriptionInfo, len(*c.relaySubscriptions))
+		for _, s := range *c.relaySubscriptions {
+			oldSubscriptions[s.Id] = s
+		}
+		for _, s := range modified {
+			removed = append(removed, oldSubscriptions[s.Id])
+		}
+	}
+	added = append(added, modified...)
+	c.relaySubscriptions = newSubscriptionInfo
+
+	if len(removed) > 0 {
+		c.nodeManager.RemoveRelayRules(c.Tag, &removed)
+		for i, relayTag := range c.RelayTags {
+			if err := c.nodeManager.RemoveRelayTag(c.relayNodes[i], relayTag, &removed); err != nil {
+				log.Printf("%s Error removing relay outbounds: %v", c.LogPrefix, err)
+			}
+		}
+	}
+	if len(added) > 0 {
+		for i, relayNodeInfo := range c.relayNodes {
+			if err := c.nodeManager.AddRelayTag(relayNodeInfo, c.RelayTags[i], &added); err != nil {
+				return false, err
+			}
+		}
+		c.nodeManager.MapRelaySubscriptions(c.Tag, &added, c.relayTargets)
+	}
+
+	log.Printf("%s Relay Monitoring - Removed: %d, Added: %d", c.LogPrefix, len(removed), len(added))
+	return false, nil
+}
+
+// bridgeMonitor connects the reverse bridge of the node to the portal on its
+// transit server, it reconnects when the node or the transit server changes
+func (c *Controller) bridgeMonitor(oldTag string, transitChanged bool) error {
+	bridgeEnabled := c.nodeInfo.RelayType == api.RelayTypeBridge && c.nodeInfo.RelayNodeID > 0
+
+	if c.bridge && (!bridgeEnabled || transitChanged || oldTag != c.Tag) {
+		c.nodeManager.RemoveReverseBridge(oldTag)
+		c.bridge = false
+	}
+	if !bridgeEnabled || c.bridge {
+		return nil
+	}
+
+	relayNodes, err := c.client.GetTransitNodes()
+	if err != nil {
+		return transient(fmt.Errorf("get transit node failed: %w", err))
+	}
+	if len(relayNodes) == 0 {
+		return fmt.Errorf("no transit node for the reverse bridge")
+	}
+	relayNodeInfo := c.bridgeTransit(relayNodes)
+	if err := c.nodeManager.AddReverseBridge(relayNodeInfo, c.nodeInfo, c.Tag); err != nil {
+		return err
+	}
+	c.bridge = true
+	log.Printf("%s Reverse bridge connected to %s", c.logPrefix(), buildRNodeTag(relayNodeInfo))
+	return nil
+}
+
+// bridgeTransit returns the transit the bridge connects to, the first healthy
+// one of the transit list
+func (c *Controller) bridgeTransit(relayNodes []*api.RelayNodeInfo) *api.RelayNodeInfo {
+	if len(relayNodes) == 1 {
+		return relayNodes[0]
+	}
+
+	relayTags := make([]string, len(relayNodes))
+	for i, relayNodeInfo := range relayNodes {
+		relayTags[i] = buildRNodeTag(relayNodeInfo)
+	}
+	relayHealth := probeTransits(relayNodes, relayTags, c.logPrefix())
+	for i, relayTag := range relayTags {
+		if relayHealth[relayTag].Healthy {
+			return relayNodes[i]
+		}
+	}
+	return relayNodes[0]
+}
+
+// addRelay must be called with relayLock held
+func (c *Controller) addRelay(relayNodes []*api.RelayNodeInfo, subscriptionInfo *[]api.SubscriptionInfo) error {
+	c.relayNodes = relayNodes
+	c.RelayTags = make([]string, len(relayNodes))
+	for i, relayNodeInfo := range relayNodes {
+		c.RelayTags[i] = buildRNodeTag(relayNodeInfo)
+	}
+	c.relaySubscriptions = subscriptionInfo
+	c.relayHealth = nil
+	c.relaySelection = ""
+
+	// Mark the relay as added first, so that a partial failure is cleaned up
+	c.Relay = true
+	for i, relayNodeInfo := range relayNodes {
+		if err := c.nodeManager.AddRelayTag(relayNodeInfo, c.RelayTags[i], subscriptionInfo); err != nil {
+			return err
+		}
+	}
+
+	// Every transit counts as healthy until transitMonitor probed it
+	c.relaySelection = c.transitSelection()
+	c.nodeManager.MapRelaySubscriptions(c.Tag, subscriptionInfo, c.relayTargets)
+	return nil
+}
+
+// removeRelay must be called with relayLock held
+func (c *Controller) removeRelay(mainTag string) {
+	if c.relaySubscriptions != nil {
+		c.nodeManager.RemoveRelayRules(mainTag, c.relaySubscriptions)
+		for i, relayTag := range c.RelayTags {
+			c.nodeManager.RemoveRelayTag(c.relayNodes[i], relayTag, c.relaySubscriptions)
+		}
+	}
+	c.Relay = false
+}
+
+// transitMonitor probes the transit servers and moves the subscriptions when
+// the selected transits change. A single transit is only probed once, so that
+// a failed certificate verification is logged.
+func (c *Controller) transitMonitor() error {
+	c.relayLock.Lock()
+	if !c.Relay || (len(c.relayNodes) < 2 && c.relayHealth != nil) {
+		c.relayLock.Unlock()
+		return nil
+	}
+	relayNodes, relayTags := c.relayNodes, c.RelayTags
+	c.relayLock.Unlock()
+
+	// Probe without relayLock, relay updates do not wait for the timeouts
+	relayHealth := probeTransits(relayNodes, relayTags, c.LogPrefix)
+
+	c.relayLock.Lock()
+	defer c.relayLock.Unlock()
+
+	// The transits were rebuilt meanwhile, the results are for the old ones
+	if !c.Relay || !reflect.DeepEqual(relayNodes, c.relayNodes) || !reflect.DeepEqual(relayTags, c.RelayTags) {
+		return nil
+	}
+	c.relayHealth = relayHealth
+
+	selection := c.transitSelection()
+	if selection == c.relaySelection {
+		return nil
+	}
+	log.Printf("%s Transit selection changed: %s", c.LogPrefix, selection)
+	c.relaySelection = selection
+	c.nodeManager.MapRelaySubscriptions(c.Tag, c.relaySubscriptions, c.relayTargets)
+	return nil
+}
+
+// probeTransits probes the transit servers concurrently
+func probeTransits(relayNodes []*api.RelayNodeInfo, relayTags []string, logPrefix string) map[string]probe.Result {
+	results := make([]probe.Result, len(relayNodes))
+
+	var wg sync.WaitGroup
+	for i, relayNodeInfo := range relayNodes {
+		wg.Add(1)
+		go func(i int, relayNodeInfo *api.RelayNodeInfo) {
+			defer wg.Done()
+			results[i] = probe.Transit(relayNodeInfo, transitProbeTimeout)
+		}(i, relayNodeInfo)
+	}
+	wg.Wait()
+
+	relayHealth := make(map[string]probe.Result, len(results))
+	for i, result := range results {
+		if !result.Healthy {
+			log.Printf("%s Transit %s is down: %v", logPrefix, relayTags[i], result.Err)
+		}
+		relayHealth[relayTags[i]] = result
+	}
+	return relayHealth
+}
+
+// healthyTransits returns the relay tags of the healthy transits, all of them
+// when none is healthy or none was probed yet
+func (c *Controller) healthyTransits() []string {
+	var healthy []string
+	for _, relayTag := range c.RelayTags {
+		if result, ok := c.relayHealth[relayTag]; !ok || result.Healthy {
+			healthy = append(healthy, relayTag)
+		}
+	}
+	if len(healthy) == 0 {
+		return c.RelayTags
+	}
+	return healthy
+}
+
+// transitSelection describes the current choice of transits, subscriptions
+// are only remapped when it changes
+func (c *Controller) transitSelection() string {
+	healthy := c.healthyTransits()
+	if c.relayStrategy() == api.RelayStrategyLeastLatency {
+		return c.fastestTransit(healthy)
+	}
+	return strings.Join(healthy, ",")
+}
+
+// fastestTransit returns the healthy transit with the lowest latency, the
+// transits that cannot be probed come last
+func (c *Controller) fastestTransit(healthy []string) string {
+	fastest := append([]string(nil), healthy...)
+	sort.SliceStable(fastest, func(i, j int) bool {
+		a, b := c.relayHealth[fastest[i]], c.relayHealth[fastest[j]]
+		if a.Skipped != b.Skipped {
+			return b.Skipped
+		}
+		return a.Latency < b.Latency
+	})
+	return fastest[0]
+}
+
+// stickyTransit picks the transit of a subscription by rendezvous hashing, a
+// transit going down or up only moves the subscriptions it had or gets
+func stickyTransit(healthy []string, id int) string {
+	var picked string
+	var best uint64
+	for _, relayTag := range healthy {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d", relayTag, id)))
+		if score := binary.BigEndian.Uint64(sum[:8]); picked == "" || score > best {
+			picked, best = relayTag, score
+		}
+	}
+	return picked
+}
+
+func (c *Controller) relayStrategy() string {
+	switch c.nodeInfo.RelayStrategy {
+		case api.RelayStrategyRoundRobin, api.RelayStrategySticky:
+			return c.nodeInfo.RelayStrategy
+		default:
+			return api.RelayStrategyLeastLatency
+	}
+}
+
+// relayTargets returns the relay tags a subscription may use, must be called
+// with relayLock held
+func (c *Controller) relayTargets(s *api.SubscriptionInfo) []string {
+	healthy := c.healthyTransits()
+	if len(healthy) == 1 {
+		return healthy
+	}
+
+	switch c.relayStrategy() {
+		case api.RelayStrategyRoundRobin:
+			return healthy
+		case api.RelayStrategySticky:
+			return []string{stickyTransit(healthy, s.Id)}
+		default:
+			return []string{c.fastestTransit(healthy)}
+	}
+}
@@ -0,0 +1,295 @@
+package controller
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xtls/xray-core/app/proxyman"
+	"github.com/xtls/xray-core/app/router"
+	"github.com/xtls/xray-core/common/serial"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/outbound"
+	"github.com/xtls/xray-core/features/routing"
+
+	"github.com/xmplusdev/xmplus-server/api"
+	"github.com/xmplusdev/xmplus-server/app/dispatcher"
+	"github.com/xmplusdev/xmplus-server/helper/probe"
+	"github.com/xmplusdev/xmplus-server/node"
+)
+
+func Test_relayTargets(t *testing.T) {
+	relayTags := []string{"a", "b", "c"}
+	relayHealth := map[string]probe.Result{
+		"a": {Healthy: true, Latency: 30 * time.Millisecond},
+		"b": {Healthy: true, Latency: 10 * time.Millisecond},
+		"c": {Healthy: false},
+	}
+
+	testCases := []struct {
+		desc        string
+		strategy    string
+		relayHealth map[string]probe.Result
+		expected    []string
+	}{
+		{
+			desc:        "least latency",
+			strategy:    api.RelayStrategyLeastLatency,
+			relayHealth: relayHealth,
+			expected:    []string{"b"},
+		},
+		{
+			desc:        "unknown strategy is least latency",
+			strategy:    "random",
+			relayHealth: relayHealth,
+			expected:    []string{"b"},
+		},
+		{
+			desc:        "round robin over the healthy transits",
+			strategy:    api.RelayStrategyRoundRobin,
+			relayHealth: relayHealth,
+			expected:    []string{"a", "b"},
+		},
+		{
+			desc:     "not probed yet",
+			strategy: api.RelayStrategyRoundRobin,
+			expected: []string{"a", "b", "c"},
+		},
+		{
+			desc:     "all down",
+			strategy: api.RelayStrategyRoundRobin,
+			relayHealth: map[string]probe.Result{
+				"a": {}, "b": {}, "c": {},
+			},
+			expected: []string{"a", "b", "c"},
+		},
+		{
+			desc:     "single healthy transit",
+			strategy: api.RelayStrategySticky,
+			relayHealth: map[string]probe.Result{
+				"a": {}, "b": {}, "c": {Healthy: true},
+			},
+			expected: []string{"c"},
+		},
+		{
+			desc:     "unprobed transit comes last",
+			strategy: api.RelayStrategyLeastLatency,
+			relayHealth: map[string]probe.Result{
+				"a": {Healthy: true, Skipped: true},
+				"b": {Healthy: true, Latency: 80 * time.Millisecond},
+				"c": {},
+			},
+			expected: []string{"b"},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			c := &Controller{
+				nodeInfo:    &api.NodeInfo{RelayStrategy: test.strategy},
+				RelayTags:   relayTags,
+				relayHealth: test.relayHealth,
+			}
+
+			assert.Equal(t, test.expected, c.relayTargets(&api.SubscriptionInfo{Id: 1}))
+		})
+	}
+}
+
+func Test_stickyTransit(t *testing.T) {
+	all := []string{"a", "b", "c", "d"}
+
+	testCases := []struct {
+		desc    string
+		healthy []string
+		down    string
+	}{
+		{desc: "first transit down", healthy: []string{"b", "c", "d"}, down: "a"},
+		{desc: "middle transit down", healthy: []string{"a", "b", "d"}, down: "c"},
+		{desc: "last transit down", healthy: []string{"a", "b", "c"}, down: "d"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			moved := 0
+			for id := 1; id <= 1000; id++ {
+				before := stickyTransit(all, id)
+				after := stickyTransit(test.healthy, id)
+
+				assert.Contains(t, test.healthy, after, fmt.Sprintf("id %d", id))
+				if before != test.down {
+					// Only the subscriptions of the transit that went down move
+					assert.Equal(t, before, after, fmt.Sprintf("id %d", id))
+				} else {
+					moved++
+				}
+				// They come back when it is up again
+				assert.Equal(t, before, stickyTransit(all, id), fmt.Sprintf("id %d", id))
+			}
+			assert.Greater(t, moved, 150)
+			assert.Less(t, moved, 350)
+		})
+	}
+}
+
+func Test_fastestTransit(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		healthy     []string
+		relayHealth map[string]probe.Result
+		expected    string
+	}{
+		{
+			desc:    "least latency",
+			healthy: []string{"a", "b", "c"},
+			relayHealth: map[string]probe.Result{
+				"a": {Healthy: true, Latency: 30 * time.Millisecond},
+				"b": {Healthy: true, Latency: 20 * time.Millisecond},
+				"c": {Healthy: true, Latency: 40 * time.Millisecond},
+			},
+			expected: "b",
+		},
+		{
+			desc:    "skipped transit comes last",
+			healthy: []string{"a", "b"},
+			relayHealth: map[string]probe.Result{
+				"a": {Healthy: true, Skipped: true},
+				"b": {Healthy: true, Latency: 200 * time.Millisecond},
+			},
+			expected: "b",
+		},
+		{
+			desc:    "only skipped transits",
+			healthy: []string{"a", "b"},
+			relayHealth: map[string]probe.Result{
+				"a": {Healthy: true, Skipped: true},
+				"b": {Healthy: true, Skipped: true},
+			},
+			expected: "a",
+		},
+		{
+			desc:     "not probed yet keeps the order",
+			healthy:  []string{"c", "a", "b"},
+			expected: "c",
+		},
+		{
+			desc:    "same latency keeps the order",
+			healthy: []string{"b", "a"},
+			relayHealth: map[string]probe.Result{
+				"a": {Healthy: true, Latency: 10 * time.Millisecond},
+				"b": {Healthy: true, Latency: 10 * time.Millisecond},
+			},
+			expected: "b",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			c := &Controller{relayHealth: test.relayHealth}
+			healthy := append([]string(nil), test.healthy...)
+
+			assert.Equal(t, test.expected, c.fastestTransit(healthy))
+			// The healthy list is shared with the other strategies
+			assert.Equal(t, test.healthy, healthy)
+		})
+	}
+}
+
+func Test_updateRelay(t *testing.T) {
+	server, err := core.New(&core.Config{
+		App: []*serial.TypedMessage{
+			serial.ToTypedMessage(&dispatcher.Config{}),
+			serial.ToTypedMessage(&proxyman.InboundConfig{}),
+			serial.ToTypedMessage(&proxyman.OutboundConfig{}),
+			serial.ToTypedMessage(&router.Config{}),
+		},
+	})
+	require.NoError(t, err)
+	obm := server.GetFeature(outbound.ManagerType()).(outbound.Manager)
+	relayOutbounds := server.GetFeature(routing.DispatcherType()).(*dispatcher.DefaultDispatcher).RelayOutbounds
+
+	relayNodes := []*api.RelayNodeInfo{
+		{
+			NodeType:      "vless",
+			NodeID:        2,
+			Address:       "203.0.113.1",
+			ListeningPort: 443,
+			NetworkType:   "raw",
+			SecurityType:  "none",
+			Encryption:    "none",
+			RawSettings:   &api.RawSettings{},
+		},
+	}
+	subscriptions := &[]api.SubscriptionInfo{
+		{Id: 1, Email: "a@example.com", Passwd: "b831381d-6324-4d53-ad4f-8cda48b30811"},
+		{Id: 2, Email: "b@example.com", Passwd: "b831381d-6324-4d53-ad4f-8cda48b30812"},
+	}
+	c := &Controller{
+		nodeInfo:    &api.NodeInfo{RelayType: api.RelayTypeTransit, RelayNodeID: 2},
+		nodeManager: node.NewManager(server),
+		Tag:         "vless_443_1",
+	}
+	require.NoError(t, c.addRelay(relayNodes, subscriptions))
+	relayTag := c.RelayTags[0]
+
+	// addRelay resets the health, an incremental update keeps it
+	relayHealth := map[string]probe.Result{relayTag: {Healthy: true}}
+	c.relayHealth = relayHealth
+
+	testCases := []struct {
+		desc          string
+		subscriptions []api.SubscriptionInfo
+		removed       []string
+	}{
+		{
+			desc: "added",
+			subscriptions: []api.SubscriptionInfo{
+				{Id: 1, Email: "a@example.com", Passwd: "b831381d-6324-4d53-ad4f-8cda48b30811"},
+				{Id: 2, Email: "b@example.com", Passwd: "b831381d-6324-4d53-ad4f-8cda48b30812"},
+				{Id: 3, Email: "c@example.com", Passwd: "b831381d-6324-4d53-ad4f-8cda48b30813"},
+			},
+		},
+		{
+			desc: "deleted",
+			subscriptions: []api.SubscriptionInfo{
+				{Id: 1, Email: "a@example.com", Passwd: "b831381d-6324-4d53-ad4f-8cda48b30811"},
+				{Id: 3, Email: "c@example.com", Passwd: "b831381d-6324-4d53-ad4f-8cda48b30813"},
+			},
+			removed: []string{"b@example.com|2"},
+		},
+		{
+			desc: "modified",
+			subscriptions: []api.SubscriptionInfo{
+				{Id: 1, Email: "a@example.org", Passwd: "b831381d-6324-4d53-ad4f-8cda48b30814"},
+				{Id: 3, Email: "c@example.com", Passwd: "b831381d-6324-4d53-ad4f-8cda48b30813"},
+			},
+			removed: []string{"a@example.com|1"},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			newSubscriptions := test.subscriptions
+			rebuilt, err := c.updateRelay(c.Tag, false, &newSubscriptions)
+			require.NoError(t, err)
+			assert.False(t, rebuilt)
+			assert.Equal(t, relayHealth, c.relayHealth)
+			assert.Equal(t, &newSubscriptions, c.relaySubscriptions)
+
+			for _, s := range newSubscriptions {
+				group, ok := relayOutbounds.Load(fmt.Sprintf("%s|%s|%d", c.Tag, s.Email, s.Id))
+				require.True(t, ok, s.Email)
+				outboundTag := fmt.Sprintf("%s_%d", relayTag, s.Id)
+				assert.Equal(t, []string{outboundTag}, group.(*dispatcher.RelayGroup).Tags)
+				assert.NotNil(t, obm.GetHandler(outboundTag), outboundTag)
+			}
+			for _, key := range test.removed {
+				_, ok := relayOutbounds.Load(fmt.Sprintf("%s|%s", c.Tag, key))
+				assert.False(t, ok, key)
+			}
+		})
+	}
+	assert.Nil(t, obm.GetHandler(fmt.Sprintf("%s_%d", relayTag, 2)))
+}
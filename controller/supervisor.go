@@ -0,0 +1,296 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtls/xray-core/core"
+
+	"github.com/xmplusdev/xmplus-server/api"
+)
+
+const (
+	StateStarting = "starting"
+	StateRunning  = "running"
+	StateFailed   = "failed"
+	StateStopped  = "stopped"
+)
+
+const (
+	minRestartBackoff = 5 * time.Second
+	maxRestartBackoff = 5 * time.Minute
+)
+
+// Supervisor runs a single controller and keeps it alive. A panic or a failed
+// task puts the controller in the failed state, its resources are removed from
+// the core and it is restarted with exponential backoff, without affecting the
+// other controllers of the process.
+type Supervisor struct {
+	access        sync.Mutex
+	client        api.API
+	newController func() *Controller
+	controller    *Controller
+	state         string
+	current       atomic.Value // state, readable by the controller while access is held
+	restarts      int
+	backoff       time.Duration
+	startedAt     time.Time
+	lastErr       error
+	timer         *time.Timer
+	closed        bool
+}
+
+// NewSupervisor returns a Supervisor building its controller with newController
+// on every (re)start.
+func NewSupervisor(client api.API, newController func() *Controller) *Supervisor {
+	s := &Supervisor{
+		client:        client,
+		newController: newController,
+		backoff:       minRestartBackoff,
+	}
+	s.setState(StateStopped)
+	return s
+}
+
+// Start implement the Start() function of the service interface. Controller
+// failures are handled by the supervisor, so it never returns an error.
+func (s *Supervisor) Start() error {
+	s.access.Lock()
+	defer s.access.Unlock()
+
+	s.closed = false
+	s.start()
+	return nil
+}
+
+// Close implement the Close() function of the service interface
+func (s *Supervisor) Close() error {
+	s.access.Lock()
+	defer s.access.Unlock()
+
+	s.closed = true
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+
+	var err error
+	if s.controller != nil && s.state == StateRunning {
+		err = s.controller.Close()
+	}
+	s.setState(StateStopped)
+	return err
+}
+
+// Drain forwards to the running controller
+func (s *Supervisor) Drain() error {
+	s.access.Lock()
+	defer s.access.Unlock()
+
+	if s.controller == nil || s.state == StateFailed {
+		return nil
+	}
+	return s.controller.Drain()
+}
+
+// Flush forwards to the supervised controller, traffic counted before a
+// failure is still reported
+func (s *Supervisor) Flush() error {
+	s.access.Lock()
+	defer s.access.Unlock()
+
+	if s.controller == nil {
+		return nil
+	}
+	return s.controller.Flush()
+}
+
+// Remove stops the supervised controller for good and removes its resources
+// from the core
+func (s *Supervisor) Remove() error {
+	s.access.Lock()
+	defer s.access.Unlock()
+
+	s.closed = true
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+
+	var err error
+	if s.controller != nil {
+		if s.state == StateFailed {
+			// Resources were already removed when the controller failed
+			err = safeCall(s.controller.Flush)
+		} else {
+			err = safeCall(s.controller.Remove)
+		}
+	}
+	s.setState(StateStopped)
+	return err
+}
+
+// State returns the controller state, the number of restarts and the last failure
+func (s *Supervisor) State() (state string, restarts int, lastErr error) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	return s.state, s.restarts, s.lastErr
+}
+
+// CurrentState returns the controller state without taking the supervisor
+// lock, the first status report runs while the supervisor starts the controller
+func (s *Supervisor) CurrentState() string {
+	return s.current.Load().(string)
+}
+
+// setState must be called with access held
+func (s *Supervisor) setState(state string) {
+	s.state = state
+	s.current.Store(state)
+}
+
+// start must be called with access held
+func (s *Supervisor) start() {
+	c := s.newController()
+	c.restarts = s.restarts
+	c.state = s.CurrentState
+	c.onFailure = func(err error) {
+		go s.fail(c, err)
+	}
+
+	s.controller = c
+	s.setState(StateStarting)
+	if err := safeStart(c); err != nil {
+		s.failLocked(err)
+		return
+	}
+
+	s.setState(StateRunning)
+	s.startedAt = time.Now()
+	log.Printf("%s Controller is running (restarts=%d)", s.logPrefix(), s.restarts)
+}
+
+func (s *Supervisor) fail(c *Controller, err error) {
+	s.access.Lock()
+	defer s.access.Unlock()
+
+	// Ignore failures of a controller that has been replaced or already handled
+	if s.closed || s.controller != c || s.state != StateRunning {
+		return
+	}
+	s.failLocked(err)
+}
+
+// failLocked must be called with access held
+func (s *Supervisor) failLocked(err error) {
+	c := s.controller
+	s.setState(StateFailed)
+	s.lastErr = err
+
+	if err := safeCall(c.Close); err != nil {
+		log.Printf("%s Close failed controller: %s", s.logPrefix(), err)
+	}
+	if err := safeCall(func() error { c.cleanup(); return nil }); err != nil {
+		log.Printf("%s Cleanup failed controller: %s", s.logPrefix(), err)
+	}
+
+	var uptime time.Duration
+	if !s.startedAt.IsZero() {
+		uptime = time.Since(s.startedAt)
+	}
+	var delay time.Duration
+	delay, s.backoff = restartDelay(s.backoff, uptime)
+	s.startedAt = time.Time{}
+
+	log.Printf("%s Controller failed: %s, restarting in %s", s.logPrefix(), err, delay)
+	go s.reportFailure(s.restarts, err)
+
+	s.timer = time.AfterFunc(delay, s.restart)
+}
+
+// restartDelay returns the delay before restarting a controller that failed
+// after uptime, and the backoff for its next failure
+func restartDelay(backoff time.Duration, uptime time.Duration) (delay time.Duration, next time.Duration) {
+	// A controller that ran long enough is considered healthy again
+	if uptime > maxRestartBackoff {
+		backoff = minRestartBackoff
+	}
+	next = backoff * 2
+	if next > maxRestartBackoff {
+		next = maxRestartBackoff
+	}
+	return backoff, next
+}
+
+func (s *Supervisor) restart() {
+	s.access.Lock()
+	defer s.access.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.timer = nil
+	s.restarts++
+	s.start()
+}
+
+func (s *Supervisor) reportFailure(restarts int, err error) {
+	nodeStatus := &api.NodeStatus{
+		CoreVersion:   core.Version(),
+		LastSyncError: err.Error(),
+		State:         StateFailed,
+		Restarts:      restarts,
+	}
+	if err := s.client.ReportNodeStatus(nodeStatus); err != nil {
+		log.Print(err)
+	}
+}
+
+func (s *Supervisor) logPrefix() string {
+	clientInfo := s.client.Describe()
+	return fmt.Sprintf("[%s] (NodeID=%d)", clientInfo.APIHost, clientInfo.NodeID)
+}
+
+// transientError is a failed panel request of a running controller, it is
+// logged and retried on the next run of the task instead of failing the
+// controller and dropping the connections of its node
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string {
+	return e.err.Error()
+}
+
+func (e *transientError) Unwrap() error {
+	return e.err
+}
+
+func transient(err error) error {
+	return &transientError{err: err}
+}
+
+func isTransient(err error) bool {
+	var t *transientError
+	return errors.As(err, &t)
+}
+
+func safeStart(c *Controller) error {
+	return safeCall(c.Start)
+}
+
+// safeCall runs f and converts a panic into an error
+func safeCall(f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Recovered from panic: %v\n%s", r, debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return f()
+}
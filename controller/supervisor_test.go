@@ -0,0 +1,134 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_restartDelay(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		backoff       time.Duration
+		uptime        time.Duration
+		expectedDelay time.Duration
+		expectedNext  time.Duration
+	}{
+		{
+			desc:          "first failure",
+			backoff:       minRestartBackoff,
+			expectedDelay: minRestartBackoff,
+			expectedNext:  2 * minRestartBackoff,
+		},
+		{
+			desc:          "doubles",
+			backoff:       40 * time.Second,
+			uptime:        time.Second,
+			expectedDelay: 40 * time.Second,
+			expectedNext:  80 * time.Second,
+		},
+		{
+			desc:          "capped",
+			backoff:       4 * time.Minute,
+			uptime:        time.Second,
+			expectedDelay: 4 * time.Minute,
+			expectedNext:  maxRestartBackoff,
+		},
+		{
+			desc:          "stays at the cap",
+			backoff:       maxRestartBackoff,
+			expectedDelay: maxRestartBackoff,
+			expectedNext:  maxRestartBackoff,
+		},
+		{
+			desc:          "reset after a long run",
+			backoff:       maxRestartBackoff,
+			uptime:        maxRestartBackoff + time.Second,
+			expectedDelay: minRestartBackoff,
+			expectedNext:  2 * minRestartBackoff,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			delay, next := restartDelay(test.backoff, test.uptime)
+			assert.Equal(t, test.expectedDelay, delay)
+			assert.Equal(t, test.expectedNext, next)
+		})
+	}
+}
+
+func Test_safeCall(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		f       func() error
+		wantErr string
+	}{
+		{
+			desc: "success",
+			f:    func() error { return nil },
+		},
+		{
+			desc:    "error",
+			f:       func() error { return errors.New("failed") },
+			wantErr: "failed",
+		},
+		{
+			desc:    "panic",
+			f:       func() error { panic("boom") },
+			wantErr: "panic: boom",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			err := safeCall(test.f)
+			if test.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, test.wantErr)
+		})
+	}
+}
+
+func Test_isTransient(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		err      error
+		expected bool
+	}{
+		{
+			desc:     "transient",
+			err:      transient(errors.New("timeout")),
+			expected: true,
+		},
+		{
+			desc:     "wrapped transient",
+			err:      fmt.Errorf("relay: %w", transient(errors.New("timeout"))),
+			expected: true,
+		},
+		{
+			desc:     "fatal",
+			err:      errors.New("add outbound failed"),
+			expected: false,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			assert.Equal(t, test.expected, isTransient(test.err))
+		})
+	}
+}
+
+func TestSupervisorCurrentState(t *testing.T) {
+	s := NewSupervisor(nil, nil)
+	assert.Equal(t, StateStopped, s.CurrentState())
+
+	s.setState(StateRunning)
+	assert.Equal(t, StateRunning, s.CurrentState())
+}
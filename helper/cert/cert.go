@@ -7,12 +7,25 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
 )
 
 var defaultPath string
 
 func New(certConf *CertConfig) (*LegoCMD, error) {
-	// Set default path to configPath/cert
+	defaultPath = certDir()
+	lego := &LegoCMD{
+		C:    certConf,
+		path: defaultPath,
+	}
+
+	return lego, nil
+}
+
+// certDir returns the default path configPath/cert
+func certDir() string {
 	var p = ""
 	configPath := os.Getenv("XRAY_LOCATION_CONFIG")
 	if configPath != "" {
@@ -22,14 +35,7 @@ func New(certConf *CertConfig) (*LegoCMD, error) {
 	} else {
 		p = "."
 	}
-
-	defaultPath = filepath.Join(p, "cert")
-	lego := &LegoCMD{
-		C:    certConf,
-		path: defaultPath,
-	}
-
-	return lego, nil
+	return filepath.Join(p, "cert")
 }
 
 func (l *LegoCMD) getPath() string {
@@ -148,6 +154,36 @@ func (l *LegoCMD) RenewCert(CertMode string, CertDomain string) (CertPath string
 	return
 }
 
+// CertFile returns the certificate file served for a domain, it reads no lego
+// state so it is safe to call while certificates are issued or renewed
+func CertFile(certConf *CertConfig, CertMode string, CertDomain string) string {
+	if CertMode == "file" {
+		if certConf == nil {
+			return ""
+		}
+		return certConf.CertFile
+	}
+	return path.Join(certDir(), "certificates", fmt.Sprintf("%s.crt",  sanitizedDomain(CertDomain)))
+}
+
+// CertExpiry returns the expiry time of a certificate file
+func CertExpiry(certPath string) (time.Time, error) {
+	data, err := os.ReadFile(certPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	certificates, err := certcrypto.ParsePEMBundle(data)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parse certificate %s failed: %s", certPath, err)
+	}
+	if len(certificates) == 0 {
+		return time.Time{}, fmt.Errorf("no certificate in %s", certPath)
+	}
+
+	return certificates[0].NotAfter, nil
+}
+
 func checkCertFile(domain string) (string, string, error) {
 	keyPath := path.Join(defaultPath, "certificates", fmt.Sprintf("%s.key",  sanitizedDomain(domain)))
 	certPath := path.Join(defaultPath, "certificates", fmt.Sprintf("%s.crt",  sanitizedDomain(domain)))
@@ -0,0 +1,281 @@
+// Package decoy serves a web site on the fallback of the nodes, so that a
+// probe of a node port sees an ordinary web server
+package decoy
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// DestPrefix marks a fallback dest that names a decoy server
+const DestPrefix = "decoy:"
+
+var servers sync.Map // Key: Name, value: *Server
+
+const notFoundPage = "<html>\r\n<head><title>404 Not Found</title></head>\r\n<body>\r\n<center><h1>404 Not Found</h1></center>\r\n<hr><center>%s</center>\r\n</body>\r\n</html>\r\n"
+
+const welcomePage = `<!DOCTYPE html>
+<html>
+<head>
+<title>Welcome to nginx!</title>
+<style>
+html { color-scheme: light dark; }
+body { width: 35em; margin: 0 auto;
+font-family: Tahoma, Verdana, Arial, sans-serif; }
+</style>
+</head>
+<body>
+<h1>Welcome to nginx!</h1>
+<p>If you see this page, the nginx web server is successfully installed and
+working. Further configuration is required.</p>
+
+<p>For online documentation and support please refer to
+<a href="http://nginx.org/">nginx.org</a>.<br/>
+Commercial support is available at
+<a href="http://nginx.com/">nginx.com</a>.</p>
+
+<p><em>Thank you for using nginx.</em></p>
+</body>
+</html>
+`
+
+// Server is a decoy web server speaking HTTP/1.1 and h2c
+type Server struct {
+	config   *Config
+	listener net.Listener
+	server   *http.Server
+}
+
+// New checks the config of a decoy server
+func New(config *Config) (*Server, error) {
+	if config.Name == "" || config.Listen == "" {
+		return nil, errors.New("decoy server needs a Name and a Listen address")
+	}
+	if err := checkListen(config.Listen); err != nil {
+		return nil, fmt.Errorf("decoy server %s: %w", config.Name, err)
+	}
+	
+	sources := 0
+	for _, source := range []string{config.Root, config.Template, config.ProxyPass} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return nil, fmt.Errorf("decoy server %s: use only one of Root, Template and ProxyPass", config.Name)
+	}
+	
+	if config.ServerHeader == "" {
+		config.ServerHeader = "nginx"
+	}
+	
+	handler, err := newHandler(config)
+	if err != nil {
+		return nil, fmt.Errorf("decoy server %s: %w", config.Name, err)
+	}
+	
+	return &Server{
+		config: config,
+		server: &http.Server{
+			Handler:           h2c.NewHandler(handler, &http2.Server{}),
+			ReadHeaderTimeout: 10 * time.Second,
+			IdleTimeout:       75 * time.Second,
+			ErrorLog:          log.New(os.Stderr, fmt.Sprintf("decoy %s: ", config.Name), 0),
+		},
+	}, nil
+}
+
+// Start listens on the loopback address or unix socket and registers the
+// server for the fallbacks naming it
+func (s *Server) Start() error {
+	network := "tcp"
+	if filepath.IsAbs(s.config.Listen) {
+		network = "unix"
+		os.Remove(s.config.Listen)
+	}
+	
+	listener, err := net.Listen(network, s.config.Listen)
+	if err != nil {
+		return fmt.Errorf("decoy server %s: %w", s.config.Name, err)
+	}
+	s.listener = listener
+	servers.Store(s.config.Name, s)
+	
+	go func() {
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Decoy server %s stopped: %s", s.config.Name, err)
+		}
+	}()
+	
+	log.Printf("Decoy server %s listening on %s", s.config.Name, s.config.Listen)
+	return nil
+}
+
+// checkListen makes sure the decoy is only reachable through the fallbacks,
+// on a loopback address or a unix socket
+func checkListen(listen string) error {
+	if filepath.IsAbs(listen) {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return fmt.Errorf("invalid Listen %s: %w", listen, err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("Listen %s is not a loopback address or a unix socket", listen)
+	}
+	return nil
+}
+
+// Close stops the server
+func (s *Server) Close() error {
+	servers.CompareAndDelete(s.config.Name, s)
+	return s.server.Close()
+}
+
+// Dest returns the fallback dest of a decoy server, a dest without the decoy:
+// prefix is returned unchanged
+func Dest(dest string) (string, error) {
+	if !strings.HasPrefix(dest, DestPrefix) {
+		return dest, nil
+	}
+	
+	name := strings.TrimPrefix(dest, DestPrefix)
+	server, ok := servers.Load(name)
+	if !ok {
+		return "", fmt.Errorf("decoy server %s is not running", name)
+	}
+	return server.(*Server).config.Listen, nil
+}
+
+func newHandler(config *Config) (http.Handler, error) {
+	var handler http.Handler
+	switch {
+		case config.ProxyPass != "":
+			target, err := url.Parse(config.ProxyPass)
+			if err != nil || target.Scheme == "" || target.Host == "" {
+				return nil, fmt.Errorf("invalid ProxyPass %s", config.ProxyPass)
+			}
+			// The real site answers with its own headers
+			return &httputil.ReverseProxy{
+				Rewrite: func(r *httputil.ProxyRequest) {
+					r.SetURL(target)
+					r.Out.Host = target.Host
+				},
+			}, nil
+		case config.Root != "":
+			if info, err := os.Stat(config.Root); err != nil || !info.IsDir() {
+				return nil, fmt.Errorf("Root %s is not a directory", config.Root)
+			}
+			handler = http.FileServer(noListing{http.Dir(config.Root)})
+		case config.Template != "":
+			page, err := template.ParseFiles(config.Template)
+			if err != nil {
+				return nil, err
+			}
+			handler = homePage(func(w http.ResponseWriter, r *http.Request) error {
+				return page.Execute(w, struct {
+					Host string
+					Path string
+					Year int
+				}{r.Host, r.URL.Path, time.Now().Year()})
+			})
+		default:
+			handler = homePage(func(w http.ResponseWriter, r *http.Request) error {
+				_, err := w.Write([]byte(welcomePage))
+				return err
+			})
+	}
+	
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", config.ServerHeader)
+		handler.ServeHTTP(&notFoundWriter{ResponseWriter: w, server: config.ServerHeader}, r)
+	}), nil
+}
+
+// homePage serves a page on / and /index.html, every other path is not found
+func homePage(render func(w http.ResponseWriter, r *http.Request) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" && r.URL.Path != "/index.html" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		if err := render(w, r); err != nil {
+			log.Printf("Decoy page failed: %s", err)
+		}
+	})
+}
+
+// noListing hides the content of the directories without an index.html
+type noListing struct {
+	fs http.FileSystem
+}
+
+func (n noListing) Open(name string) (http.File, error) {
+	f, err := n.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := f.Stat(); err == nil && info.IsDir() {
+		index, err := n.fs.Open(strings.TrimSuffix(name, "/") + "/index.html")
+		if err != nil {
+			f.Close()
+			return nil, os.ErrNotExist
+		}
+		index.Close()
+	}
+	return f, nil
+}
+
+// notFoundWriter replaces the plain text error pages of net/http with the
+// pages of the web server the decoy looks like
+type notFoundWriter struct {
+	http.ResponseWriter
+	server  string
+	replace bool
+}
+
+func (w *notFoundWriter) WriteHeader(status int) {
+	if status == http.StatusNotFound || status == http.StatusMethodNotAllowed {
+		w.replace = true
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Del("X-Content-Type-Options")
+		w.Header().Del("Content-Length")
+		w.ResponseWriter.WriteHeader(status)
+		title := fmt.Sprintf("%d %s", status, http.StatusText(status))
+		page := strings.ReplaceAll(fmt.Sprintf(notFoundPage, w.server), "404 Not Found", title)
+		w.ResponseWriter.Write([]byte(page))
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *notFoundWriter) Write(b []byte) (int, error) {
+	if w.replace {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,63 @@
+package decoy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		listen      string
+		expectError bool
+	}{
+		{
+			desc:   "loopback",
+			listen: "127.0.0.1:8080",
+		},
+		{
+			desc:   "loopback IPv6",
+			listen: "[::1]:8080",
+		},
+		{
+			desc:   "localhost",
+			listen: "localhost:8080",
+		},
+		{
+			desc:   "unix socket",
+			listen: "/dev/shm/decoy.sock",
+		},
+		{
+			desc:        "every address",
+			listen:      "0.0.0.0:8080",
+			expectError: true,
+		},
+		{
+			desc:        "no host",
+			listen:      ":8080",
+			expectError: true,
+		},
+		{
+			desc:        "public address",
+			listen:      "203.0.113.1:8080",
+			expectError: true,
+		},
+		{
+			desc:        "no port",
+			listen:      "127.0.0.1",
+			expectError: true,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := New(&Config{Name: "site", Listen: test.listen})
+			if test.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,10 @@
+package decoy
+
+type Config struct {
+	Name         string `mapstructure:"Name"`         // fallbacks point to it with dest decoy:<Name>
+	Listen       string `mapstructure:"Listen"`       // 127.0.0.1:port, or /path/to/unix.sock
+	Root         string `mapstructure:"Root"`         // static site directory
+	Template     string `mapstructure:"Template"`     // html/template file rendered for the home page
+	ProxyPass    string `mapstructure:"ProxyPass"`    // URL of a real site to reverse proxy
+	ServerHeader string `mapstructure:"ServerHeader"` // default nginx
+}
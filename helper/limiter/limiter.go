@@ -41,11 +41,13 @@ type InboundInfo struct {
 
 type Limiter struct {
 	InboundInfo *sync.Map // Key: Tag, Value: *InboundInfo
+	RuleInfo    *sync.Map // Key: Rule tag, Value: *RuleInfo
 }
 
 func New() *Limiter {
 	return &Limiter{
 		InboundInfo: new(sync.Map),
+		RuleInfo:    new(sync.Map),
 	}
 }
 
@@ -0,0 +1,62 @@
+package limiter
+
+import (
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// RuleInfo throttles the traffic matched by a router rule, every
+// subscription gets its own bucket
+type RuleInfo struct {
+	Tag        string
+	SpeedLimit uint64
+	BucketHub  *sync.Map // key: Email, value: *rate.Limiter
+}
+
+func (l *Limiter) AddRuleLimiter(ruleTag string, speedLimit uint64) error {
+	l.RuleInfo.Store(ruleTag, &RuleInfo{
+		Tag:        ruleTag,
+		SpeedLimit: speedLimit,
+		BucketHub:  new(sync.Map),
+	})
+	return nil
+}
+
+func (l *Limiter) DeleteRuleLimiter(ruleTag string) error {
+	l.RuleInfo.Delete(ruleTag)
+	return nil
+}
+
+// DeleteRuleBuckets removes the buckets of removed subscriptions from every
+// rule limiter
+func (l *Limiter) DeleteRuleBuckets(emails []string) {
+	if len(emails) == 0 {
+		return
+	}
+	l.RuleInfo.Range(func(_, value any) bool {
+		ruleInfo := value.(*RuleInfo)
+		for _, email := range emails {
+			ruleInfo.BucketHub.Delete(email)
+		}
+		return true
+	})
+}
+
+func (l *Limiter) GetRuleLimiter(ruleTag string, email string) (limiter *rate.Limiter, isSpeedLimited bool) {
+	value, ok := l.RuleInfo.Load(ruleTag)
+	if !ok {
+		return nil, false
+	}
+
+	ruleInfo := value.(*RuleInfo)
+	if ruleInfo.SpeedLimit == 0 {
+		return nil, false
+	}
+
+	limiter = rate.NewLimiter(rate.Limit(ruleInfo.SpeedLimit), int(ruleInfo.SpeedLimit)) // Byte/s
+	if v, ok := ruleInfo.BucketHub.LoadOrStore(email, limiter); ok {
+		return v.(*rate.Limiter), true
+	}
+	return limiter, true
+}
@@ -0,0 +1,120 @@
+// Package probe measures the handshake latency of transit servers
+package probe
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xmplusdev/xmplus-server/api"
+)
+
+// Result of a transit server probe
+type Result struct {
+	Latency time.Duration
+	Healthy bool
+	Skipped bool // not probed, the transport runs over UDP
+	Err     error
+}
+
+// Transit dials the transit server and completes a verified TLS handshake when the
+// transit uses tls. Transports over UDP cannot be probed and are reported healthy.
+func Transit(nodeInfo *api.RelayNodeInfo, timeout time.Duration) Result {
+	if nodeInfo.NetworkType == "kcp" || nodeInfo.NetworkType == "mkcp" {
+		return Result{Healthy: true, Skipped: true}
+	}
+
+	address := net.JoinHostPort(nodeInfo.Address, strconv.Itoa(int(nodeInfo.ListeningPort)))
+	start := time.Now()
+
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return Result{Err: err}
+	}
+	defer conn.Close()
+
+	if nodeInfo.SecurityType == "tls" {
+		tlsConfig, err := transitTLSConfig(nodeInfo)
+		if err != nil {
+			return Result{Err: err}
+		}
+
+		conn.SetDeadline(time.Now().Add(timeout))
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return Result{Err: fmt.Errorf("tls handshake with %s failed: %w", address, err)}
+		}
+	}
+
+	return Result{Latency: time.Since(start), Healthy: true}
+}
+
+// transitTLSConfig verifies the transit like its relay outbound does, so that a
+// certificate the outbound rejects is reported instead of failing silently
+func transitTLSConfig(nodeInfo *api.RelayNodeInfo) (*tls.Config, error) {
+	tlsSettings := nodeInfo.TlsSettings
+	if tlsSettings == nil {
+		tlsSettings = &api.TlsSettings{}
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         tlsSettings.ServerName,
+		InsecureSkipVerify: tlsSettings.AllowInsecure,
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = nodeInfo.Address
+	}
+
+	if tlsSettings.CaCertificate != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(tlsSettings.CaCertificate)) {
+			return nil, fmt.Errorf("invalid transit ca certificate")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if tlsSettings.ClientCertificate != "" {
+		certificate, err := tls.X509KeyPair([]byte(tlsSettings.ClientCertificate), []byte(tlsSettings.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid transit client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	if tlsSettings.PinnedPeerCertSha256 != "" {
+		var pinned [][]byte
+		for _, v := range strings.Split(tlsSettings.PinnedPeerCertSha256, "~") {
+			if v = strings.TrimSpace(v); v == "" {
+				continue
+			}
+			hash, err := hex.DecodeString(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pinnedPeerCertSha256: %w", err)
+			}
+			pinned = append(pinned, hash)
+		}
+
+		// A pinned certificate replaces the chain verification
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			for _, rawCert := range rawCerts {
+				hash := sha256.Sum256(rawCert)
+				for _, p := range pinned {
+					if bytes.Equal(hash[:], p) {
+						return nil
+					}
+				}
+			}
+			return fmt.Errorf("certificate verification failed: peer certificate does not match pinnedPeerCertSha256")
+		}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,88 @@
+// Package sysinfo samples host metrics (cpu, memory, load, network) for node status reports
+package sysinfo
+
+import (
+	"sync"
+	"time"
+)
+
+type Stat struct {
+	CPU      float64 // percent of all cores
+	MemTotal uint64  // bytes
+	MemUsed  uint64  // bytes
+	Load1    float64
+	Load5    float64
+	Load15   float64
+	NetIn    uint64 // bytes per second, summed over non-loopback interfaces
+	NetOut   uint64 // bytes per second, summed over non-loopback interfaces
+}
+
+type cpuTimes struct {
+	idle  uint64
+	total uint64
+}
+
+type netCounters struct {
+	rx uint64
+	tx uint64
+}
+
+// Collector keeps the previous cpu and network counters so that
+// each call to Collect reports usage since the last sample.
+type Collector struct {
+	mu       sync.Mutex
+	lastCPU  cpuTimes
+	lastNet  netCounters
+	lastTime time.Time
+}
+
+func NewCollector() *Collector {
+	return &Collector{}
+}
+
+// Collect returns the current host metrics. The first call primes the
+// counters, so CPU and network rates are reported as zero.
+func (c *Collector) Collect() (*Stat, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stat := &Stat{}
+	now := time.Now()
+
+	cpu, err := readCPUTimes()
+	if err != nil {
+		return nil, err
+	}
+	if c.lastCPU.total > 0 && cpu.total > c.lastCPU.total {
+		total := cpu.total - c.lastCPU.total
+		idle := cpu.idle - c.lastCPU.idle
+		stat.CPU = float64(total-idle) / float64(total) * 100
+	}
+	c.lastCPU = cpu
+
+	stat.MemTotal, stat.MemUsed, err = readMemory()
+	if err != nil {
+		return nil, err
+	}
+
+	stat.Load1, stat.Load5, stat.Load15, err = readLoad()
+	if err != nil {
+		return nil, err
+	}
+
+	counters, err := readNetCounters()
+	if err != nil {
+		return nil, err
+	}
+	if !c.lastTime.IsZero() {
+		elapsed := now.Sub(c.lastTime).Seconds()
+		if elapsed > 0 && counters.rx >= c.lastNet.rx && counters.tx >= c.lastNet.tx {
+			stat.NetIn = uint64(float64(counters.rx-c.lastNet.rx) / elapsed)
+			stat.NetOut = uint64(float64(counters.tx-c.lastNet.tx) / elapsed)
+		}
+	}
+	c.lastNet = counters
+	c.lastTime = now
+
+	return stat, nil
+}
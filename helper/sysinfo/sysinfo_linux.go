@@ -0,0 +1,130 @@
+//go:build linux
+
+package sysinfo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func readCPUTimes() (cpuTimes, error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return cpuTimes{}, err
+	}
+	defer f.Close()
+	return parseCPUTimes(f)
+}
+
+func parseCPUTimes(r io.Reader) (cpuTimes, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || fields[0] != "cpu" {
+			continue
+		}
+		var times cpuTimes
+		for i, field := range fields[1:] {
+			v, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return cpuTimes{}, fmt.Errorf("parse /proc/stat failed: %s", err)
+			}
+			times.total += v
+			// idle and iowait
+			if i == 3 || i == 4 {
+				times.idle += v
+			}
+		}
+		return times, nil
+	}
+	return cpuTimes{}, fmt.Errorf("cpu line missing from /proc/stat")
+}
+
+func readMemory() (total uint64, used uint64, err error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	return parseMemory(f)
+}
+
+func parseMemory(r io.Reader) (total uint64, used uint64, err error) {
+	var available uint64
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total = v * 1024
+		case "MemAvailable:":
+			available = v * 1024
+		}
+	}
+	if total == 0 {
+		return 0, 0, fmt.Errorf("MemTotal missing from /proc/meminfo")
+	}
+	if available < total {
+		used = total - available
+	}
+	return total, used, nil
+}
+
+func readLoad() (load1 float64, load5 float64, load15 float64, err error) {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return parseLoad(string(data))
+}
+
+func parseLoad(data string) (load1 float64, load5 float64, load15 float64, err error) {
+	fields := strings.Fields(data)
+	if len(fields) < 3 {
+		return 0, 0, 0, fmt.Errorf("unexpected /proc/loadavg format: %s", data)
+	}
+	load1, _ = strconv.ParseFloat(fields[0], 64)
+	load5, _ = strconv.ParseFloat(fields[1], 64)
+	load15, _ = strconv.ParseFloat(fields[2], 64)
+	return load1, load5, load15, nil
+}
+
+func readNetCounters() (netCounters, error) {
+	f, err := os.Open("/proc/net/dev")
+	if err != nil {
+		return netCounters{}, err
+	}
+	defer f.Close()
+	return parseNetCounters(f), nil
+}
+
+func parseNetCounters(r io.Reader) netCounters {
+	var counters netCounters
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		iface, data, found := strings.Cut(scanner.Text(), ":")
+		if !found || strings.TrimSpace(iface) == "lo" {
+			continue
+		}
+		fields := strings.Fields(data)
+		if len(fields) < 9 {
+			continue
+		}
+		rx, _ := strconv.ParseUint(fields[0], 10, 64)
+		tx, _ := strconv.ParseUint(fields[8], 10, 64)
+		counters.rx += rx
+		counters.tx += tx
+	}
+	return counters
+}
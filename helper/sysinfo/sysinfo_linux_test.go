@@ -0,0 +1,112 @@
+//go:build linux
+
+package sysinfo
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseCPUTimes(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		data     string
+		expected cpuTimes
+		wantErr  bool
+	}{
+		{
+			desc: "aggregate line",
+			data: "cpu  100 20 30 400 50 6 7 0 0 0\ncpu0 50 10 15 200 25 3 3 0 0 0\n",
+			expected: cpuTimes{idle: 450, total: 613},
+		},
+		{
+			desc: "aggregate line after others",
+			data: "intr 1 2 3\ncpu  1 1 1 1 1\n",
+			expected: cpuTimes{idle: 2, total: 5},
+		},
+		{
+			desc:    "missing cpu line",
+			data:    "cpu0 1 2 3 4 5\n",
+			wantErr: true,
+		},
+		{
+			desc:    "bad counter",
+			data:    "cpu  1 x 1 1 1\n",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			times, err := parseCPUTimes(strings.NewReader(test.data))
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, times)
+		})
+	}
+}
+
+func Test_parseMemory(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		data          string
+		expectedTotal uint64
+		expectedUsed  uint64
+		wantErr       bool
+	}{
+		{
+			desc:          "total and available",
+			data:          "MemTotal:       2048 kB\nMemFree:         512 kB\nMemAvailable:   1024 kB\n",
+			expectedTotal: 2048 * 1024,
+			expectedUsed:  1024 * 1024,
+		},
+		{
+			desc:          "no available",
+			data:          "MemTotal:       2048 kB\n",
+			expectedTotal: 2048 * 1024,
+			expectedUsed:  2048 * 1024,
+		},
+		{
+			desc:    "no total",
+			data:    "MemFree:         512 kB\n",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			total, used, err := parseMemory(strings.NewReader(test.data))
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expectedTotal, total)
+			assert.Equal(t, test.expectedUsed, used)
+		})
+	}
+}
+
+func Test_parseLoad(t *testing.T) {
+	load1, load5, load15, err := parseLoad("0.50 1.25 2.00 1/234 5678\n")
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{0.5, 1.25, 2}, []float64{load1, load5, load15})
+
+	_, _, _, err = parseLoad("0.50\n")
+	assert.Error(t, err)
+}
+
+func Test_parseNetCounters(t *testing.T) {
+	data := `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo:    1000      10    0    0    0     0          0         0     1000      10    0    0    0     0       0          0
+  eth0:    2000      20    0    0    0     0          0         0     3000      30    0    0    0     0       0          0
+  eth1:     500       5    0    0    0     0          0         0      700       7    0    0    0     0       0          0
+`
+	assert.Equal(t, netCounters{rx: 2500, tx: 3700}, parseNetCounters(strings.NewReader(data)))
+}
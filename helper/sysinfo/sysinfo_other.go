@@ -0,0 +1,26 @@
+//go:build !linux
+
+package sysinfo
+
+import (
+	"fmt"
+	"runtime"
+)
+
+var errUnsupported = fmt.Errorf("system metrics are not supported on %s", runtime.GOOS)
+
+func readCPUTimes() (cpuTimes, error) {
+	return cpuTimes{}, errUnsupported
+}
+
+func readMemory() (uint64, uint64, error) {
+	return 0, 0, errUnsupported
+}
+
+func readLoad() (float64, float64, float64, error) {
+	return 0, 0, 0, errUnsupported
+}
+
+func readNetCounters() (netCounters, error) {
+	return netCounters{}, errUnsupported
+}
@@ -2,8 +2,10 @@
 package task
 
 import (
+	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/xtls/xray-core/common/task"
@@ -32,12 +34,25 @@ func NewWithInterval(tag string, interval time.Duration, execute func() error) *
 		Tag: tag,
 		Periodic: &task.Periodic{
 			Interval: interval,
-			Execute:  execute,
+			Execute:  recoverExecute(tag, execute),
 		},
 		running: false,
 	}
 }
 
+// recoverExecute turns a panic inside execute into an error, which stops the
+// periodic task instead of crashing the process
+func recoverExecute(tag string, execute func() error) func() error {
+	return func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("task %s panicked: %v", tag, r)
+			}
+		}()
+		return execute()
+	}
+}
+
 // Start begins the periodic task execution
 func (pt *PeriodicTask) Start() error {
 	pt.mu.Lock()
@@ -93,8 +108,9 @@ func (pt *PeriodicTask) Restart() error {
 
 // Manager manages multiple periodic tasks
 type Manager struct {
-	tasks []*PeriodicTask
-	mu    sync.RWMutex
+	tasks        []*PeriodicTask
+	mu           sync.RWMutex
+	errorHandler atomic.Value // func(tag string, err error)
 }
 
 // NewManager creates a new task manager
@@ -104,10 +120,28 @@ func NewManager() *Manager {
 	}
 }
 
+// SetErrorHandler sets a callback invoked when a task fails. A failed task
+// is no longer scheduled by the underlying periodic runner.
+func (m *Manager) SetErrorHandler(handler func(tag string, err error)) {
+	m.errorHandler.Store(handler)
+}
+
 // Add adds a new task to the manager
 func (m *Manager) Add(task *PeriodicTask) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if task.Periodic != nil {
+		execute := task.Periodic.Execute
+		task.Periodic.Execute = func() error {
+			err := execute()
+			if err != nil {
+				if handler, ok := m.errorHandler.Load().(func(string, error)); ok && handler != nil {
+					handler(task.Tag, err)
+				}
+			}
+			return err
+		}
+	}
 	m.tasks = append(m.tasks, task)
 }
 
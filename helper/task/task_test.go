@@ -0,0 +1,70 @@
+package task
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_recoverExecute(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		execute func() error
+		wantErr string
+	}{
+		{
+			desc:    "success",
+			execute: func() error { return nil },
+		},
+		{
+			desc:    "error",
+			execute: func() error { return errors.New("failed") },
+			wantErr: "failed",
+		},
+		{
+			desc:    "panic",
+			execute: func() error { panic("boom") },
+			wantErr: "task test panicked: boom",
+		},
+		{
+			desc: "nil map panic",
+			execute: func() error {
+				var m map[string]int
+				m["a"] = 1
+				return nil
+			},
+			wantErr: "task test panicked: assignment to entry in nil map",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			err := recoverExecute("test", test.execute)()
+			if test.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, test.wantErr)
+		})
+	}
+}
+
+func TestManagerErrorHandler(t *testing.T) {
+	m := NewManager()
+	var failedTag atomic.Value
+	m.SetErrorHandler(func(tag string, err error) {
+		failedTag.Store(tag)
+	})
+
+	m.Add(NewWithInterval("ok", time.Hour, func() error { return nil }))
+	m.Add(NewWithInterval("panics", time.Hour, func() error { panic("boom") }))
+
+	m.StartAll()
+	defer m.CloseAll()
+
+	assert.Equal(t, "panics", failedTag.Load())
+	assert.True(t, m.GetTask("ok").IsRunning())
+}
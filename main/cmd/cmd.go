@@ -7,6 +7,7 @@ import (
 	"path"
 	"runtime"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -82,7 +83,22 @@ func run() error {
 
 	m := manager.New(managerConfig)
 	lastTime := time.Now()
+	var reloadLock sync.Mutex
+	
+	// Persist api keys re-issued by the panel, without triggering a hot reload
+	m.KeyRotated = func(apiHost string, nodeID int, key string) {
+		reloadLock.Lock()
+		defer reloadLock.Unlock()
+		if err := updateNodeKey(config.ConfigFileUsed(), apiHost, nodeID, key); err != nil {
+			log.Errorf("Save rotated api key failed: %s", err)
+			return
+		}
+		lastTime = time.Now()
+	}
+	
 	config.OnConfigChange(func(e fsnotify.Event) {
+		reloadLock.Lock()
+		defer reloadLock.Unlock()
 		// Discarding event received within a short period of time after receiving an event.
 		if time.Now().After(lastTime.Add(3 * time.Second)) {
 			// Hot reload function
@@ -104,7 +120,6 @@ func run() error {
 	})
 
 	m.Start()
-	defer m.Close()
 
 	// Explicitly triggering GC to remove garbage from config loading.
 	runtime.GC()
@@ -113,6 +128,9 @@ func run() error {
 	signal.Notify(osSignals, os.Interrupt, os.Kill, syscall.SIGTERM)
 	<-osSignals
 
+	// Stop accepting connections, drain and report the final traffic before closing the core
+	m.Shutdown()
+
 	return nil
 }
 
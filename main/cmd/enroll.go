@@ -0,0 +1,479 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
+
+	"github.com/xmplusdev/xmplus-server/api"
+)
+
+var (
+	enrollPanel   string
+	enrollToken   string
+	enrollTimeout int
+
+	enrollCmd = &cobra.Command{
+		Use:   "enroll",
+		Short: "Enroll this server on the panel with a one-time token",
+		Long: `Enroll this server on the panel with a one-time token.
+
+The panel returns the api key and the node IDs assigned to this server.
+Existing nodes of the same panel get their api key updated, new nodes are
+appended to the Nodes section of the config file using the controller
+settings of the first configured node.
+
+Examples:
+  enroll --panel https://www.xyz.com --token 4f1c2a
+  enroll -c /etc/XMPlus/config.yml --panel https://www.xyz.com --token 4f1c2a`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := executeEnroll(); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
+		},
+	}
+)
+
+func init() {
+	enrollCmd.Flags().StringVar(&enrollPanel, "panel", "", "Panel URL (required)")
+	enrollCmd.Flags().StringVar(&enrollToken, "token", "", "One-time enrollment token (required)")
+	enrollCmd.Flags().IntVar(&enrollTimeout, "timeout", 30, "Api request timeout in seconds")
+	enrollCmd.MarkFlagRequired("panel")
+	enrollCmd.MarkFlagRequired("token")
+
+	rootCmd.AddCommand(enrollCmd)
+}
+
+func executeEnroll() error {
+	configPath := cfgFile
+	if configPath == "" {
+		configPath = "config.yml"
+	}
+
+	enrollment, err := api.Enroll(enrollPanel, enrollToken, enrollTimeout)
+	if err != nil {
+		return err
+	}
+
+	f, err := loadConfigFile(configPath)
+	if err != nil {
+		return err
+	}
+
+	for _, nodeID := range enrollment.NodeIDs {
+		updated, err := f.setNodeConfig(enrollPanel, nodeID, enrollment.ApiKey, enrollTimeout)
+		if err != nil {
+			return err
+		}
+		if updated {
+			fmt.Printf("Updated api key of NodeID %d\n", nodeID)
+		} else {
+			fmt.Printf("Added NodeID %d\n", nodeID)
+		}
+	}
+
+	if err := f.save(); err != nil {
+		return err
+	}
+
+	fmt.Printf("\n✓ Server enrolled, config written to %s\n", configPath)
+	return nil
+}
+
+// updateNodeKey stores a rotated api key in the config file
+func updateNodeKey(configPath string, apiHost string, nodeID int, key string) error {
+	f, err := loadConfigFile(configPath)
+	if err != nil {
+		return err
+	}
+	if err := f.setRotatedKey(apiHost, nodeID, key); err != nil {
+		return err
+	}
+	return f.save()
+}
+
+// configFile is the text of the config file with its parsed yaml. Edits
+// change the text at the position of the parsed nodes, so the rest of the
+// file keeps the formatting and comments of the operator.
+type configFile struct {
+	path string
+	data []byte
+	doc  *yaml.Node
+}
+
+func loadConfigFile(configPath string) (*configFile, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read config file %s failed: %s", configPath, err)
+	}
+
+	f := &configFile{path: configPath, data: data}
+	if err := f.parse(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *configFile) parse() error {
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal(f.data, doc); err != nil {
+		return fmt.Errorf("parse config file %s failed: %s", f.path, err)
+	}
+
+	if len(doc.Content) == 0 {
+		doc.Kind = yaml.DocumentNode
+		doc.Content = []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}
+	}
+	if doc.Kind != yaml.DocumentNode || doc.Content[0].Kind != yaml.MappingNode || doc.Content[0].Style&yaml.FlowStyle != 0 {
+		return fmt.Errorf("config file %s is not a yaml block mapping", f.path)
+	}
+
+	f.doc = doc
+	return nil
+}
+
+func (f *configFile) save() error {
+	// Write to a temporary file first so that a running instance never reads a partial config
+	tmpFile := filepath.Join(filepath.Dir(f.path), "."+filepath.Base(f.path)+".tmp")
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(f.path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := os.WriteFile(tmpFile, f.data, mode); err != nil {
+		return fmt.Errorf("write config file %s failed: %s", f.path, err)
+	}
+
+	return os.Rename(tmpFile, f.path)
+}
+
+func (f *configFile) root() *yaml.Node {
+	return f.doc.Content[0]
+}
+
+func (f *configFile) lines() []string {
+	return strings.Split(string(f.data), "\n")
+}
+
+// setLines replaces the text and parses it again for the next edit
+func (f *configFile) setLines(lines []string) error {
+	f.data = []byte(strings.Join(lines, "\n"))
+	return f.parse()
+}
+
+// insertLines inserts text after a line, 0 inserts at the top of the file
+func (f *configFile) insertLines(after int, text []string) error {
+	lines := f.lines()
+	if after > len(lines) {
+		after = len(lines)
+	}
+	result := append([]string{}, lines[:after]...)
+	result = append(result, text...)
+	result = append(result, lines[after:]...)
+	return f.setLines(result)
+}
+
+// endLine returns the line after which text is appended to the file
+func (f *configFile) endLine() int {
+	lines := f.lines()
+	end := len(lines)
+	for end > 0 && strings.TrimSpace(lines[end-1]) == "" {
+		end--
+	}
+	return end
+}
+
+// setRotatedKey stores the key of a node, nodes discovered in server mode
+// share the key of the server
+func (f *configFile) setRotatedKey(apiHost string, nodeID int, key string) error {
+	nodes := mappingValue(f.root(), "Nodes")
+	if apiConfig := findNodeConfig(nodes, apiHost, nodeID); apiConfig != nil {
+		return f.setApiKey(apiConfig, key)
+	}
+
+	apiConfig := mappingValue(mappingValue(f.root(), "Server"), "ApiConfig")
+	host := mappingValue(apiConfig, "ApiHost")
+	if host == nil || strings.TrimRight(host.Value, "/") != strings.TrimRight(apiHost, "/") {
+		return fmt.Errorf("NodeID %d of %s not found in %s", nodeID, apiHost, f.path)
+	}
+	if current := mappingValue(apiConfig, "ApiKey"); current != nil && current.Value == key {
+		return nil
+	}
+	return f.setApiKey(apiConfig, key)
+}
+
+// setNodeConfig updates the api key of a node, or appends a new node entry.
+// It returns true when the node already existed.
+func (f *configFile) setNodeConfig(apiHost string, nodeID int, key string, timeout int) (bool, error) {
+	nodes := mappingValue(f.root(), "Nodes")
+	if apiConfig := findNodeConfig(nodes, apiHost, nodeID); apiConfig != nil {
+		return true, f.setApiKey(apiConfig, key)
+	}
+
+	if timeout <= 0 {
+		timeout = 30
+	}
+	apiConfig := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	setMappingValue(apiConfig, "ApiHost", scalarNode(apiHost))
+	setMappingValue(apiConfig, "ApiKey", scalarNode(key))
+	setMappingValue(apiConfig, "NodeID", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.Itoa(nodeID)})
+	setMappingValue(apiConfig, "Timeout", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.Itoa(timeout)})
+
+	entry := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	setMappingValue(entry, "ApiConfig", apiConfig)
+
+	// New nodes share the controller settings of the first configured node
+	if nodes != nil && nodes.Kind == yaml.SequenceNode && len(nodes.Content) > 0 {
+		if controllerConfig := mappingValue(nodes.Content[0], "ControllerConfig"); controllerConfig != nil {
+			setMappingValue(entry, "ControllerConfig", copyNode(controllerConfig))
+		}
+	}
+
+	return false, f.appendNode(entry)
+}
+
+// appendNode adds an entry to the end of the Nodes sequence
+func (f *configFile) appendNode(entry *yaml.Node) error {
+	root := f.root()
+	var key, nodes *yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if strings.EqualFold(root.Content[i].Value, "Nodes") {
+			key, nodes = root.Content[i], root.Content[i+1]
+		}
+	}
+
+	switch {
+		case key == nil:
+			text, err := sequenceEntry(entry, "  ")
+			if err != nil {
+				return err
+			}
+			return f.insertLines(f.endLine(), append([]string{"Nodes:"}, text...))
+		case nodes.Kind == yaml.SequenceNode && len(nodes.Content) > 0:
+			if nodes.Style&yaml.FlowStyle != 0 {
+				return fmt.Errorf("Nodes at line %d of %s is a flow sequence, add the node by hand", key.Line, f.path)
+			}
+			first := nodes.Content[0]
+			indent := strings.Repeat(" ", max(first.Column-3, 0))
+			if line := f.lines()[first.Line-1]; first.Column-1 <= len(line) {
+				if dash := strings.LastIndex(line[:first.Column-1], "-"); dash >= 0 {
+					indent = strings.Repeat(" ", dash)
+				}
+			}
+			text, err := sequenceEntry(entry, indent)
+			if err != nil {
+				return err
+			}
+			return f.insertLines(lastLine(nodes), text)
+		case nodes.Kind == yaml.SequenceNode || (nodes.Kind == yaml.ScalarNode && nodes.Tag == "!!null"):
+			// An empty list, the value is dropped from the key line
+			lines := f.lines()
+			line := lines[key.Line-1]
+			colon := strings.Index(line[key.Column-1:], ":")
+			if colon < 0 || lastLine(nodes) != key.Line {
+				return fmt.Errorf("cannot add a node to Nodes at line %d of %s", key.Line, f.path)
+			}
+			lines[key.Line-1] = line[:key.Column+colon]
+			if err := f.setLines(lines); err != nil {
+				return err
+			}
+			text, err := sequenceEntry(entry, strings.Repeat(" ", key.Column+1))
+			if err != nil {
+				return err
+			}
+			return f.insertLines(key.Line, text)
+		default:
+			return fmt.Errorf("Nodes at line %d of %s is not a list", key.Line, f.path)
+	}
+}
+
+// setApiKey sets the ApiKey of an ApiConfig mapping
+func (f *configFile) setApiKey(apiConfig *yaml.Node, apiKey string) error {
+	for i := 0; i+1 < len(apiConfig.Content); i += 2 {
+		if strings.EqualFold(apiConfig.Content[i].Value, "ApiKey") {
+			return f.replaceValue(apiConfig.Content[i], apiConfig.Content[i+1], apiKey)
+		}
+	}
+
+	if apiConfig.Style&yaml.FlowStyle != 0 || len(apiConfig.Content) == 0 {
+		return fmt.Errorf("cannot add ApiKey to ApiConfig at line %d of %s", apiConfig.Line, f.path)
+	}
+	indent := strings.Repeat(" ", apiConfig.Content[0].Column-1)
+	return f.insertLines(lastLine(apiConfig), []string{indent + "ApiKey: " + scalarText(apiKey, 0)})
+}
+
+// replaceValue replaces the single line scalar value of a key, keeping its quoting
+func (f *configFile) replaceValue(key *yaml.Node, value *yaml.Node, text string) error {
+	lines := f.lines()
+	if value.Kind != yaml.ScalarNode || value.Line < 1 || value.Line > len(lines) {
+		return fmt.Errorf("%s at line %d of %s is not a scalar", key.Value, key.Line, f.path)
+	}
+
+	// An empty value has no text of its own
+	if value.Tag == "!!null" && value.Value == "" {
+		line := lines[key.Line-1]
+		colon := strings.Index(line[key.Column-1:], ":")
+		if colon < 0 {
+			return fmt.Errorf("cannot edit %s at line %d of %s", key.Value, key.Line, f.path)
+		}
+		lines[key.Line-1] = line[:key.Column+colon] + " " + scalarText(text, 0)
+		return f.setLines(lines)
+	}
+
+	line := lines[value.Line-1]
+	start := value.Column - 1
+	end, ok := scalarEnd(line, start, value)
+	if !ok {
+		return fmt.Errorf("cannot edit %s at line %d of %s", key.Value, key.Line, f.path)
+	}
+	lines[value.Line-1] = line[:start] + scalarText(text, value.Style) + line[end:]
+	return f.setLines(lines)
+}
+
+// scalarEnd returns the end of a single line scalar starting at start
+func scalarEnd(line string, start int, node *yaml.Node) (int, bool) {
+	if start < 0 || start >= len(line) {
+		return 0, false
+	}
+
+	switch {
+		case node.Style&yaml.DoubleQuotedStyle != 0:
+			for i := start + 1; i < len(line); i++ {
+				switch line[i] {
+					case '\\':
+						i++
+					case '"':
+						return i + 1, true
+				}
+			}
+		case node.Style&yaml.SingleQuotedStyle != 0:
+			for i := start + 1; i < len(line); i++ {
+				if line[i] != '\'' {
+					continue
+				}
+				if i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					continue
+				}
+				return i + 1, true
+			}
+		case node.Style&(yaml.LiteralStyle|yaml.FoldedStyle) == 0:
+			if strings.HasPrefix(line[start:], node.Value) {
+				return start + len(node.Value), true
+			}
+	}
+	return 0, false
+}
+
+// scalarText renders a value in the quoting style of the value it replaces
+func scalarText(value string, style yaml.Style) string {
+	switch {
+		case style&yaml.DoubleQuotedStyle != 0:
+			return strconv.Quote(value)
+		case style&yaml.SingleQuotedStyle != 0:
+			return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+	}
+
+	data, err := yaml.Marshal(value)
+	if err != nil {
+		return strconv.Quote(value)
+	}
+	return strings.TrimSuffix(string(data), "\n")
+}
+
+// sequenceEntry renders a new sequence entry with its dash at indent
+func sequenceEntry(entry *yaml.Node, indent string) ([]string, error) {
+	var buffer bytes.Buffer
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(entry); err != nil {
+		return nil, err
+	}
+	encoder.Close()
+
+	var text []string
+	for i, line := range strings.Split(strings.TrimRight(buffer.String(), "\n"), "\n") {
+		if i == 0 {
+			text = append(text, indent+"- "+line)
+		} else {
+			text = append(text, indent+"  "+line)
+		}
+	}
+	return text, nil
+}
+
+// lastLine returns the last line of a node and its children
+func lastLine(node *yaml.Node) int {
+	last := node.Line
+	for _, c := range node.Content {
+		if l := lastLine(c); l > last {
+			last = l
+		}
+	}
+	return last
+}
+
+// findNodeConfig returns the ApiConfig mapping of a node
+func findNodeConfig(nodes *yaml.Node, apiHost string, nodeID int) *yaml.Node {
+	if nodes == nil {
+		return nil
+	}
+	for _, entry := range nodes.Content {
+		apiConfig := mappingValue(entry, "ApiConfig")
+		if apiConfig == nil {
+			continue
+		}
+		host := mappingValue(apiConfig, "ApiHost")
+		id := mappingValue(apiConfig, "NodeID")
+		if host == nil || id == nil {
+			continue
+		}
+		if strings.TrimRight(host.Value, "/") == strings.TrimRight(apiHost, "/") && id.Value == strconv.Itoa(nodeID) {
+			return apiConfig
+		}
+	}
+	return nil
+}
+
+// mappingValue looks up a key case-insensitively, like viper does
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if strings.EqualFold(node.Content[i].Value, key) {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func setMappingValue(node *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if strings.EqualFold(node.Content[i].Value, key) {
+			// Keep the comments of the replaced value
+			value.LineComment = node.Content[i+1].LineComment
+			node.Content[i+1] = value
+			return
+		}
+	}
+	node.Content = append(node.Content, scalarNode(key), value)
+}
+
+func scalarNode(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
+
+func copyNode(node *yaml.Node) *yaml.Node {
+	n := *node
+	n.Content = make([]*yaml.Node, len(node.Content))
+	for i, c := range node.Content {
+		n.Content[i] = copyNode(c)
+	}
+	return &n
+}
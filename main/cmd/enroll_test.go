@@ -0,0 +1,274 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_setNodeConfig(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		config      string
+		apiHost     string
+		nodeID      int
+		key         string
+		expected    string
+		wantUpdated bool
+	}{
+		{
+			desc: "update key keeps formatting and comments",
+			config: `Log:
+    Level: warning   # Log level
+Nodes:
+  -
+    ApiConfig:
+      ApiHost: "https://www.xyz.com"
+      ApiKey: "old"    # Panel key
+      NodeID: 1
+`,
+			apiHost: "https://www.xyz.com",
+			nodeID:  1,
+			key:     "new",
+			expected: `Log:
+    Level: warning   # Log level
+Nodes:
+  -
+    ApiConfig:
+      ApiHost: "https://www.xyz.com"
+      ApiKey: "new"    # Panel key
+      NodeID: 1
+`,
+			wantUpdated: true,
+		},
+		{
+			desc: "update plain and single quoted keys",
+			config: `Nodes:
+  - ApiConfig: {ApiHost: a, ApiKey: 'it''s', NodeID: 1}
+  - ApiConfig:
+      ApiHost: a
+      ApiKey: old
+      NodeID: 2
+`,
+			apiHost: "a",
+			nodeID:  2,
+			key:     "#new",
+			expected: `Nodes:
+  - ApiConfig: {ApiHost: a, ApiKey: 'it''s', NodeID: 1}
+  - ApiConfig:
+      ApiHost: a
+      ApiKey: '#new'
+      NodeID: 2
+`,
+			wantUpdated: true,
+		},
+		{
+			desc: "add a missing key",
+			config: `Nodes:
+  -
+    ApiConfig:
+      ApiHost: a
+      NodeID: 1
+    ControllerConfig:
+      ListenIP: 0.0.0.0
+`,
+			apiHost: "a",
+			nodeID:  1,
+			key:     "new",
+			expected: `Nodes:
+  -
+    ApiConfig:
+      ApiHost: a
+      NodeID: 1
+      ApiKey: new
+    ControllerConfig:
+      ListenIP: 0.0.0.0
+`,
+			wantUpdated: true,
+		},
+		{
+			desc: "append a node with the controller config of the first",
+			config: `Nodes:
+  -
+    ApiConfig:
+      ApiHost: a
+      ApiKey: old
+      NodeID: 1
+    ControllerConfig:
+      ListenIP: 0.0.0.0
+
+# Trailing comment
+`,
+			apiHost: "a",
+			nodeID:  2,
+			key:     "new",
+			expected: `Nodes:
+  -
+    ApiConfig:
+      ApiHost: a
+      ApiKey: old
+      NodeID: 1
+    ControllerConfig:
+      ListenIP: 0.0.0.0
+  - ApiConfig:
+      ApiHost: a
+      ApiKey: new
+      NodeID: 2
+      Timeout: 30
+    ControllerConfig:
+      ListenIP: 0.0.0.0
+
+# Trailing comment
+`,
+		},
+		{
+			desc: "append to an empty list",
+			config: `Log:
+  Level: warning
+Nodes: []   # none yet
+`,
+			apiHost: "a",
+			nodeID:  1,
+			key:     "new",
+			expected: `Log:
+  Level: warning
+Nodes:
+  - ApiConfig:
+      ApiHost: a
+      ApiKey: new
+      NodeID: 1
+      Timeout: 30
+`,
+		},
+		{
+			desc: "append without a Nodes section",
+			config: `Log:
+  Level: warning
+`,
+			apiHost: "a",
+			nodeID:  1,
+			key:     "new",
+			expected: `Log:
+  Level: warning
+Nodes:
+  - ApiConfig:
+      ApiHost: a
+      ApiKey: new
+      NodeID: 1
+      Timeout: 30
+`,
+		},
+		{
+			desc:    "new file",
+			config:  "",
+			apiHost: "a",
+			nodeID:  1,
+			key:     "new",
+			expected: `Nodes:
+  - ApiConfig:
+      ApiHost: a
+      ApiKey: new
+      NodeID: 1
+      Timeout: 30
+`,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			f := &configFile{path: "config.yml", data: []byte(test.config)}
+			require.NoError(t, f.parse())
+
+			updated, err := f.setNodeConfig(test.apiHost, test.nodeID, test.key, 0)
+			require.NoError(t, err)
+			assert.Equal(t, test.wantUpdated, updated)
+			assert.Equal(t, test.expected, string(f.data))
+		})
+	}
+}
+
+func Test_setRotatedKey(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		config   string
+		nodeID   int
+		expected string
+		wantErr  bool
+	}{
+		{
+			desc: "configured node",
+			config: `Nodes:
+  - ApiConfig:
+      ApiHost: https://a/
+      ApiKey: old
+      NodeID: 3
+`,
+			nodeID: 3,
+			expected: `Nodes:
+  - ApiConfig:
+      ApiHost: https://a/
+      ApiKey: new
+      NodeID: 3
+`,
+		},
+		{
+			desc: "node discovered in server mode",
+			config: `Server:
+  ApiConfig:
+    ApiHost: https://a
+    ApiKey: old # server key
+Nodes: []
+`,
+			nodeID: 7,
+			expected: `Server:
+  ApiConfig:
+    ApiHost: https://a
+    ApiKey: new # server key
+Nodes: []
+`,
+		},
+		{
+			desc: "unknown panel",
+			config: `Server:
+  ApiConfig:
+    ApiHost: https://b
+    ApiKey: old
+`,
+			nodeID:  7,
+			wantErr: true,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			f := &configFile{path: "config.yml", data: []byte(test.config)}
+			require.NoError(t, f.parse())
+
+			err := f.setRotatedKey("https://a", test.nodeID, "new")
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, string(f.data))
+		})
+	}
+}
+
+func Test_updateNodeKey(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yml")
+	require.NoError(t, os.WriteFile(configPath, []byte("Nodes:\n  - ApiConfig:\n      ApiHost: a\n      ApiKey: old\n      NodeID: 1\n"), 0600))
+
+	require.NoError(t, updateNodeKey(configPath, "a", 1, "new"))
+
+	data, err := os.ReadFile(configPath)
+	require.NoError(t, err)
+	assert.Equal(t, "Nodes:\n  - ApiConfig:\n      ApiHost: a\n      ApiKey: new\n      NodeID: 1\n", string(data))
+
+	info, err := os.Stat(configPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
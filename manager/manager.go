@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"log"
 	"os"
+	"strings"
 	"sync"
+	"time"
 
 	"dario.cat/mergo"
 	"github.com/r3labs/diff/v2"
@@ -12,10 +14,14 @@ import (
 	"github.com/xtls/xray-core/app/stats"
 	"github.com/xtls/xray-core/common/serial"
 	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/routing"
 	"github.com/xtls/xray-core/infra/conf"
 
 	"github.com/xmplusdev/xmplus-server/api"
 	"github.com/xmplusdev/xmplus-server/controller"
+	"github.com/xmplusdev/xmplus-server/helper/decoy"
+	"github.com/xmplusdev/xmplus-server/helper/task"
+	"github.com/xmplusdev/xmplus-server/node"
 	_ "github.com/xmplusdev/xmplus-server/main/distro/all"
 	"github.com/xmplusdev/xmplus-server/app/dispatcher"
 )
@@ -25,8 +31,21 @@ type Manager struct {
 	statusLock    sync.Mutex
 	managerConfig *Config
 	Server        *core.Instance
+	nodeManager   *node.Manager // inbounds and rules of Server, shared by its controllers
 	Service       []controller.ControllerInterface
 	Running       bool
+	// KeyRotated is called when the panel re-issued the api key of a node
+	KeyRotated    func(apiHost string, nodeID int, key string)
+	// Server mode, nodes assigned by the panel
+	serverLock    sync.Mutex
+	serverClient  *api.Client
+	serverTask    *task.PeriodicTask
+	serverNodes   map[int]controller.ControllerInterface
+	serverIDs     []int
+	// Api keys shared by the nodes of the same panel server
+	credentials   map[string]*api.Credentials
+	// Decoy web servers for the fallbacks, they outlive core restarts
+	decoys        []*decoy.Server
 }
 
 // ManagerInterface for dependency injection
@@ -169,47 +188,69 @@ func (m *Manager) Start() {
 		log.Panicf("Failed to start instance: %s", err)
 	}
 	m.Server = server
+	m.nodeManager = node.NewManager(server)
+	
+	// The fallbacks of the nodes check that the decoy servers answer
+	m.startDecoys()
+	
+	m.credentials = make(map[string]*api.Credentials)
 
 	// Load Nodes config
-	for _, nodeConfig := range m.managerConfig.NodesConfig {
-		var client api.API
-		client = api.New(nodeConfig.ApiConfig)
-		
-		var controllerService controller.ControllerInterface
-		// Register controller service
-		controllerConfig := getDefaultControllerConfig()
-		if nodeConfig.ControllerConfig != nil {
-			if err := mergo.Merge(controllerConfig, nodeConfig.ControllerConfig, mergo.WithOverride); err != nil {
-				log.Panicf("Read Controller Config Failed")
-			}
-		}
-		controllerService = controller.New(server, client, controllerConfig)
-		
-		// Set manager reference if controller supports it
-		if ctrl, ok := controllerService.(interface{ SetManager(ManagerInterface) }); ok {
-			ctrl.SetManager(m)
+	for i, nodeConfig := range m.managerConfig.NodesConfig {
+		controllerService, err := m.newService(server, nodeConfig, m.nodeCredentials(nodeConfig))
+		if err != nil {
+			log.Printf("XMPlus failed to read the controller config of node %d: %s", i+1, err)
+			continue
 		}
 		
 		m.Service = append(m.Service, controllerService)
 
 	}
 
-	// Start all the service
+	// Start all the service, a failing node is restarted by its supervisor
+	// while the other nodes keep serving
 	for _, s := range m.Service {
 		err := s.Start()
 		if err != nil {
-			log.Panicf("XMPlus fialed to start: %s", err)
+			log.Printf("XMPlus fialed to start service: %s", err)
 		}
 	}
+	
+	m.startServerNodes(server)
+	
 	m.Running = true
 	return
 }
 
+// newService builds a supervised controller for one node, its clients use the
+// credentials of the panel server
+func (m *Manager) newService(server *core.Instance, nodeConfig *NodesConfig, credentials *api.Credentials) (controller.ControllerInterface, error) {
+	var client api.API
+	client = api.NewWithCredentials(nodeConfig.ApiConfig, credentials)
+	
+	// Register controller service
+	controllerConfig := getDefaultControllerConfig()
+	if nodeConfig.ControllerConfig != nil {
+		if err := mergo.Merge(controllerConfig, nodeConfig.ControllerConfig, mergo.WithOverride); err != nil {
+			return nil, err
+		}
+	}
+	
+	nodeManager := m.nodeManager
+	return controller.NewSupervisor(client, func() *controller.Controller {
+		c := controller.New(server, nodeManager, client, controllerConfig)
+		c.SetManager(m)
+		return c
+	}), nil
+}
+
 // Close the manager
 func (m *Manager) Close() {
 	m.statusLock.Lock()
 	defer m.statusLock.Unlock()
 	
+	m.closeServerNodes()
+	
 	for _, s := range m.Service {
 		err := s.Close()
 		if err != nil {
@@ -217,17 +258,120 @@ func (m *Manager) Close() {
 		}
 	}
 	
+	m.flushServices()
+	m.closeDecoys()
+	
 	m.Service = nil
 	m.Server.Close()
 	m.Running = false
 	return
 }
 
+// startDecoys starts the decoy web servers of the config
+func (m *Manager) startDecoys() {
+	for _, decoyConfig := range m.managerConfig.Decoys {
+		server, err := decoy.New(decoyConfig)
+		if err == nil {
+			err = server.Start()
+		}
+		if err != nil {
+			log.Printf("XMPlus fialed to start decoy server: %s", err)
+			continue
+		}
+		m.decoys = append(m.decoys, server)
+	}
+}
+
+// closeDecoys stops the decoy web servers
+func (m *Manager) closeDecoys() {
+	for _, server := range m.decoys {
+		if err := server.Close(); err != nil {
+			log.Printf("Warning: Failed to close decoy server: %s", err)
+		}
+	}
+	m.decoys = nil
+}
+
+// Shutdown gracefully stops the manager: new connections are refused, established
+// ones are given up to DrainTimeout seconds to finish, then the final traffic is
+// reported before the core is closed
+func (m *Manager) Shutdown() {
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+	
+	m.closeServerNodes()
+	
+	for _, s := range m.Service {
+		if err := s.Close(); err != nil {
+			log.Printf("Warning: Failed to close service during shutdown: %s", err)
+		}
+	}
+	
+	for _, s := range m.Service {
+		if err := s.Drain(); err != nil {
+			log.Printf("Warning: Failed to drain service during shutdown: %s", err)
+		}
+	}
+	
+	if m.managerConfig.DrainTimeout > 0 {
+		m.drainConnections(time.Duration(m.managerConfig.DrainTimeout) * time.Second)
+	}
+	
+	m.flushServices()
+	m.closeDecoys()
+	
+	m.Service = nil
+	if m.Server != nil {
+		m.Server.Close()
+	}
+	m.Running = false
+	log.Println("XMPlus stopped")
+}
+
+// drainConnections waits until the established connections are closed or the
+// timeout is reached
+func (m *Manager) drainConnections(timeout time.Duration) {
+	if m.Server == nil {
+		return
+	}
+	d, ok := m.Server.GetFeature(routing.DispatcherType()).(*dispatcher.DefaultDispatcher)
+	if !ok {
+		return
+	}
+	
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	
+	open := d.TotalConnections()
+	if open > 0 {
+		log.Printf("Draining %d connections for up to %s", open, timeout)
+	}
+	for ; open > 0; open = d.TotalConnections() {
+		if time.Now().After(deadline) {
+			log.Printf("Drain timeout reached with %d connections open", open)
+			return
+		}
+		<-ticker.C
+	}
+}
+
+// flushServices runs a final traffic and online ip report for every controller
+func (m *Manager) flushServices() {
+	for _, s := range m.Service {
+		if err := s.Flush(); err != nil {
+			log.Printf("Warning: Failed to report final traffic: %s", err)
+		}
+	}
+}
+
 // Restart the manager
 func (m *Manager) Restart() error {
 	m.statusLock.Lock()
 	defer m.statusLock.Unlock()
 	
+	m.closeServerNodes()
+	
 	// Close all services
 	for _, s := range m.Service {
 		if err := s.Close(); err != nil {
@@ -235,6 +379,8 @@ func (m *Manager) Restart() error {
 		}
 	}
 	
+	m.flushServices()
+	
 	// Close the server
 	if m.Server != nil {
 		m.Server.Close()
@@ -250,21 +396,15 @@ func (m *Manager) Restart() error {
 		log.Panicf("Failed to restart instance: %s", err)
 	}
 	m.Server = server
+	m.nodeManager = node.NewManager(server)
 	
 	// Reload and start services
+	m.credentials = make(map[string]*api.Credentials)
 	for _, nodeConfig := range m.managerConfig.NodesConfig {
-		var apiClient api.API
-		apiClient = api.New(nodeConfig.ApiConfig)
-		
-		var controllerService controller.ControllerInterface
-		// Register controller service
-		controllerConfig := getDefaultControllerConfig()
-		if nodeConfig.ControllerConfig != nil {
-			if err := mergo.Merge(controllerConfig, nodeConfig.ControllerConfig, mergo.WithOverride); err != nil {
-				return err
-			}
+		controllerService, err := m.newService(server, nodeConfig, m.nodeCredentials(nodeConfig))
+		if err != nil {
+			return err
 		}
-		controllerService = controller.New(server, apiClient, controllerConfig)
 		m.Service = append(m.Service, controllerService)
 	}
 	
@@ -275,11 +415,157 @@ func (m *Manager) Restart() error {
 		}
 	}
 	
+	m.startServerNodes(server)
+	
 	m.Running = true
 	log.Println("XMPlus restarted successfully")
 	return nil
 }
 
+// sharedCredentials returns the credentials shared by the nodes configured
+// with the same panel host and api key
+func (m *Manager) sharedCredentials(apiConfig *api.Config) *api.Credentials {
+	id := strings.TrimRight(apiConfig.APIHost, "/") + "|" + apiConfig.Key
+	if credentials, ok := m.credentials[id]; ok {
+		return credentials
+	}
+	credentials := api.NewCredentials(apiConfig.Key)
+	m.credentials[id] = credentials
+	return credentials
+}
+
+// nodeCredentials returns the shared credentials of a configured node, a
+// rotated key is saved in the config of every node using it
+func (m *Manager) nodeCredentials(nodeConfig *NodesConfig) *api.Credentials {
+	credentials := m.sharedCredentials(nodeConfig.ApiConfig)
+	credentials.OnRotated(func(key string) {
+		nodeConfig.ApiConfig.Key = key
+		if m.KeyRotated != nil {
+			m.KeyRotated(nodeConfig.ApiConfig.APIHost, nodeConfig.ApiConfig.NodeID, key)
+		}
+	})
+	return credentials
+}
+
+// startServerNodes starts the periodic node discovery of server mode
+func (m *Manager) startServerNodes(server *core.Instance) {
+	serverConfig := m.managerConfig.ServerConfig
+	if serverConfig == nil || serverConfig.ApiConfig == nil || serverConfig.ApiConfig.APIHost == "" {
+		return
+	}
+	
+	interval := serverConfig.UpdatePeriodic
+	if interval <= 0 {
+		interval = 60
+	}
+	
+	// The discovered nodes use the server key, a key rotated through any of
+	// them is saved as the server key. NodeID 0 selects the Server section.
+	credentials := m.sharedCredentials(serverConfig.ApiConfig)
+	credentials.OnRotated(func(key string) {
+		serverConfig.ApiConfig.Key = key
+		if m.KeyRotated != nil {
+			m.KeyRotated(serverConfig.ApiConfig.APIHost, 0, key)
+		}
+	})
+	m.serverClient = api.NewWithCredentials(serverConfig.ApiConfig, credentials)
+	m.serverNodes = make(map[int]controller.ControllerInterface)
+	m.serverIDs = nil
+	m.serverTask = task.NewWithInterval("server_nodes", time.Duration(interval)*time.Second, func() error {
+		m.syncServerNodes(server)
+		return nil
+	})
+	
+	log.Printf("[%s] Server mode, node assignment is updated every %d seconds", serverConfig.ApiConfig.APIHost, interval)
+	if err := m.serverTask.Start(); err != nil {
+		log.Printf("[%s] Start node discovery failed: %s", serverConfig.ApiConfig.APIHost, err)
+	}
+}
+
+// syncServerNodes starts the nodes newly assigned by the panel and removes
+// the ones that are no longer assigned
+func (m *Manager) syncServerNodes(server *core.Instance) {
+	serverConfig := m.managerConfig.ServerConfig
+	
+	nodeIDs, err := m.serverClient.GetServerNodes()
+	if err != nil && err.Error() != api.ServerNodesNotModified {
+		log.Printf("[%s] Get server nodes failed: %s", serverConfig.ApiConfig.APIHost, err)
+		return
+	}
+	
+	m.serverLock.Lock()
+	defer m.serverLock.Unlock()
+	
+	// Server mode was closed while the panel was queried
+	if m.serverNodes == nil {
+		return
+	}
+	
+	// The assignment is unchanged, retry the nodes that failed to start
+	if err != nil {
+		nodeIDs = m.serverIDs
+	}
+	m.serverIDs = nodeIDs
+	
+	assigned := make(map[int]bool, len(nodeIDs))
+	for _, nodeID := range nodeIDs {
+		assigned[nodeID] = true
+		if _, ok := m.serverNodes[nodeID]; ok {
+			continue
+		}
+		
+		nodeConfig := &NodesConfig{
+			ApiConfig: &api.Config{
+				APIHost: serverConfig.ApiConfig.APIHost,
+				NodeID:  nodeID,
+				Key:     m.serverClient.Describe().Key,
+				Timeout: serverConfig.ApiConfig.Timeout,
+			},
+			ControllerConfig: serverConfig.ControllerConfig,
+		}
+		controllerService, err := m.newService(server, nodeConfig, m.serverClient.Credentials())
+		if err != nil {
+			log.Printf("[%s] (NodeID=%d) Read Controller Config Failed: %s", serverConfig.ApiConfig.APIHost, nodeID, err)
+			continue
+		}
+		if err := controllerService.Start(); err != nil {
+			log.Printf("[%s] (NodeID=%d) Start node failed: %s", serverConfig.ApiConfig.APIHost, nodeID, err)
+			continue
+		}
+		m.serverNodes[nodeID] = controllerService
+		log.Printf("[%s] (NodeID=%d) Node assigned to this server", serverConfig.ApiConfig.APIHost, nodeID)
+	}
+	
+	for nodeID, controllerService := range m.serverNodes {
+		if assigned[nodeID] {
+			continue
+		}
+		if err := controllerService.Remove(); err != nil {
+			log.Printf("[%s] (NodeID=%d) Remove node failed: %s", serverConfig.ApiConfig.APIHost, nodeID, err)
+		}
+		delete(m.serverNodes, nodeID)
+		log.Printf("[%s] (NodeID=%d) Node unassigned from this server", serverConfig.ApiConfig.APIHost, nodeID)
+	}
+}
+
+// closeServerNodes stops the node discovery and hands the discovered nodes
+// over to m.Service, so that they are closed, drained and flushed like the
+// static nodes
+func (m *Manager) closeServerNodes() {
+	if m.serverTask != nil {
+		m.serverTask.Close()
+		m.serverTask = nil
+	}
+	
+	m.serverLock.Lock()
+	defer m.serverLock.Unlock()
+	
+	for _, controllerService := range m.serverNodes {
+		m.Service = append(m.Service, controllerService)
+	}
+	m.serverNodes = nil
+}
+
 func parseConnectionConfig(c *ConnectionConfig) (policy *conf.Policy) {
 	connectionConfig := getDefaultConnectionConfig()
 	if c != nil {
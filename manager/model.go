@@ -2,6 +2,7 @@ package manager
 
 import (
 	"github.com/xmplusdev/xmplus-server/api"
+	"github.com/xmplusdev/xmplus-server/helper/decoy"
 	"github.com/xmplusdev/xmplus-server/node"
 )
 
@@ -12,7 +13,10 @@ type Config struct {
 	OutboundConfigPath string            `mapstructure:"OutboundConfigPath"`
 	RouteConfigPath    string            `mapstructure:"RouteConfigPath"`
 	ConnectionConfig   *ConnectionConfig `mapstructure:"ConnectionConfig"`
+	DrainTimeout       int               `mapstructure:"DrainTimeout"`
+	Decoys             []*decoy.Config   `mapstructure:"Decoys"`
 	NodesConfig        []*NodesConfig    `mapstructure:"Nodes"`
+	ServerConfig       *ServerConfig     `mapstructure:"Server"`
 }
 
 type NodesConfig struct {
@@ -20,6 +24,14 @@ type NodesConfig struct {
 	ControllerConfig *node.Config   `mapstructure:"ControllerConfig"`
 }
 
+// ServerConfig enables server mode: the panel decides which nodes this
+// server runs, all of them use the server key and ControllerConfig
+type ServerConfig struct {
+	ApiConfig        *api.Config    `mapstructure:"ApiConfig"`
+	ControllerConfig *node.Config   `mapstructure:"ControllerConfig"`
+	UpdatePeriodic   int            `mapstructure:"UpdatePeriodic"`
+}
+
 type LogConfig struct {
 	Level      string    `mapstructure:"Level"`
 	AccessPath string    `mapstructure:"AccessPath"`
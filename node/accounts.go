@@ -0,0 +1,174 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/xtls/xray-core/app/proxyman"
+	proxyInbound "github.com/xtls/xray-core/app/proxyman/inbound"
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/inbound"
+	"github.com/xtls/xray-core/features/routing"
+	"github.com/xtls/xray-core/proxy"
+	"github.com/xtls/xray-core/proxy/http"
+	"github.com/xtls/xray-core/proxy/socks"
+	"github.com/xtls/xray-core/transport/internet/stat"
+	"google.golang.org/protobuf/proto"
+)
+
+// AccountInbound reports whether the accounts of a node type are swapped at
+// runtime by UpdateInboundUsers
+func AccountInbound(nodeType string) bool {
+	return nodeType == "socks" || nodeType == "http"
+}
+
+// accountHandlerConfig creates an inbound handler around an accountProxy
+type accountHandlerConfig struct {
+	config *core.InboundHandlerConfig
+}
+
+// accountProxyConfig is the socks or http server config of an accountProxy
+type accountProxyConfig struct {
+	config proto.Message
+}
+
+// accountProxy is the proxy of a socks or http inbound. xray reads the
+// accounts of these servers without a lock, so an update builds a new server
+// with the new accounts. Later connections use it, open ones keep theirs.
+type accountProxy struct {
+	ctx     context.Context
+	config  proto.Message
+	network []net.Network
+	server  atomic.Pointer[accountServer]
+}
+
+type accountServer struct {
+	proxy.Inbound
+	accounts int
+}
+
+func newAccountProxy(ctx context.Context, config proto.Message) (*accountProxy, error) {
+	p := &accountProxy{
+		ctx:    ctx,
+		config: config,
+	}
+	if err := p.setAccounts(nil); err != nil {
+		return nil, err
+	}
+	p.network = p.server.Load().Network()
+	return p, nil
+}
+
+// setAccounts replaces the accounts, Key: username, value: password
+func (p *accountProxy) setAccounts(accounts map[string]string) error {
+	config := proto.Clone(p.config)
+	switch config := config.(type) {
+		case *socks.ServerConfig:
+			config.AuthType = socks.AuthType_PASSWORD
+			config.Accounts = accounts
+		case *http.ServerConfig:
+			config.Accounts = accounts
+		default:
+			return fmt.Errorf("unsupported account proxy config: %T", config)
+	}
+
+	rawServer, err := common.CreateObject(p.ctx, config)
+	if err != nil {
+		return err
+	}
+	server, ok := rawServer.(proxy.Inbound)
+	if !ok {
+		return fmt.Errorf("not an inbound proxy: %T", rawServer)
+	}
+	p.server.Store(&accountServer{Inbound: server, accounts: len(accounts)})
+	return nil
+}
+
+// Network implements proxy.Inbound.
+func (p *accountProxy) Network() []net.Network {
+	return p.network
+}
+
+// Process implements proxy.Inbound.
+func (p *accountProxy) Process(ctx context.Context, network net.Network, conn stat.Connection, dispatcher routing.Dispatcher) error {
+	server := p.server.Load()
+	// An http server without accounts lets anyone in
+	if server.accounts == 0 {
+		return fmt.Errorf("no account on the inbound")
+	}
+	return server.Process(ctx, network, conn, dispatcher)
+}
+
+// newAccountHandler mirrors the inbound handler of xray, with the proxy
+// settings wrapped in an accountProxy
+func newAccountHandler(ctx context.Context, config *core.InboundHandlerConfig) (inbound.Handler, error) {
+	rawReceiverSettings, err := config.ReceiverSettings.GetInstance()
+	if err != nil {
+		return nil, err
+	}
+	receiverSettings, ok := rawReceiverSettings.(*proxyman.ReceiverConfig)
+	if !ok {
+		return nil, fmt.Errorf("not a ReceiverConfig: %s", config.Tag)
+	}
+	proxySettings, err := config.ProxySettings.GetInstance()
+	if err != nil {
+		return nil, err
+	}
+
+	streamSettings := receiverSettings.StreamSettings
+	if streamSettings != nil && streamSettings.SocketSettings != nil {
+		ctx = session.ContextWithSockopt(ctx, &session.Sockopt{
+			Mark: streamSettings.SocketSettings.Mark,
+		})
+	}
+	return proxyInbound.NewAlwaysOnInboundHandler(ctx, config.Tag, receiverSettings, &accountProxyConfig{config: proxySettings})
+}
+
+// addAccountInbound adds a socks or http inbound whose accounts are set with
+// setInboundAccounts
+func (m *Manager) addAccountInbound(config *core.InboundHandlerConfig) error {
+	rawHandler, err := core.CreateObject(m.server, &accountHandlerConfig{config: config})
+	if err != nil {
+		return err
+	}
+	handler, ok := rawHandler.(inbound.Handler)
+	if !ok {
+		return fmt.Errorf("not an InboundHandler: %s", config.Tag)
+	}
+	return m.ibm.AddHandler(context.Background(), handler)
+}
+
+// setInboundAccounts replaces the accounts of a socks or http inbound
+func (m *Manager) setInboundAccounts(tag string, users []*inboundUser) error {
+	handler, err := m.ibm.GetHandler(context.Background(), tag)
+	if err != nil {
+		return err
+	}
+	getInbound, ok := handler.(proxy.GetInbound)
+	if !ok {
+		return fmt.Errorf("inbound %s has no proxy", tag)
+	}
+	accountProxy, ok := getInbound.GetInbound().(*accountProxy)
+	if !ok {
+		return fmt.Errorf("inbound %s has no runtime accounts", tag)
+	}
+
+	accounts := make(map[string]string, len(users))
+	for _, user := range users {
+		accounts[user.Key] = user.Secret
+	}
+	return accountProxy.setAccounts(accounts)
+}
+
+func init() {
+	common.Must(common.RegisterConfig((*accountHandlerConfig)(nil), func(ctx context.Context, config interface{}) (interface{}, error) {
+		return newAccountHandler(ctx, config.(*accountHandlerConfig).config)
+	}))
+	common.Must(common.RegisterConfig((*accountProxyConfig)(nil), func(ctx context.Context, config interface{}) (interface{}, error) {
+		return newAccountProxy(ctx, config.(*accountProxyConfig).config)
+	}))
+}
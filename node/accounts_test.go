@@ -0,0 +1,66 @@
+package node
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xtls/xray-core/app/proxyman"
+	"github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/serial"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/inbound"
+	"github.com/xtls/xray-core/proxy"
+
+	"github.com/xmplusdev/xmplus-server/api"
+)
+
+func Test_accountProxy(t *testing.T) {
+	server, err := core.New(&core.Config{
+		App: []*serial.TypedMessage{serial.ToTypedMessage(&proxyman.InboundConfig{})},
+	})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		nodeType string
+		network  []net.Network
+	}{
+		{
+			nodeType: "socks",
+			network:  []net.Network{net.Network_TCP},
+		},
+		{
+			nodeType: "http",
+			network:  []net.Network{net.Network_TCP, net.Network_UNIX},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.nodeType, func(t *testing.T) {
+			nodeInfo := &api.NodeInfo{
+				NodeType:      test.nodeType,
+				NodeID:        1,
+				ListeningPort: "1080",
+				NetworkType:   "tcp",
+				RawSettings:   &api.RawSettings{},
+			}
+			config, err := InboundBuilder(&Config{}, nodeInfo, "node")
+			require.NoError(t, err)
+
+			rawHandler, err := core.CreateObject(server, &accountHandlerConfig{config: config})
+			require.NoError(t, err)
+			p, ok := rawHandler.(inbound.Handler).(proxy.GetInbound).GetInbound().(*accountProxy)
+			require.True(t, ok)
+			assert.Equal(t, test.network, p.Network())
+
+			// Without account every connection is refused
+			assert.Error(t, p.Process(context.Background(), net.Network_TCP, nil, nil))
+
+			first := p.server.Load()
+			require.NoError(t, p.setAccounts(map[string]string{"user": "passwd"}))
+			assert.NotSame(t, first, p.server.Load())
+			assert.Equal(t, 1, p.server.Load().accounts)
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package node
+
+import (
+	"fmt"
+
+	"github.com/xmplusdev/xmplus-server/api"
+)
+
+// ExtraInboundTag returns the tag of the i-th extra inbound of a node
+func ExtraInboundTag(tag string, i int) string {
+	return fmt.Sprintf("%s_in%d", tag, i+1)
+}
+
+// InboundTags returns the node tag followed by the tags of its extra inbounds
+func (m *Manager) InboundTags(tag string) []string {
+	m.access.Lock()
+	defer m.access.Unlock()
+	return append([]string{tag}, m.extraInbounds[tag]...)
+}
+
+// addExtraInbounds adds the extra listeners of a node. They share the outbound
+// and rules of the node, the dispatcher gives their connections the node tag.
+func (m *Manager) addExtraInbounds(nodeInfo *api.NodeInfo, tag string, config *Config) error {
+	if len(nodeInfo.Inbounds) == 0 {
+		return nil
+	}
+	if StaticInbound(nodeInfo.NodeType) || nodeInfo.NodeType == "Shadowsocks-Plugin" {
+		return fmt.Errorf("Inbound server with type %s has no extra inbounds", nodeInfo.NodeType)
+	}
+	
+	for i, inboundInfo := range nodeInfo.Inbounds {
+		extraTag := ExtraInboundTag(tag, i)
+		m.dispatcher.InboundAliases.Store(extraTag, tag)
+		m.access.Lock()
+		m.extraInbounds[tag] = append(m.extraInbounds[tag], extraTag)
+		m.access.Unlock()
+		
+		if err := m.addNodeInbound(inboundInfo, extraTag, config); err != nil {
+			return err
+		}
+	}
+	
+	return nil
+}
+
+// removeExtraInbounds removes the extra listeners of a node
+func (m *Manager) removeExtraInbounds(tag string) {
+	m.access.Lock()
+	extraTags := m.extraInbounds[tag]
+	delete(m.extraInbounds, tag)
+	m.access.Unlock()
+	
+	for _, extraTag := range extraTags {
+		m.removeInbound(extraTag)
+		m.removeFrontRoute(extraTag)
+		m.dispatcher.InboundAliases.Delete(extraTag)
+	}
+}
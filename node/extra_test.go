@@ -0,0 +1,90 @@
+package node
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xmplusdev/xmplus-server/api"
+)
+
+func testExtraNode(nodeType string, port string) *api.NodeInfo {
+	return &api.NodeInfo{
+		NodeType:      nodeType,
+		NodeID:        1,
+		ListeningPort: port,
+		SecurityType:  "none",
+		NetworkType:   "tcp",
+		Decryption:    "none",
+		RawSettings:   &api.RawSettings{},
+	}
+}
+
+func TestManager_extraInbounds(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		nodeInfo *api.NodeInfo
+		tags     []string
+		err      bool
+	}{
+		{
+			desc:     "no extra inbound",
+			nodeInfo: testExtraNode("vless", "21000"),
+			tags:     []string{"node"},
+		},
+		{
+			desc: "extra inbounds",
+			nodeInfo: func() *api.NodeInfo {
+				nodeInfo := testExtraNode("vless", "21010")
+				nodeInfo.Inbounds = []*api.NodeInfo{testExtraNode("vless", "21011"), testExtraNode("vless", "21012")}
+				return nodeInfo
+			}(),
+			tags: []string{"node", "node_in1", "node_in2"},
+		},
+		{
+			desc: "static inbound",
+			nodeInfo: func() *api.NodeInfo {
+				nodeInfo := testExtraNode("socks", "21020")
+				nodeInfo.Inbounds = []*api.NodeInfo{testExtraNode("socks", "21021")}
+				return nodeInfo
+			}(),
+			err: true,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			m := newTestManager(t)
+			err := m.AddTag(test.nodeInfo, "node", &Config{})
+			if test.err {
+				assert.ErrorContains(t, err, "has no extra inbounds")
+				m.PurgeTag("node")
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.tags, m.InboundTags("node"))
+
+			for _, tag := range test.tags {
+				_, err := m.ibm.GetHandler(context.Background(), tag)
+				assert.NoError(t, err, tag)
+			}
+			// The connections of an extra inbound are accounted to the node
+			for _, tag := range test.tags[1:] {
+				alias, ok := m.dispatcher.InboundAliases.Load(tag)
+				require.True(t, ok, tag)
+				assert.Equal(t, "node", alias)
+			}
+
+			require.NoError(t, m.RemoveTag("node"))
+			assert.Equal(t, []string{"node"}, m.InboundTags("node"))
+			for _, tag := range test.tags {
+				_, err := m.ibm.GetHandler(context.Background(), tag)
+				assert.Error(t, err, tag)
+				_, ok := m.dispatcher.InboundAliases.Load(tag)
+				assert.False(t, ok, tag)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package node
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xmplusdev/xmplus-server/api"
+	"github.com/xmplusdev/xmplus-server/helper/decoy"
+)
+
+const fallbackDialTimeout = 3 * time.Second
+
+// nodeFallbacks returns the fallbacks of a node inbound. The fallbacks of the
+// panel replace the FallBackConfigs of the local config, which are only the
+// default: they are skipped on a node they do not fit, while the panel ones
+// are an error there.
+func nodeFallbacks(config *Config, nodeInfo *api.NodeInfo) ([]*FallBackConfig, error) {
+	if len(nodeInfo.Fallbacks) == 0 {
+		if !config.EnableFallback || fallbackSupported(nodeInfo) != nil {
+			return nil, nil
+		}
+		if config.FallBackConfigs == nil {
+			return nil, fmt.Errorf("you must provide FallBackConfigs")
+		}
+		return resolveFallbacks(config.FallBackConfigs)
+	}
+	
+	if err := fallbackSupported(nodeInfo); err != nil {
+		return nil, fmt.Errorf("fallbacks of node %d: %w", nodeInfo.NodeID, err)
+	}
+	
+	fallbackConfigs := make([]*FallBackConfig, 0, len(nodeInfo.Fallbacks))
+	for _, fallback := range nodeInfo.Fallbacks {
+		fallbackConfigs = append(fallbackConfigs, &FallBackConfig{
+			SNI:              fallback.SNI,
+			Alpn:             fallback.Alpn,
+			Path:             fallback.Path,
+			Dest:             fallback.Dest,
+			ProxyProtocolVer: fallback.Xver,
+		})
+	}
+	fallbackConfigs, err := resolveFallbacks(fallbackConfigs)
+	if err != nil {
+		return nil, fmt.Errorf("fallbacks of node %d: %w", nodeInfo.NodeID, err)
+	}
+	return fallbackConfigs, nil
+}
+
+// resolveFallbacks points the fallbacks naming a decoy server to its address
+// and validates them
+func resolveFallbacks(fallbackConfigs []*FallBackConfig) ([]*FallBackConfig, error) {
+	resolved := make([]*FallBackConfig, 0, len(fallbackConfigs))
+	for i, c := range fallbackConfigs {
+		// A decoy would answer a proxy protocol header with the error page
+		// of a Go server
+		if strings.HasPrefix(c.Dest, decoy.DestPrefix) && c.ProxyProtocolVer > 0 {
+			return nil, fmt.Errorf("fallback %d: decoy server %s does not accept xver", i+1, strings.TrimPrefix(c.Dest, decoy.DestPrefix))
+		}
+		dest, err := decoy.Dest(c.Dest)
+		if err != nil {
+			return nil, fmt.Errorf("fallback %d: %w", i+1, err)
+		}
+		fallbackConfig := *c
+		fallbackConfig.Dest = dest
+		resolved = append(resolved, &fallbackConfig)
+	}
+	
+	if err := checkFallbacks(resolved); err != nil {
+		return nil, err
+	}
+	return resolved, nil
+}
+
+// fallbackSupported reports why a node cannot have fallbacks, xray only falls
+// back from a vless or trojan inbound on the raw transport
+func fallbackSupported(nodeInfo *api.NodeInfo) error {
+	switch nodeInfo.NodeType {
+		case "vless":
+			if nodeInfo.Decryption != "none" {
+				return fmt.Errorf("vless decryption %s does not support fallbacks", nodeInfo.Decryption)
+			}
+		case "trojan":
+		default:
+			return fmt.Errorf("node type %s does not support fallbacks", nodeInfo.NodeType)
+	}
+	
+	if nodeInfo.NetworkType != "raw" && nodeInfo.NetworkType != "tcp" {
+		return fmt.Errorf("transport %s does not support fallbacks, use raw", nodeInfo.NetworkType)
+	}
+	return nil
+}
+
+// checkFallbacks validates the fallbacks. A destination that does not answer
+// is only logged, the web server behind it may start after the node.
+func checkFallbacks(fallbackConfigs []*FallBackConfig) error {
+	matches := make(map[string]int)
+	for i, c := range fallbackConfigs {
+		if c.Path != "" && !strings.HasPrefix(c.Path, "/") {
+			return fmt.Errorf("fallback %d: path %s must start with /", i+1, c.Path)
+		}
+		if c.ProxyProtocolVer > 2 {
+			return fmt.Errorf("fallback %d: xver %d must be 0, 1 or 2", i+1, c.ProxyProtocolVer)
+		}
+		
+		match := fmt.Sprintf("%s|%s|%s", c.SNI, c.Alpn, c.Path)
+		if other, ok := matches[match]; ok {
+			return fmt.Errorf("fallback %d matches the same connections as fallback %d", i+1, other)
+		}
+		matches[match] = i + 1
+		
+		address, err := fallbackAddress(c.Dest)
+		if err != nil {
+			return fmt.Errorf("fallback %d: %w", i+1, err)
+		}
+		if err := fallbackReachable(address); err != nil {
+			log.Printf("Warning: fallback %d: %s", i+1, err)
+		}
+	}
+	return nil
+}
+
+// fallbackAddress returns the address to dial for a fallback dest, empty for
+// a dest that cannot be checked
+func fallbackAddress(dest string) (string, error) {
+	switch {
+		case dest == "":
+			return "", fmt.Errorf("dest is required")
+		case dest == "serve-ws-none", strings.HasPrefix(dest, "@"):
+			// An abstract unix socket has no file to look for
+			return "", nil
+		case filepath.IsAbs(dest):
+			return dest, nil
+	}
+	
+	address := dest
+	if _, err := strconv.Atoi(dest); err == nil {
+		address = net.JoinHostPort("localhost", dest)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return "", fmt.Errorf("dest %s is not a port, an address or a unix socket", dest)
+	}
+	return address, nil
+}
+
+func fallbackReachable(address string) error {
+	switch {
+		case address == "":
+			return nil
+		case filepath.IsAbs(address):
+			if _, err := os.Stat(address); err != nil {
+				return fmt.Errorf("dest unix socket %s does not exist", address)
+			}
+			return nil
+	}
+	
+	conn, err := net.DialTimeout("tcp", address, fallbackDialTimeout)
+	if err != nil {
+		return fmt.Errorf("dest %s is not reachable: %w", address, err)
+	}
+	conn.Close()
+	return nil
+}
@@ -0,0 +1,127 @@
+package node
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_checkFallbacks(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		fallbacks   []*FallBackConfig
+		expectError bool
+	}{
+		{
+			desc: "valid",
+			fallbacks: []*FallBackConfig{
+				{Dest: "serve-ws-none"},
+				{Path: "/ws", Dest: "@xray.sock"},
+				{Alpn: "h2", Dest: "/run/nginx.sock", ProxyProtocolVer: 2},
+			},
+		},
+		{
+			desc:      "unreachable dest",
+			fallbacks: []*FallBackConfig{{Dest: "127.0.0.1:1"}},
+		},
+		{
+			desc:        "path without slash",
+			fallbacks:   []*FallBackConfig{{Path: "ws", Dest: "80"}},
+			expectError: true,
+		},
+		{
+			desc:        "xver",
+			fallbacks:   []*FallBackConfig{{Dest: "80", ProxyProtocolVer: 3}},
+			expectError: true,
+		},
+		{
+			desc: "same match",
+			fallbacks: []*FallBackConfig{
+				{SNI: "example.com", Dest: "80"},
+				{SNI: "example.com", Dest: "8080"},
+			},
+			expectError: true,
+		},
+		{
+			desc:        "no dest",
+			fallbacks:   []*FallBackConfig{{}},
+			expectError: true,
+		},
+		{
+			desc:        "invalid dest",
+			fallbacks:   []*FallBackConfig{{Dest: "example.com"}},
+			expectError: true,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			err := checkFallbacks(test.fallbacks)
+			if test.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func Test_fallbackAddress(t *testing.T) {
+	testCases := []struct {
+		dest     string
+		expected string
+	}{
+		{dest: "80", expected: "localhost:80"},
+		{dest: "127.0.0.1:8080", expected: "127.0.0.1:8080"},
+		{dest: "/run/nginx.sock", expected: "/run/nginx.sock"},
+		{dest: "@xray.sock"},
+		{dest: "serve-ws-none"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.dest, func(t *testing.T) {
+			address, err := fallbackAddress(test.dest)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, address)
+		})
+	}
+}
+
+func Test_resolveFallbacks(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		fallbacks   []*FallBackConfig
+		expected    string
+		expectError bool
+	}{
+		{
+			desc:      "plain dest",
+			fallbacks: []*FallBackConfig{{Dest: "serve-ws-none"}},
+			expected:  "serve-ws-none",
+		},
+		{
+			desc:        "decoy not running",
+			fallbacks:   []*FallBackConfig{{Dest: "decoy:site"}},
+			expectError: true,
+		},
+		{
+			desc:        "decoy with xver",
+			fallbacks:   []*FallBackConfig{{Dest: "decoy:site", ProxyProtocolVer: 1}},
+			expectError: true,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			resolved, err := resolveFallbacks(test.fallbacks)
+			if test.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, resolved, 1)
+			assert.Equal(t, test.expected, resolved[0].Dest)
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/infra/conf"
+
+	"github.com/xmplusdev/xmplus-server/api"
+)
+
+type frontRoute struct {
+	nodeInfo *api.NodeInfo
+	config   *Config
+}
+
+// FrontTag returns the inbound tag of the listener shared on a port
+func FrontTag(port uint32) string {
+	return fmt.Sprintf("front_%d", port)
+}
+
+// addNodeInbound adds the inbound of a node, a node with front settings
+// listens on the loopback address behind the shared listener
+func (m *Manager) addNodeInbound(nodeInfo *api.NodeInfo, tag string, config *Config) error {
+	inboundInfo := nodeInfo
+	if nodeInfo.FrontSettings != nil {
+		backendInfo, err := frontBackend(nodeInfo)
+		if err != nil {
+			return err
+		}
+		inboundInfo = backendInfo
+	}
+	
+	inboundConfig, err := InboundBuilder(config, inboundInfo, tag)
+	if err != nil {
+		return fmt.Errorf("failed to build inbound %s config: %w", tag, err)
+	}
+
+	addInbound := m.addInbound
+	if AccountInbound(nodeInfo.NodeType) {
+		addInbound = m.addAccountInbound
+	}
+	if err := addInbound(inboundConfig); err != nil {
+		return fmt.Errorf("failed to add inbound %s: %w", tag, err)
+	}
+	
+	if nodeInfo.FrontSettings != nil {
+		return m.addFrontRoute(nodeInfo, tag, config)
+	}
+	return nil
+}
+
+// frontBackend returns the node info of a node inbound behind the shared
+// listener. The listener terminates TLS and passes the client address on
+// with a proxy protocol header.
+func frontBackend(nodeInfo *api.NodeInfo) (*api.NodeInfo, error) {
+	switch {
+		case nodeInfo.NodeType == "wireguard" || nodeInfo.NodeType == "Shadowsocks-Plugin":
+			return nil, fmt.Errorf("Inbound server with type %s cannot share a port", nodeInfo.NodeType)
+		case nodeInfo.SecurityType == "reality":
+			return nil, fmt.Errorf("Inbound server with reality cannot share a port")
+	}
+	
+	// The shared listener is TCP, a kcp node would be unreachable
+	networkType, err := conf.TransportProtocol(nodeInfo.NetworkType).Build()
+	if err != nil {
+		return nil, fmt.Errorf("convert TransportProtocol failed: %s", err)
+	}
+	if networkType == "mkcp" {
+		return nil, fmt.Errorf("Inbound server with network %s cannot share a port", nodeInfo.NetworkType)
+	}
+	
+	if nodeInfo.FrontSettings.Port == 0 {
+		return nil, fmt.Errorf("node %d has no shared port", nodeInfo.NodeID)
+	}
+	
+	port, err := strconv.ParseUint(nodeInfo.ListeningPort, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("node %d behind a shared port needs a single listening port: %w", nodeInfo.NodeID, err)
+	}
+	if uint32(port) == nodeInfo.FrontSettings.Port {
+		return nil, fmt.Errorf("node %d listens on its shared port %d", nodeInfo.NodeID, port)
+	}
+	
+	backendInfo := *nodeInfo
+	backendInfo.ListeningIP = "127.0.0.1"
+	backendInfo.SecurityType = "none"
+	backendInfo.AcceptProxyProtocol = true
+	withoutXrayStream(&backendInfo)
+	if !backendInfo.UseSocket {
+		backendInfo.UseSocket = true
+		backendInfo.SocketSettings = &api.SocketSettings{}
+	}
+	return &backendInfo, nil
+}
+
+// addFrontRoute adds a node to the listener shared on its front port, the
+// listener is created with the first node
+func (m *Manager) addFrontRoute(nodeInfo *api.NodeInfo, tag string, config *Config) error {
+	m.frontAccess.Lock()
+	defer m.frontAccess.Unlock()
+	
+	port := nodeInfo.FrontSettings.Port
+	routes := make(map[string]*frontRoute)
+	for routeTag, route := range m.fronts[port] {
+		routes[routeTag] = route
+	}
+	routes[tag] = &frontRoute{nodeInfo: nodeInfo, config: config}
+	
+	if err := m.updateFront(port, routes); err != nil {
+		return err
+	}
+	m.fronts[port] = routes
+	return nil
+}
+
+// removeFrontRoute removes a node from the listener it shares, the listener
+// is removed with the last node
+func (m *Manager) removeFrontRoute(tag string) {
+	m.frontAccess.Lock()
+	defer m.frontAccess.Unlock()
+	
+	for port, routes := range m.fronts {
+		if routes[tag] == nil {
+			continue
+		}
+		
+		remaining := make(map[string]*frontRoute)
+		for routeTag, route := range routes {
+			if routeTag != tag {
+				remaining[routeTag] = route
+			}
+		}
+		
+		if err := m.updateFront(port, remaining); err != nil {
+			log.Printf("Failed to update shared port %d: %s", port, err)
+		}
+		if len(remaining) == 0 {
+			delete(m.fronts, port)
+		} else {
+			m.fronts[port] = remaining
+		}
+	}
+}
+
+// updateFront rebuilds the shared listener with its routes
+func (m *Manager) updateFront(port uint32, routes map[string]*frontRoute) error {
+	if len(routes) == 0 {
+		m.removeInbound(FrontTag(port))
+		return nil
+	}
+	
+	inboundConfig, err := FrontInboundBuilder(port, routes)
+	if err != nil {
+		return fmt.Errorf("failed to build shared port %d: %w", port, err)
+	}
+	
+	if err := m.replaceInbound(inboundConfig); err != nil {
+		return fmt.Errorf("failed to add shared port %d: %w", port, err)
+	}
+	
+	log.Printf("Shared port %d routes %d inbounds", port, len(routes))
+	return nil
+}
+
+// FrontInboundBuilder builds the listener shared on a port. It is a VLESS
+// inbound without clients, every connection goes to the fallback of its
+// node, matched by TLS server name, ALPN and HTTP path.
+func FrontInboundBuilder(port uint32, routes map[string]*frontRoute) (*core.InboundHandlerConfig, error) {
+	tags := make([]string, 0, len(routes))
+	for tag := range routes {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	
+	var (
+		fallbackConfigs []*FallBackConfig
+		useTLS          bool
+		alpn            conf.StringList
+	)
+	tlsSettings := &conf.TLSConfig{}
+	matches := make(map[string]string)
+	seenAlpn := make(map[string]bool)
+	
+	for i, tag := range tags {
+		nodeInfo := routes[tag].nodeInfo
+		front := nodeInfo.FrontSettings
+		
+		routeTLS := nodeInfo.SecurityType == "tls" && nodeInfo.TlsSettings.CertMode != "none"
+		if i > 0 && routeTLS != useTLS {
+			return nil, fmt.Errorf("inbound %s and %s disagree on tls", tags[0], tag)
+		}
+		useTLS = routeTLS
+		
+		if routeTLS {
+			certFile, keyFile, err := getCertFile(routes[tag].config.CertConfig, nodeInfo.TlsSettings.CertMode, nodeInfo.TlsSettings.CertDomainName)
+			if err != nil {
+				return nil, err
+			}
+			tlsSettings.Certs = append(tlsSettings.Certs, &conf.TLSCertConfig{CertFile: certFile, KeyFile: keyFile, OcspStapling: 3600})
+			
+			for _, protocol := range append([]string{front.Alpn}, nodeInfo.TlsSettings.Alpn...) {
+				if protocol != "" && !seenAlpn[protocol] {
+					seenAlpn[protocol] = true
+					alpn = append(alpn, protocol)
+				}
+			}
+		} else if front.SNI != "" || front.Alpn != "" {
+			return nil, fmt.Errorf("inbound %s matches sni or alpn without tls", tag)
+		}
+		
+		match := fmt.Sprintf("%s|%s|%s", front.SNI, front.Alpn, front.Path)
+		if other, ok := matches[match]; ok {
+			return nil, fmt.Errorf("inbound %s and %s match the same connections", other, tag)
+		}
+		matches[match] = tag
+		
+		fallbackConfigs = append(fallbackConfigs, &FallBackConfig{
+			SNI:              front.SNI,
+			Alpn:             front.Alpn,
+			Path:             front.Path,
+			Dest:             fmt.Sprintf("127.0.0.1:%s", nodeInfo.ListeningPort),
+			ProxyProtocolVer: 2,
+		})
+	}
+	
+	fallbacks, err := buildVlessFallbacks(fallbackConfigs)
+	if err != nil {
+		return nil, err
+	}
+	
+	setting, err := json.Marshal(&conf.VLessInboundConfig{
+		Decryption: "none",
+		Fallbacks:  fallbacks,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshal shared port %d config fialed: %s", port, err)
+	}
+	rawSetting := json.RawMessage(setting)
+	
+	transportProtocol := conf.TransportProtocol("raw")
+	streamSetting := &conf.StreamConfig{Network: &transportProtocol}
+	if useTLS {
+		if len(alpn) == 0 {
+			alpn = conf.StringList{"h2", "http/1.1"}
+		}
+		tlsSettings.ALPN = &alpn
+		streamSetting.Security = "tls"
+		streamSetting.TLSSettings = tlsSettings
+	}
+	
+	inboundDetourConfig := &conf.InboundDetourConfig{
+		Protocol:      "vless",
+		Tag:           FrontTag(port),
+		PortList:      &conf.PortList{Range: []conf.PortRange{{From: port, To: port}}},
+		Settings:      &rawSetting,
+		StreamSetting: streamSetting,
+	}
+	return inboundDetourConfig.Build()
+}
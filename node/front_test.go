@@ -0,0 +1,129 @@
+package node
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xmplusdev/xmplus-server/api"
+)
+
+func frontNode(port string, securityType string, front *api.FrontSettings) *frontRoute {
+	return &frontRoute{
+		nodeInfo: &api.NodeInfo{
+			NodeType:      "vless",
+			ListeningPort: port,
+			SecurityType:  securityType,
+			NetworkType:   "tcp",
+			TlsSettings:   &api.TlsSettings{CertMode: "file"},
+			FrontSettings: front,
+		},
+		config: &Config{},
+	}
+}
+
+func TestFrontInboundBuilder(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		routes      map[string]*frontRoute
+		expectError bool
+	}{
+		{
+			desc: "paths",
+			routes: map[string]*frontRoute{
+				"a": frontNode("10001", "none", &api.FrontSettings{Port: 443, Path: "/a"}),
+				"b": frontNode("10002", "none", &api.FrontSettings{Port: 443, Path: "/b"}),
+			},
+		},
+		{
+			desc: "same match",
+			routes: map[string]*frontRoute{
+				"a": frontNode("10001", "none", &api.FrontSettings{Port: 443, Path: "/a"}),
+				"b": frontNode("10002", "none", &api.FrontSettings{Port: 443, Path: "/a"}),
+			},
+			expectError: true,
+		},
+		{
+			desc: "disagree on tls",
+			routes: map[string]*frontRoute{
+				"a": frontNode("10001", "none", &api.FrontSettings{Port: 443, Path: "/a"}),
+				"b": frontNode("10002", "tls", &api.FrontSettings{Port: 443, Path: "/b"}),
+			},
+			expectError: true,
+		},
+		{
+			desc: "sni without tls",
+			routes: map[string]*frontRoute{
+				"a": frontNode("10001", "none", &api.FrontSettings{Port: 443, SNI: "a.example.com"}),
+			},
+			expectError: true,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			config, err := FrontInboundBuilder(443, test.routes)
+			if test.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, FrontTag(443), config.Tag)
+		})
+	}
+}
+
+func Test_frontBackend(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		networkType string
+		port        string
+		expectError bool
+	}{
+		{
+			desc:        "tcp",
+			networkType: "tcp",
+			port:        "10001",
+		},
+		{
+			desc:        "kcp",
+			networkType: "kcp",
+			port:        "10001",
+			expectError: true,
+		},
+		{
+			desc:        "mkcp",
+			networkType: "mkcp",
+			port:        "10001",
+			expectError: true,
+		},
+		{
+			desc:        "port range",
+			networkType: "tcp",
+			port:        "10001-10002",
+			expectError: true,
+		},
+		{
+			desc:        "listens on the shared port",
+			networkType: "tcp",
+			port:        "443",
+			expectError: true,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			nodeInfo := frontNode(test.port, "none", &api.FrontSettings{Port: 443}).nodeInfo
+			nodeInfo.NetworkType = test.networkType
+			backendInfo, err := frontBackend(nodeInfo)
+			if test.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "127.0.0.1", backendInfo.ListeningIP)
+			assert.True(t, backendInfo.AcceptProxyProtocol)
+		})
+	}
+}
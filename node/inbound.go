@@ -20,6 +20,12 @@ import (
 )
 
 func InboundBuilder(config *Config, nodeInfo *api.NodeInfo, tag string) (*core.InboundHandlerConfig, error) {
+	return inboundBuilder(config, nodeInfo, tag, nil)
+}
+
+// inboundBuilder builds the node inbound, users are only set as the peers of a
+// wireguard inbound
+func inboundBuilder(config *Config, nodeInfo *api.NodeInfo, tag string, users []*inboundUser) (*core.InboundHandlerConfig, error) {
 	inboundDetourConfig := &conf.InboundDetourConfig{}
 	
 	if nodeInfo.NodeType == "Shadowsocks-Plugin" {
@@ -59,9 +65,9 @@ func InboundBuilder(config *Config, nodeInfo *api.NodeInfo, tag string) (*core.I
 	inboundDetourConfig.PortList = portList
 	inboundDetourConfig.Tag = tag
 
-	sniffingConfig := &conf.SniffingConfig{
-		Enabled:      nodeInfo.Sniffing,
-		DestOverride: &conf.StringList{"http", "tls", "quic", "fakedns"},
+	sniffingConfig, err := sniffingBuilder(nodeInfo)
+	if err != nil {
+		return nil, fmt.Errorf("node %d: %w", nodeInfo.NodeID, err)
 	}
 	
 	inboundDetourConfig.SniffingConfig = sniffingConfig
@@ -74,11 +80,16 @@ func InboundBuilder(config *Config, nodeInfo *api.NodeInfo, tag string) (*core.I
 
 	var proxySetting any
 	
+	fallbackConfigs, err := nodeFallbacks(config, nodeInfo)
+	if err != nil {
+		return nil, err
+	}
+	
 	switch nodeInfo.NodeType {
 		case "vless":
 			protocol = "vless"
-			if nodeInfo.Decryption == "none" && config.EnableFallback {
-				fallbackConfigs, err := buildVlessFallbacks(config.FallBackConfigs)
+			if fallbackConfigs != nil {
+				fallbackConfigs, err := buildVlessFallbacks(fallbackConfigs)
 				if err == nil {
 					proxySetting = &conf.VLessInboundConfig{
 						Decryption: nodeInfo.Decryption,
@@ -98,8 +109,8 @@ func InboundBuilder(config *Config, nodeInfo *api.NodeInfo, tag string) (*core.I
 
 		case "trojan":
 			protocol = "trojan"
-			if config.EnableFallback {
-				fallbackConfigs, err := buildTrojanFallbacks(config.FallBackConfigs)
+			if fallbackConfigs != nil {
+				fallbackConfigs, err := buildTrojanFallbacks(fallbackConfigs)
 				if err == nil {
 					proxySetting = &conf.TrojanServerConfig{
 						Fallbacks: fallbackConfigs,
@@ -143,17 +154,58 @@ func InboundBuilder(config *Config, nodeInfo *api.NodeInfo, tag string) (*core.I
 				Host:        "v1.mux.cool",
 				NetworkList: []string{"tcp", "udp"},
 			}
+		case "wireguard":
+			protocol = "wireguard"
+			if nodeInfo.WireguardSettings == nil {
+				return nil, fmt.Errorf("wireguardSettings missing for node %d", nodeInfo.NodeID)
+			}
+			peers := make([]*conf.WireGuardPeerConfig, 0, len(users))
+			for _, user := range users {
+				allowedIPs := make([]string, 0, len(user.Addresses))
+				for _, ip := range user.Addresses {
+					if ip.To4() != nil {
+						allowedIPs = append(allowedIPs, ip.String()+"/32")
+					} else {
+						allowedIPs = append(allowedIPs, ip.String()+"/128")
+					}
+				}
+				peers = append(peers, &conf.WireGuardPeerConfig{
+					PublicKey:  user.Secret,
+					AllowedIPs: allowedIPs,
+				})
+			}
+			proxySetting = &conf.WireGuardConfig{
+				SecretKey: nodeInfo.WireguardSettings.SecretKey,
+				Address:   nodeInfo.WireguardSettings.Address,
+				Peers:     peers,
+				MTU:       nodeInfo.WireguardSettings.Mtu,
+			}
+		case "socks":
+			// The accounts are set at runtime by setInboundAccounts. UDP is
+			// off as xray does not tell which account associated a datagram.
+			protocol = "socks"
+			proxySetting = &conf.SocksServerConfig{
+				AuthMethod: "password",
+			}
+		case "http":
+			protocol = "http"
+			proxySetting = &conf.HTTPServerConfig{}
 		default:
 			return nil, fmt.Errorf("Unsupported Node Type: %v", nodeInfo.NodeType)	
 	}
 	
-	setting, err := json.Marshal(proxySetting)
+	setting, err = json.Marshal(proxySetting)
 	if err != nil {
 		return nil, fmt.Errorf("marshal proxy %s config fialed: %s", nodeInfo.NodeType, err)
 	}
 	inboundDetourConfig.Protocol = protocol
 	inboundDetourConfig.Settings = &setting
 	
+	// Wireguard runs over plain UDP
+	if nodeInfo.NodeType == "wireguard" {
+		return buildInbound(nodeInfo, inboundDetourConfig)
+	}
+	
 	streamSetting = new(conf.StreamConfig)
 	transportProtocol := conf.TransportProtocol(nodeInfo.NetworkType)
 	networkType, err := transportProtocol.Build()
@@ -174,6 +226,7 @@ func InboundBuilder(config *Config, nodeInfo *api.NodeInfo, tag string) (*core.I
 				Path: nodeInfo.WsSettings.Path,
 				Host: nodeInfo.WsSettings.Host,
 				HeartbeatPeriod: nodeInfo.WsSettings.HeartbeatPeriod,
+				Headers: nodeInfo.WsSettings.Headers,
 			}
 			streamSetting.WSSettings = wsSettings	
 		case "httpupgrade":
@@ -181,31 +234,21 @@ func InboundBuilder(config *Config, nodeInfo *api.NodeInfo, tag string) (*core.I
 				AcceptProxyProtocol: nodeInfo.AcceptProxyProtocol,
 				Host: nodeInfo.HttpSettings.Host,
 				Path: nodeInfo.HttpSettings.Path,
+				Headers: nodeInfo.HttpSettings.Headers,
 			}
 			streamSetting.HTTPUPGRADESettings = httpupgradeSettings	
 		case "xhttp":
-			xhttpSettings := &conf.SplitHTTPConfig{
-				Host: nodeInfo.XhttpSettings.Host,
-				Path: nodeInfo.XhttpSettings.Path,
-				Mode: nodeInfo.XhttpSettings.Mode,
-				NoSSEHeader: nodeInfo.XhttpSettings.NoSSEHeader,
-				NoGRPCHeader: nodeInfo.XhttpSettings.NoGRPCHeader,
+			xhttpSettings, err := xhttpConfig(nodeInfo.XhttpSettings)
+			if err != nil {
+				return nil, err
 			}
+			// The download connection is chosen by the client
+			xhttpSettings.DownloadSettings = nil
 			streamSetting.XHTTPSettings = xhttpSettings		
 		case "grpc":
-			grpcSettings := &conf.GRPCConfig{
-				ServiceName: nodeInfo.GrpcSettings.ServiceName,
-				Authority: nodeInfo.GrpcSettings.Authority,
-				UserAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 17_4_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/123.0.6312.52 Mobile/15E148 Safari/604.1",
-			}
-			streamSetting.GRPCSettings = grpcSettings
+			streamSetting.GRPCSettings = grpcConfig(nodeInfo.GrpcSettings)
 		case "mkcp":
-			kcpSettings := &conf.KCPConfig{
-				HeaderConfig: nodeInfo.KcpSettings.Header,
-				Congestion: &nodeInfo.KcpSettings.Congestion,
-				Seed: &nodeInfo.KcpSettings.Seed,
-			}
-			streamSetting.KCPSettings = kcpSettings	
+			streamSetting.KCPSettings = kcpConfig(nodeInfo.KcpSettings)
 	}
 	
 	streamSetting.Network = &transportProtocol	
@@ -290,7 +333,7 @@ func InboundBuilder(config *Config, nodeInfo *api.NodeInfo, tag string) (*core.I
 	
 	inboundDetourConfig.StreamSetting = streamSetting
 
-	return inboundDetourConfig.Build()
+	return buildInbound(nodeInfo, inboundDetourConfig)
 }
 
 
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"sync"
 
 	"github.com/xmplusdev/xmplus-server/api"
 	"github.com/xmplusdev/xmplus-server/helper/limiter"
@@ -16,19 +17,31 @@ import (
 	"github.com/xtls/xray-core/features/outbound"
 	"github.com/xtls/xray-core/features/routing"
 	"github.com/xtls/xray-core/app/router"
+	"github.com/xtls/xray-core/app/reverse"
 	"github.com/xtls/xray-core/common/serial"
 	
 	C "github.com/sagernet/sing/common"
 	"github.com/sagernet/sing-shadowsocks/shadowaead_2022"
 )
 
-// Manager handles node-related operations (inbound/outbound management)
+// Manager handles node-related operations (inbound/outbound management), the
+// controllers on the same core share it
 type Manager struct {
 	server 		*core.Instance
 	ibm    		inbound.Manager
 	obm    		outbound.Manager
 	router  	*router.Router
 	dispatcher  *dispatcher.DefaultDispatcher
+	access      sync.Mutex
+	ruleTags    map[string][]string // Key: Tag, value: rule tags of the rule actions and rule sets
+	portals     map[string]*reverse.Portal // Key: Tag
+	bridges     map[string]*reverse.Bridge // Key: Tag
+	inboundUsers map[string][]string // Key: Tag, value: keys of the dispatcher inbound users
+	ruleSetUsers map[string][]string // Key: Tag, value: emails of the dispatcher rule set users
+	wireguardPools map[string]*wireguardPool // Key: Tag
+	extraInbounds map[string][]string // Key: Tag, value: tags of the extra inbounds
+	frontAccess sync.Mutex
+	fronts      map[uint32]map[string]*frontRoute // Key: shared port, value Key: Tag of the node inbound
 }
 
 // NewManager creates a new node manager
@@ -39,23 +52,34 @@ func NewManager(server *core.Instance) *Manager {
 		obm:    	server.GetFeature(outbound.ManagerType()).(outbound.Manager),
 		router: 	server.GetFeature(routing.RouterType()).(*router.Router),
 		dispatcher: server.GetFeature(routing.DispatcherType()).(*dispatcher.DefaultDispatcher),
+		ruleTags:   make(map[string][]string),
+		portals:    make(map[string]*reverse.Portal),
+		bridges:    make(map[string]*reverse.Bridge),
+		inboundUsers: make(map[string][]string),
+		ruleSetUsers: make(map[string][]string),
+		wireguardPools: make(map[string]*wireguardPool),
+		extraInbounds: make(map[string][]string),
+		fronts:     make(map[uint32]map[string]*frontRoute),
 	}
 }
 
 // AddTag adds both inbound and outbound for a node
 func (m *Manager) AddTag(nodeInfo *api.NodeInfo, tag string, config *Config) error {
+	// The shadowsocks inbound of a plugin node sits behind its transport inbound
 	if nodeInfo.NodeType == "Shadowsocks-Plugin" {
-		return fmt.Errorf("Inbound server with type %s is not supportted", nodeInfo.NodeType)
+		if err := m.addPlugin(nodeInfo, tag, config); err != nil {
+			return err
+		}
+		shadowsocksInfo, err := pluginShadowsocks(nodeInfo)
+		if err != nil {
+			return err
+		}
+		nodeInfo = shadowsocksInfo
 	}
 
 	// Add inbound
-	inboundConfig, err := InboundBuilder(config, nodeInfo, tag)
-	if err != nil {
-		return fmt.Errorf("failed to build inbound config: %w", err)
-	}
-
-	if err := m.addInbound(inboundConfig); err != nil {
-		return fmt.Errorf("failed to add inbound: %w", err)
+	if err := m.addNodeInbound(nodeInfo, tag, config); err != nil {
+		return err
 	}
 
 	// Add outbound
@@ -68,17 +92,18 @@ func (m *Manager) AddTag(nodeInfo *api.NodeInfo, tag string, config *Config) err
 		return fmt.Errorf("failed to add outbound: %w", err)
 	}
 	
-	if nodeInfo.RelayType == 0 || nodeInfo.RelayNodeID == 0 {
-		// Build and add router rule
-		routerConfig, err := DefaultRouterBuilder(tag)
+	// Relayed subscriptions are routed by the dispatcher, the other relay
+	// types only change where the default route goes
+	if nodeInfo.RelayType != api.RelayTypeTransit || nodeInfo.RelayNodeID == 0 {
+		outboundTag, err := m.defaultOutbound(nodeInfo, tag)
 		if err != nil {
 			return err
 		}
-		
-		// Add rule
-		if err := m.addRouterRule(routerConfig, true); err != nil {
-			return err
-		}
+		m.dispatcher.DefaultOutbounds.Store(tag, outboundTag)
+	}
+	
+	if err := m.addExtraInbounds(nodeInfo, tag, config); err != nil {
+		return err
 	}
 
 	//log.Printf("Added inbound tag %s for node type %s", tag, nodeInfo.NodeType)
@@ -90,6 +115,8 @@ func (m *Manager) RemoveTag(tag string) error {
 	if err := m.removeInbound(tag); err != nil {
 		return fmt.Errorf("failed to remove inbound: %w", err)
 	}
+	m.removeFrontRoute(tag)
+	m.removeExtraInbounds(tag)
 
 	if err := m.removeOutbound(tag); err != nil {
 		return fmt.Errorf("failed to remove outbound: %w", err)
@@ -97,61 +124,131 @@ func (m *Manager) RemoveTag(tag string) error {
 
 	log.Printf("Removed tag %s", tag)
 	
-	defaultRuleTag := fmt.Sprintf("%s_default", tag)
-	if errr := m.removeRouterRule(defaultRuleTag); errr != nil {
-		return errr
+	m.removePortal(tag)
+	m.removeInboundUsers(tag)
+	m.dispatcher.DefaultOutbounds.Delete(tag)
+	
+	return nil
+}
+
+// PurgeTag removes every inbound, outbound and router rule a node may have
+// created, ignoring the ones that were never added. It is used to clean up
+// after a partially started node.
+func (m *Manager) PurgeTag(tag string) {
+	m.removeInbound(tag)
+	m.removeFrontRoute(tag)
+	m.removeExtraInbounds(tag)
+	m.removeOutbound(tag)
+	m.dispatcher.DefaultOutbounds.Delete(tag)
+	m.removePortal(tag)
+	m.RemoveReverseBridge(tag)
+	m.removeInboundUsers(tag)
+	m.removeRules(tag)
+	m.removeRuleSetUsers(tag)
+	m.removeOutbound(fmt.Sprintf("%s_blackhole", tag))
+	m.DeleteInboundLimiter(tag)
+}
+
+// RemoveInbound removes only the inbound of a node so that it stops accepting
+// new connections, while established ones keep using the outbound
+func (m *Manager) RemoveInbound(tag string) error {
+	if err := m.removeInbound(tag); err != nil {
+		return fmt.Errorf("failed to remove inbound: %w", err)
 	}
 	
+	// The aliases stay for the connections still running
+	for _, extraTag := range m.InboundTags(tag)[1:] {
+		if err := m.removeInbound(extraTag); err != nil {
+			return fmt.Errorf("failed to remove inbound: %w", err)
+		}
+	}
+	for _, inboundTag := range m.InboundTags(tag) {
+		m.removeFrontRoute(inboundTag)
+	}
+
+	log.Printf("Removed inbound %s", tag)
 	return nil
 }
 
-// AddRelayTag adds relay outbounds and routing for all subscriptions
+// AddRelayTag adds the relay outbounds of a transit server for the given
+// subscriptions, it can be called again with added subscriptions only. The
+// outbound tagged relayTag is the last hop of the chain, every hop dials
+// through the previous one.
 func (m *Manager) AddRelayTag(
 	relayNodeInfo *api.RelayNodeInfo,
 	relayTag string,
-	mainTag string,
 	subscriptionInfo *[]api.SubscriptionInfo,
 ) error {
-	if relayNodeInfo.NodeType == "Shadowsocks-Plugin" {
-		return fmt.Errorf("Rely outbound server with type %s is not supportted", relayNodeInfo.NodeType)
+	hops := relayHops(relayNodeInfo)
+	for _, hop := range hops {
+		if hop.NodeType == "Shadowsocks-Plugin" {
+			return fmt.Errorf("Rely outbound server with type %s is not supportted", hop.NodeType)
+		}
 	}
 
 	for _, subscription := range *subscriptionInfo {
-		var key string
-
-		// Handle Shadowsocks 2022 key generation
-		if C.Contains(shadowaead_2022.List, strings.ToLower(relayNodeInfo.Cipher)) {
-			userKey, err := checkShadowsocksPassword(subscription.Passwd, relayNodeInfo.Cipher)
-			if err != nil {
-				continue
+		relayTagConfigs, err := relayChain(hops, relayTag, &subscription)
+		if err != nil {
+			return err
+		}
+		for _, relayTagConfig := range relayTagConfigs {
+			if err := m.addOutbound(relayTagConfig); err != nil {
+				return fmt.Errorf("failed to add relay outbound for UID %d: %w", subscription.Id, err)
 			}
-			key = fmt.Sprintf("%s:%s", relayNodeInfo.ServerKey, userKey)
-		} else {
-			key = subscription.Passwd
 		}
+	}
+	
+	return nil
+}
 
-		// Build and add relay outbound
-		relayTagConfig, err := OutboundRelayBuilder(relayNodeInfo, relayTag, &subscription, key)
+// relayChain builds the relay outbounds of a subscription from the first hop
+// to the exit hop, none when a hop has no key for the subscription
+func relayChain(hops []*api.RelayNodeInfo, relayTag string, subscription *api.SubscriptionInfo) ([]*core.OutboundHandlerConfig, error) {
+	var relayTagConfigs []*core.OutboundHandlerConfig
+	dialerProxy := ""
+	for i, hop := range hops {
+		key, err := relayKey(hop, subscription.Passwd)
 		if err != nil {
-			return fmt.Errorf("failed to build relay outbound for Id %d: %w", subscription.Id, err)
+			return nil, nil
 		}
 
-		if err := m.addOutbound(relayTagConfig); err != nil {
-			return fmt.Errorf("failed to add relay outbound for UID %d: %w", subscription.Id, err)
-		}
+		hopTag := RelayHopTag(relayTag, i, len(hops))
 
-		// Build and add router rule
-		routerConfig, err := RelayRouterBuilder(mainTag, relayTag, &subscription)
+		// Build relay outbound
+		relayTagConfig, err := OutboundRelayBuilder(hop, hopTag, subscription, key, dialerProxy)
 		if err != nil {
-			return fmt.Errorf("failed to build router for UID %d: %w", subscription.Id, err)
+			return nil, fmt.Errorf("failed to build relay outbound for Id %d: %w", subscription.Id, err)
 		}
+		relayTagConfigs = append(relayTagConfigs, relayTagConfig)
+		dialerProxy = relayTagConfig.Tag
+	}
+	return relayTagConfigs, nil
+}
 
-		if err := m.addRouterRule(routerConfig, true); err != nil {
-			return fmt.Errorf("failed to add router rule for UID %d: %w", subscription.Id, err)
+// RelayHopTag returns the tag of the i-th of n hops of a relay chain, the exit
+// hop keeps the relay tag so that the dispatcher mapping does not depend on the chain
+func RelayHopTag(relayTag string, i int, n int) string {
+	if i == n-1 {
+		return relayTag
+	}
+	return fmt.Sprintf("%s_hop%d", relayTag, i+1)
+}
+
+func relayHops(relayNodeInfo *api.RelayNodeInfo) []*api.RelayNodeInfo {
+	return append([]*api.RelayNodeInfo{relayNodeInfo}, relayNodeInfo.Chain...)
+}
+
+// relayKey returns the password of a relay outbound user
+func relayKey(relayNodeInfo *api.RelayNodeInfo, passwd string) (string, error) {
+	// Handle Shadowsocks 2022 key generation
+	if C.Contains(shadowaead_2022.List, strings.ToLower(relayNodeInfo.Cipher)) {
+		userKey, err := checkShadowsocksPassword(passwd, relayNodeInfo.Cipher)
+		if err != nil {
+			return "", err
 		}
+		return fmt.Sprintf("%s:%s", relayNodeInfo.ServerKey, userKey), nil
 	}
-	
-	return nil
+	return passwd, nil
 }
 
 func checkShadowsocksPassword(password string, method string) (string, error) {
@@ -175,38 +272,61 @@ func checkShadowsocksPassword(password string, method string) (string, error) {
 	return base64.StdEncoding.EncodeToString([]byte(userKey)), nil
 }
 
-// RemoveRelayTag removes all relay outbounds for subscriptions
-func (m *Manager) RemoveRelayTag(tag string, subscriptionInfo *[]api.SubscriptionInfo) error {
+// RemoveRelayTag removes the relay outbounds of every hop for the given subscriptions
+func (m *Manager) RemoveRelayTag(relayNodeInfo *api.RelayNodeInfo, tag string, subscriptionInfo *[]api.SubscriptionInfo) error {
+	hops := len(relayHops(relayNodeInfo))
+
+	// Keep going on errors, a subscription may have no relay outbound
+	var err error
 	for _, subscription := range *subscriptionInfo {
-		outboundTag := fmt.Sprintf("%s_%d", tag, subscription.Id)
-		if err := m.removeOutbound(outboundTag); err != nil {
-			return err
+		for i := hops - 1; i >= 0; i-- {
+			outboundTag := fmt.Sprintf("%s_%d", RelayHopTag(tag, i, hops), subscription.Id)
+			if e := m.removeOutbound(outboundTag); e != nil && err == nil {
+				err = e
+			}
 		}
 	}
 
-	return nil
+	return err
 }
 
-// RemoveRelayRules removes all routing rules for relay
-func (m *Manager) RemoveRelayRules(tag string, subscriptionInfo *[]api.SubscriptionInfo) error {
-	for _, subscription := range *subscriptionInfo {
-		ruleTag := fmt.Sprintf("%s_%d", tag, subscription.Id)
-		if err := m.removeRouterRule(ruleTag); err != nil {
-			return err
+// MapRelaySubscriptions maps the given subscriptions to the relay outbounds
+// returned by relayTags, the dispatcher looks them up by email
+func (m *Manager) MapRelaySubscriptions(
+	mainTag string,
+	subscriptionInfo *[]api.SubscriptionInfo,
+	relayTags func(subscription *api.SubscriptionInfo) []string,
+) {
+	for i := range *subscriptionInfo {
+		subscription := &(*subscriptionInfo)[i]
+		tags := relayTags(subscription)
+		outboundTags := make([]string, len(tags))
+		for j, tag := range tags {
+			outboundTags[j] = fmt.Sprintf("%s_%d", tag, subscription.Id)
 		}
+		m.dispatcher.RelayOutbounds.Store(
+			fmt.Sprintf("%s|%s|%d", mainTag, subscription.Email, subscription.Id),
+			&dispatcher.RelayGroup{Tags: outboundTags},
+		)
+	}
+}
+
+// RemoveRelayRules removes the relay mapping of the given subscriptions
+func (m *Manager) RemoveRelayRules(mainTag string, subscriptionInfo *[]api.SubscriptionInfo) error {
+	for _, subscription := range *subscriptionInfo {
+		m.dispatcher.RelayOutbounds.Delete(fmt.Sprintf("%s|%s|%d", mainTag, subscription.Email, subscription.Id))
 	}
 
 	return nil
 }
 
-// RemoveBlockingRules removes all routing rules for relay
+// RemoveBlockingRules removes the blocking rule, the rule actions and the
+// blackhole outbound of a node
 func (m *Manager) RemoveBlockingRules(tag string) error {
-	ruleTag := fmt.Sprintf("%s_blackhole", tag)
-	if err := m.removeRouterRule(ruleTag); err != nil {
-		return err
-	}
+	m.removeRules(tag)
+	m.removeRuleSetUsers(tag)
 	
-	if err := m.removeOutbound(ruleTag); err != nil {
+	if err := m.removeOutbound(fmt.Sprintf("%s_blackhole", tag)); err != nil {
 		return err
 	}
 
@@ -214,7 +334,7 @@ func (m *Manager) RemoveBlockingRules(tag string) error {
 }
 
 // Add blocking rule Tag for outbound 
-func (m *Manager) AddRuleTag(nodeInfo *api.NodeInfo, tag string) error {
+func (m *Manager) AddRuleTag(nodeInfo *api.NodeInfo, tag string, subscriptionList *[]api.SubscriptionInfo) error {
 	// Add outbound
 	blackholeConfig, err := BlackholeOutboundBuilder(tag)
 	if err != nil {
@@ -225,19 +345,163 @@ func (m *Manager) AddRuleTag(nodeInfo *api.NodeInfo, tag string) error {
 		return fmt.Errorf("failed to add outbound: %w", err)
 	}
 	
-	// Build and add router rule
-	routerConfig, err := RouterBuilder(nodeInfo, tag)
+	m.UpdateRuleSetUsers(tag, subscriptionList)
+	return m.addRules(nodeInfo.BlockingRules, tag)
+}
+
+// UpdateBlockingRules swaps the <tag>_blackhole rule, the rule actions and the
+// rule sets, the inbound, outbound and users of the node are left untouched
+func (m *Manager) UpdateBlockingRules(blockingRules *api.BlockingRules, tag string) error {
+	m.removeRules(tag)
+	return m.addRules(blockingRules, tag)
+}
+
+// addRules adds the blocking rule, the rule actions and the rule sets with
+// their outbounds
+func (m *Manager) addRules(blockingRules *api.BlockingRules, tag string) error {
+	m.access.Lock()
+	defer m.access.Unlock()
+	
+	if blockingRules == nil {
+		blockingRules = &api.BlockingRules{}
+	}
+	
+	// Build the rules first so that an invalid action adds nothing
+	routerConfig, err := BlockingRouterBuilder(blockingRules, tag)
 	if err != nil {
 		return err
 	}
+	ruleSets := make([]*dispatcher.RuleSet, len(blockingRules.RuleSets))
+	for i := range blockingRules.RuleSets {
+		ruleSets[i], err = RuleSetBuilder(&blockingRules.RuleSets[i].RuleAction, tag, RuleSetTag(tag, blockingRules.RuleSets[i].ID))
+		if err != nil {
+			return err
+		}
+	}
+	
+	ruleTags := make([]string, 0, len(blockingRules.Actions)+len(blockingRules.RuleSets))
+	defer func() {
+		m.ruleTags[tag] = ruleTags
+	}()
+	
+	for i := range blockingRules.Actions {
+		ruleTag := RuleActionTag(tag, i)
+		ruleTags = append(ruleTags, ruleTag)
+		if err := m.addRuleAction(&blockingRules.Actions[i], ruleTag); err != nil {
+			return err
+		}
+	}
+	groups := make(map[int][]string)
+	for i := range blockingRules.RuleSets {
+		ruleTag := RuleSetTag(tag, blockingRules.RuleSets[i].ID)
+		ruleTags = append(ruleTags, ruleTag)
+		if err := m.addRuleAction(&blockingRules.RuleSets[i].RuleAction, ruleTag); err != nil {
+			return err
+		}
+		m.dispatcher.RuleSets.Store(ruleTag, ruleSets[i])
+		for _, group := range blockingRules.RuleSets[i].Groups {
+			groups[group] = append(groups[group], ruleTag)
+		}
+	}
+	
+	// The rule sets of a plan group, in the order sent
+	for group, groupRuleTags := range groups {
+		groupTag := RuleSetGroupTag(tag, group)
+		ruleTags = append(ruleTags, groupTag)
+		m.dispatcher.RuleSetGroups.Store(groupTag, groupRuleTags)
+	}
+	
+	return m.addRouterRule(routerConfig, true)
+}
 
-	if err := m.addRouterRule(routerConfig, true); err != nil {
-		return err
+// UpdateRuleSetUsers sets the rule sets of the subscriptions of a node, the
+// rules themselves are left untouched
+func (m *Manager) UpdateRuleSetUsers(tag string, subscriptionList *[]api.SubscriptionInfo) {
+	m.access.Lock()
+	defer m.access.Unlock()
+	
+	emails := make(map[string]bool)
+	if subscriptionList != nil {
+		for _, subscription := range *subscriptionList {
+			if len(subscription.RuleSets) == 0 && subscription.GroupId == 0 {
+				continue
+			}
+			ruleTags := make([]string, 0, len(subscription.RuleSets)+1)
+			for _, id := range subscription.RuleSets {
+				ruleTags = append(ruleTags, RuleSetTag(tag, id))
+			}
+			// The rule sets of the plan group come after the own ones
+			if subscription.GroupId > 0 {
+				ruleTags = append(ruleTags, RuleSetGroupTag(tag, subscription.GroupId))
+			}
+			email := fmt.Sprintf("%s|%s|%d", tag, subscription.Email, subscription.Id)
+			m.dispatcher.RuleSetUsers.Store(email, ruleTags)
+			emails[email] = true
+		}
 	}
 	
+	for _, email := range m.ruleSetUsers[tag] {
+		if !emails[email] {
+			m.dispatcher.RuleSetUsers.Delete(email)
+		}
+	}
+	m.ruleSetUsers[tag] = make([]string, 0, len(emails))
+	for email := range emails {
+		m.ruleSetUsers[tag] = append(m.ruleSetUsers[tag], email)
+	}
+}
+
+func (m *Manager) removeRuleSetUsers(tag string) {
+	m.access.Lock()
+	defer m.access.Unlock()
+	for _, email := range m.ruleSetUsers[tag] {
+		m.dispatcher.RuleSetUsers.Delete(email)
+	}
+	delete(m.ruleSetUsers, tag)
+}
+
+// addRuleAction prepares what a rule action needs besides its router rule
+func (m *Manager) addRuleAction(ruleAction *api.RuleAction, ruleTag string) error {
+	switch ruleAction.Action {
+		case api.RuleActionRedirect:
+			if m.obm.GetHandler(ruleAction.Outbound) == nil {
+				return fmt.Errorf("outbound %s of redirect rule %s does not exist", ruleAction.Outbound, ruleTag)
+			}
+		case api.RuleActionThrottle:
+			m.dispatcher.Limiter.AddRuleLimiter(ruleTag, ruleAction.SpeedLimit)
+		case api.RuleActionAudit:
+			m.dispatcher.AuditRules.Store(ruleTag, true)
+		case api.RuleActionDNS:
+			outboundConfig, err := RuleActionOutboundBuilder(ruleAction, ruleTag)
+			if err != nil {
+				return err
+			}
+			if err := m.addOutbound(outboundConfig); err != nil {
+				return fmt.Errorf("failed to add dns rule outbound: %w", err)
+			}
+	}
 	return nil
 }
 
+// removeRules removes everything addRules added except the blackhole outbound,
+// rules that were never added are ignored
+func (m *Manager) removeRules(tag string) {
+	m.access.Lock()
+	defer m.access.Unlock()
+	
+	m.removeRouterRule(fmt.Sprintf("%s_blackhole", tag))
+	
+	for _, ruleTag := range m.ruleTags[tag] {
+		m.removeRouterRule(ruleTag)
+		m.removeOutbound(ruleTag)
+		m.dispatcher.Limiter.DeleteRuleLimiter(ruleTag)
+		m.dispatcher.AuditRules.Delete(ruleTag)
+		m.dispatcher.RuleSets.Delete(ruleTag)
+		m.dispatcher.RuleSetGroups.Delete(ruleTag)
+	}
+	delete(m.ruleTags, tag)
+}
+
 // Private helper methods
 func (m *Manager) removeInbound(tag string) error {
 	err := m.ibm.RemoveHandler(context.Background(), tag)
@@ -303,3 +567,14 @@ func (m *Manager) DeleteInboundLimiter(tag string) error {
 	err := m.dispatcher.Limiter.DeleteInboundLimiter(tag)
 	return err
 }
+
+// DeleteRuleBuckets removes the throttle buckets of removed subscriptions
+func (m *Manager) DeleteRuleBuckets(emails []string) {
+	m.dispatcher.Limiter.DeleteRuleBuckets(emails)
+}
+
+// ActiveConnections returns the open connections of a node, the connections of
+// its extra inbounds are counted under the node tag
+func (m *Manager) ActiveConnections(tag string) int64 {
+	return m.dispatcher.ActiveConnections(tag)
+}
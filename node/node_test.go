@@ -0,0 +1,145 @@
+package node
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xmplusdev/xmplus-server/api"
+	"github.com/xmplusdev/xmplus-server/app/dispatcher"
+)
+
+func TestManager_MapRelaySubscriptions(t *testing.T) {
+	subscriptions := &[]api.SubscriptionInfo{
+		{Id: 1, Email: "a@example.com"},
+		{Id: 2, Email: "b@example.com"},
+	}
+
+	testCases := []struct {
+		desc      string
+		relayTags func(subscription *api.SubscriptionInfo) []string
+		expected  map[string][]string
+	}{
+		{
+			desc: "single transit",
+			relayTags: func(subscription *api.SubscriptionInfo) []string {
+				return []string{"transit"}
+			},
+			expected: map[string][]string{
+				"node|a@example.com|1": {"transit_1"},
+				"node|b@example.com|2": {"transit_2"},
+			},
+		},
+		{
+			desc: "transit per subscription",
+			relayTags: func(subscription *api.SubscriptionInfo) []string {
+				if subscription.Id == 1 {
+					return []string{"transit1"}
+				}
+				return []string{"transit2"}
+			},
+			expected: map[string][]string{
+				"node|a@example.com|1": {"transit1_1"},
+				"node|b@example.com|2": {"transit2_2"},
+			},
+		},
+		{
+			desc: "several transits",
+			relayTags: func(subscription *api.SubscriptionInfo) []string {
+				return []string{"transit1", "transit2"}
+			},
+			expected: map[string][]string{
+				"node|a@example.com|1": {"transit1_1", "transit2_1"},
+				"node|b@example.com|2": {"transit1_2", "transit2_2"},
+			},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			m := newTestManager(t)
+			m.MapRelaySubscriptions("node", subscriptions, test.relayTags)
+
+			for key, tags := range test.expected {
+				group, ok := m.dispatcher.RelayOutbounds.Load(key)
+				require.True(t, ok, key)
+				assert.Equal(t, tags, group.(*dispatcher.RelayGroup).Tags)
+			}
+
+			require.NoError(t, m.RemoveRelayRules("node", subscriptions))
+			for key := range test.expected {
+				_, ok := m.dispatcher.RelayOutbounds.Load(key)
+				assert.False(t, ok, key)
+			}
+		})
+	}
+}
+
+func TestManager_ruleSetGroups(t *testing.T) {
+	m := newTestManager(t)
+	blockingRules := &api.BlockingRules{
+		RuleSets: []api.RuleSet{
+			{ID: 3, Groups: []int{1}, RuleAction: api.RuleAction{Action: api.RuleActionBlock, Domain: []string{"example.com"}}},
+			{ID: 4, Groups: []int{1, 2}, RuleAction: api.RuleAction{Action: api.RuleActionBlock, Domain: []string{"example.org"}}},
+		},
+	}
+	require.NoError(t, m.addRules(blockingRules, "node"))
+
+	groups := map[string][]string{
+		"node_group_1": {"node_ruleset_3", "node_ruleset_4"},
+		"node_group_2": {"node_ruleset_4"},
+	}
+	for groupTag, ruleTags := range groups {
+		value, ok := m.dispatcher.RuleSetGroups.Load(groupTag)
+		require.True(t, ok, groupTag)
+		assert.Equal(t, ruleTags, value)
+	}
+
+	testCases := []struct {
+		desc         string
+		subscription api.SubscriptionInfo
+		expected     []string
+	}{
+		{
+			desc:         "own rule sets",
+			subscription: api.SubscriptionInfo{Id: 1, Email: "a@example.com", RuleSets: []int{3}},
+			expected:     []string{"node_ruleset_3"},
+		},
+		{
+			desc:         "plan group",
+			subscription: api.SubscriptionInfo{Id: 2, Email: "b@example.com", GroupId: 2},
+			expected:     []string{"node_group_2"},
+		},
+		{
+			desc:         "own rule sets before the plan group",
+			subscription: api.SubscriptionInfo{Id: 3, Email: "c@example.com", RuleSets: []int{4}, GroupId: 1},
+			expected:     []string{"node_ruleset_4", "node_group_1"},
+		},
+		{
+			desc:         "none",
+			subscription: api.SubscriptionInfo{Id: 4, Email: "d@example.com"},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			m.UpdateRuleSetUsers("node", &[]api.SubscriptionInfo{test.subscription})
+
+			value, ok := m.dispatcher.RuleSetUsers.Load(fmt.Sprintf("node|%s|%d", test.subscription.Email, test.subscription.Id))
+			if test.expected == nil {
+				assert.False(t, ok)
+				return
+			}
+			require.True(t, ok)
+			assert.Equal(t, test.expected, value)
+		})
+	}
+
+	m.removeRules("node")
+	for groupTag := range groups {
+		_, ok := m.dispatcher.RuleSetGroups.Load(groupTag)
+		assert.False(t, ok, groupTag)
+	}
+}
@@ -3,6 +3,7 @@ package node
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 
 	"github.com/xtls/xray-core/core"
 	"github.com/xtls/xray-core/infra/conf"
@@ -46,6 +47,29 @@ func OutboundBuilder(config *Config, nodeInfo *api.NodeInfo, tag string) (*core.
 	return outboundDetourConfig.Build()	
 }
 
+// PluginOutboundBuilder builds the freedom outbound of the transport inbound of
+// a Shadowsocks-Plugin node, it redirects to the shadowsocks inbound
+func PluginOutboundBuilder(tag string, port uint32) (*core.OutboundHandlerConfig, error) {
+	outboundDetourConfig := &conf.OutboundDetourConfig{}
+	
+	outboundDetourConfig.Protocol = "freedom"
+	outboundDetourConfig.Tag = tag
+	
+	proxySetting := &conf.FreedomConfig{
+		Redirect:      fmt.Sprintf("127.0.0.1:%d", port),
+		ProxyProtocol: 2,
+	}
+	
+	setting, err := json.Marshal(proxySetting)
+	if err != nil {
+		return nil, fmt.Errorf("marshal plugin %s config fialed: %s", tag, err)
+	}
+	
+	rawSetting := json.RawMessage(setting)
+	outboundDetourConfig.Settings = &rawSetting
+	return outboundDetourConfig.Build()
+}
+
 func BlackholeOutboundBuilder(tag string) (*core.OutboundHandlerConfig, error) {
 	outboundDetourConfig := &conf.OutboundDetourConfig{}
 	
@@ -55,8 +79,30 @@ func BlackholeOutboundBuilder(tag string) (*core.OutboundHandlerConfig, error) {
 	return outboundDetourConfig.Build()	
 }
 
+// RuleActionOutboundBuilder builds the freedom outbound of a dns rule action
+func RuleActionOutboundBuilder(ruleAction *api.RuleAction, ruleTag string) (*core.OutboundHandlerConfig, error) {
+	outboundDetourConfig := &conf.OutboundDetourConfig{}
+	
+	outboundDetourConfig.Protocol = "freedom"
+	outboundDetourConfig.Tag = ruleTag
+	
+	proxySetting := &conf.FreedomConfig{
+		DomainStrategy: ruleAction.DomainStrategy,
+	}
+	
+	setting, err := json.Marshal(proxySetting)
+	if err != nil {
+		return nil, fmt.Errorf("marshal dns rule %s config fialed: %s", ruleTag, err)
+	}
+	
+	rawSetting := json.RawMessage(setting)
+	outboundDetourConfig.Settings = &rawSetting
+	return outboundDetourConfig.Build()
+}
 
-func OutboundRelayBuilder(nodeInfo *api.RelayNodeInfo, tag string, subscription *api.SubscriptionInfo, Passwd string) (*core.OutboundHandlerConfig, error) {
+// OutboundRelayBuilder builds the relay outbound of a subscription, dialerProxy
+// is the outbound of the previous hop of a relay chain
+func OutboundRelayBuilder(nodeInfo *api.RelayNodeInfo, tag string, subscription *api.SubscriptionInfo, Passwd string, dialerProxy string) (*core.OutboundHandlerConfig, error) {
 	outboundDetourConfig := &conf.OutboundDetourConfig{}
 	
 	var (
@@ -165,6 +211,7 @@ func OutboundRelayBuilder(nodeInfo *api.RelayNodeInfo, tag string, subscription
 			Path: nodeInfo.WsSettings.Path,
 			Host: nodeInfo.WsSettings.Host,
 			HeartbeatPeriod: nodeInfo.WsSettings.HeartbeatPeriod,
+			Headers: nodeInfo.WsSettings.Headers,
 		}
 		streamSetting.WSSettings = wsSettings
 	case "httpupgrade":
@@ -172,41 +219,52 @@ func OutboundRelayBuilder(nodeInfo *api.RelayNodeInfo, tag string, subscription
 		    AcceptProxyProtocol: nodeInfo.AcceptProxyProtocol,
 			Host: nodeInfo.HttpSettings.Host,
 			Path: nodeInfo.HttpSettings.Path,
+			Headers: nodeInfo.HttpSettings.Headers,
 		}
 		streamSetting.HTTPUPGRADESettings = httpupgradeSettings	
 	case "xhttp":
-		xhttpSettings := &conf.SplitHTTPConfig{
-			Host: nodeInfo.XhttpSettings.Host,
-			Path: nodeInfo.XhttpSettings.Path,
-			Mode: nodeInfo.XhttpSettings.Mode,
-			NoSSEHeader: nodeInfo.XhttpSettings.NoSSEHeader,
-			NoGRPCHeader: nodeInfo.XhttpSettings.NoGRPCHeader,
+		xhttpSettings, err := xhttpConfig(nodeInfo.XhttpSettings)
+		if err != nil {
+			return nil, err
 		}
 		streamSetting.XHTTPSettings = xhttpSettings		
 	case "grpc":
-		grpcSettings := &conf.GRPCConfig{
-			ServiceName: nodeInfo.GrpcSettings.ServiceName,
-			Authority: nodeInfo.GrpcSettings.Authority,
-			UserAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 17_4_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/123.0.6312.52 Mobile/15E148 Safari/604.1",
-		}
-		streamSetting.GRPCSettings = grpcSettings
+		streamSetting.GRPCSettings = grpcConfig(nodeInfo.GrpcSettings)
 	case "mkcp":
-		kcpSettings := &conf.KCPConfig{
-			HeaderConfig: nodeInfo.KcpSettings.Header,
-			Congestion: &nodeInfo.KcpSettings.Congestion,
-			Seed: &nodeInfo.KcpSettings.Seed,
-		}
-		streamSetting.KCPSettings = kcpSettings	
+		streamSetting.KCPSettings = kcpConfig(nodeInfo.KcpSettings)
 	}
 	
 	streamSetting.Network = &transportProtocol
 	
 	if nodeInfo.SecurityType == "tls" {
 		streamSetting.Security = "tls"
+		// The transit certificate is verified against the server name, or only
+		// against the pinned hash or the CA bundle sent by the panel
+		serverName := nodeInfo.TlsSettings.ServerName
+		if serverName == "" {
+			serverName = nodeInfo.Address
+		}
 		tlsSettings := &conf.TLSConfig{
-			Insecure: true,
+			Insecure: nodeInfo.TlsSettings.AllowInsecure,
+			ServerName: serverName,
 			Fingerprint: nodeInfo.TlsSettings.FingerPrint,
 			VerifyPeerCertInNames: nodeInfo.TlsSettings.VerifyPeerCertInNames,
+			PinnedPeerCertSha256: nodeInfo.TlsSettings.PinnedPeerCertSha256,
+		}
+		if nodeInfo.TlsSettings.CaCertificate != "" {
+			tlsSettings.Certs = []*conf.TLSCertConfig{{
+				CertStr: strings.Split(strings.TrimSpace(nodeInfo.TlsSettings.CaCertificate), "\n"),
+				Usage: "verify",
+			}}
+			tlsSettings.DisableSystemRoot = true
+		}
+		// The client certificate proves the relay to a transit asking for one
+		if nodeInfo.TlsSettings.ClientCertificate != "" {
+			tlsSettings.Certs = append(tlsSettings.Certs, &conf.TLSCertConfig{
+				CertStr: strings.Split(strings.TrimSpace(nodeInfo.TlsSettings.ClientCertificate), "\n"),
+				KeyStr: strings.Split(strings.TrimSpace(nodeInfo.TlsSettings.ClientKey), "\n"),
+				Usage: "encipherment",
+			})
 		}
 		streamSetting.TLSSettings = tlsSettings	
 	}
@@ -231,6 +289,27 @@ func OutboundRelayBuilder(nodeInfo *api.RelayNodeInfo, tag string, subscription
 	}
 	outboundDetourConfig.StreamSetting = streamSetting
 	
+	// Mux runs inside the per-subscription outbound, so traffic is still accounted per user
+	if nodeInfo.MuxSettings != nil {
+		if nodeInfo.Flow != "" || (nodeInfo.RawSettings != nil && nodeInfo.RawSettings.Flow != "") {
+			return nil, fmt.Errorf("mux is not supported with vless flow on relay %s", tag)
+		}
+		outboundDetourConfig.MuxSettings = &conf.MuxConfig{
+			Enabled: true,
+			Concurrency: nodeInfo.MuxSettings.Concurrency,
+			XudpConcurrency: nodeInfo.MuxSettings.XudpConcurrency,
+			XudpProxyUDP443: nodeInfo.MuxSettings.XudpProxyUDP443,
+		}
+	}
+	
+	// Keep the transport and security of the hop, only the dial goes through the previous hop
+	if dialerProxy != "" {
+		outboundDetourConfig.ProxySettings = &conf.ProxyConfig{
+			Tag: dialerProxy,
+			TransportLayerProxy: true,
+		}
+	}
+	
 	return outboundDetourConfig.Build()
 }
 
@@ -0,0 +1,258 @@
+package node
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xtls/xray-core/app/proxyman"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/transport/internet/tls"
+
+	"github.com/xmplusdev/xmplus-server/api"
+)
+
+// testCertificate returns a self-signed PEM certificate and key
+func testCertificate(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "relay"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+}
+
+func testRelayNode() *api.RelayNodeInfo {
+	return &api.RelayNodeInfo{
+		NodeType:      "vless",
+		NodeID:        2,
+		Address:       "203.0.113.1",
+		ListeningPort: 443,
+		NetworkType:   "raw",
+		SecurityType:  "none",
+		Encryption:    "none",
+		RawSettings:   &api.RawSettings{},
+	}
+}
+
+func testSubscription() *api.SubscriptionInfo {
+	return &api.SubscriptionInfo{Id: 7, Email: "user@example.com", Passwd: "b831381d-6324-4d53-ad4f-8cda48b30811"}
+}
+
+// senderSettings returns the stream settings of a built outbound
+func senderSettings(t *testing.T, config *core.OutboundHandlerConfig) *proxyman.SenderConfig {
+	rawSettings, err := config.SenderSettings.GetInstance()
+	require.NoError(t, err)
+	settings, ok := rawSettings.(*proxyman.SenderConfig)
+	require.True(t, ok)
+	return settings
+}
+
+func TestOutboundRelayBuilder_clientCertificate(t *testing.T) {
+	certificate, key := testCertificate(t)
+
+	testCases := []struct {
+		desc        string
+		tlsSettings *api.TlsSettings
+		expected    []tls.Certificate_Usage
+	}{
+		{
+			desc:        "server verification only",
+			tlsSettings: &api.TlsSettings{ServerName: "transit.example.com"},
+		},
+		{
+			desc:        "client certificate",
+			tlsSettings: &api.TlsSettings{ClientCertificate: certificate, ClientKey: key},
+			expected:    []tls.Certificate_Usage{tls.Certificate_ENCIPHERMENT},
+		},
+		{
+			desc:        "ca bundle and client certificate",
+			tlsSettings: &api.TlsSettings{CaCertificate: certificate, ClientCertificate: certificate, ClientKey: key},
+			expected:    []tls.Certificate_Usage{tls.Certificate_AUTHORITY_VERIFY, tls.Certificate_ENCIPHERMENT},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			nodeInfo := testRelayNode()
+			nodeInfo.SecurityType = "tls"
+			nodeInfo.TlsSettings = test.tlsSettings
+
+			config, err := OutboundRelayBuilder(nodeInfo, "relay", testSubscription(), "", "")
+			require.NoError(t, err)
+
+			streamSettings := senderSettings(t, config).StreamSettings
+			require.Len(t, streamSettings.SecuritySettings, 1)
+			rawTLS, err := streamSettings.SecuritySettings[0].GetInstance()
+			require.NoError(t, err)
+			tlsConfig := rawTLS.(*tls.Config)
+
+			usages := []tls.Certificate_Usage{}
+			for _, c := range tlsConfig.Certificate {
+				usages = append(usages, c.Usage)
+				if c.Usage == tls.Certificate_ENCIPHERMENT {
+					assert.Equal(t, key, string(c.Key)+"\n")
+				}
+			}
+			if test.expected == nil {
+				assert.Empty(t, usages)
+			} else {
+				assert.Equal(t, test.expected, usages)
+			}
+		})
+	}
+}
+
+func TestRelayHopTag(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		i        int
+		n        int
+		expected string
+	}{
+		{desc: "single hop", i: 0, n: 1, expected: "relay"},
+		{desc: "first hop", i: 0, n: 3, expected: "relay_hop1"},
+		{desc: "middle hop", i: 1, n: 3, expected: "relay_hop2"},
+		{desc: "exit hop", i: 2, n: 3, expected: "relay"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			assert.Equal(t, test.expected, RelayHopTag("relay", test.i, test.n))
+		})
+	}
+}
+
+func Test_relayChain(t *testing.T) {
+	ss2022 := testRelayNode()
+	ss2022.NodeType = "Shadowsocks"
+	ss2022.Cipher = "2022-blake3-aes-128-gcm"
+	ss2022.ServerKey = "c2VydmVyLWtleS0xMjM0NQ=="
+
+	testCases := []struct {
+		desc        string
+		hops        []*api.RelayNodeInfo
+		passwd      string
+		tags        []string
+		dialerProxy []string
+	}{
+		{
+			desc:        "single hop",
+			hops:        []*api.RelayNodeInfo{testRelayNode()},
+			tags:        []string{"relay_7"},
+			dialerProxy: []string{""},
+		},
+		{
+			desc:        "each hop dials through the previous one",
+			hops:        []*api.RelayNodeInfo{testRelayNode(), testRelayNode(), testRelayNode()},
+			tags:        []string{"relay_hop1_7", "relay_hop2_7", "relay_7"},
+			dialerProxy: []string{"", "relay_hop1_7", "relay_hop2_7"},
+		},
+		{
+			desc:   "no key for a hop",
+			hops:   []*api.RelayNodeInfo{testRelayNode(), ss2022},
+			passwd: "short",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			subscription := testSubscription()
+			if test.passwd != "" {
+				subscription.Passwd = test.passwd
+			}
+
+			configs, err := relayChain(test.hops, "relay", subscription)
+			require.NoError(t, err)
+			require.Len(t, configs, len(test.tags))
+
+			for i, config := range configs {
+				assert.Equal(t, test.tags[i], config.Tag)
+				// A transport layer proxy is built into the dialer of the stream
+				assert.Equal(t, test.dialerProxy[i], senderSettings(t, config).StreamSettings.GetSocketSettings().GetDialerProxy())
+			}
+		})
+	}
+}
+
+func TestOutboundRelayBuilder_mux(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		flow        string
+		rawFlow     string
+		muxSettings *api.MuxSettings
+		expected    *proxyman.MultiplexingConfig
+		err         bool
+	}{
+		{
+			desc: "mux disabled",
+		},
+		{
+			desc:        "mux with xudp",
+			muxSettings: &api.MuxSettings{Concurrency: 8, XudpConcurrency: 16, XudpProxyUDP443: "allow"},
+			expected:    &proxyman.MultiplexingConfig{Enabled: true, Concurrency: 8, XudpConcurrency: 16, XudpProxyUDP443: "allow"},
+		},
+		{
+			desc:        "udp 443 rejected by default",
+			muxSettings: &api.MuxSettings{Concurrency: 8},
+			expected:    &proxyman.MultiplexingConfig{Enabled: true, Concurrency: 8, XudpProxyUDP443: "reject"},
+		},
+		{
+			desc:        "flow of the node",
+			flow:        "xtls-rprx-vision",
+			muxSettings: &api.MuxSettings{Concurrency: 8},
+			err:         true,
+		},
+		{
+			desc:        "flow of the raw transport",
+			rawFlow:     "xtls-rprx-vision",
+			muxSettings: &api.MuxSettings{Concurrency: 8},
+			err:         true,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			nodeInfo := testRelayNode()
+			nodeInfo.Flow = test.flow
+			nodeInfo.RawSettings.Flow = test.rawFlow
+			nodeInfo.MuxSettings = test.muxSettings
+
+			config, err := OutboundRelayBuilder(nodeInfo, "relay", testSubscription(), "", "")
+			if test.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			multiplexSettings := senderSettings(t, config).MultiplexSettings
+			if test.expected == nil {
+				assert.Nil(t, multiplexSettings)
+				return
+			}
+			require.NotNil(t, multiplexSettings)
+			assert.Equal(t, test.expected.Enabled, multiplexSettings.Enabled)
+			assert.Equal(t, test.expected.Concurrency, multiplexSettings.Concurrency)
+			assert.Equal(t, test.expected.XudpConcurrency, multiplexSettings.XudpConcurrency)
+			assert.Equal(t, test.expected.XudpProxyUDP443, multiplexSettings.XudpProxyUDP443)
+		})
+	}
+}
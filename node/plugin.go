@@ -0,0 +1,90 @@
+package node
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/xmplusdev/xmplus-server/api"
+)
+
+// PluginTag returns the tag of the transport inbound of a Shadowsocks-Plugin node
+func PluginTag(tag string) string {
+	return fmt.Sprintf("dokodemo-door_%s+1", tag)
+}
+
+// pluginPort returns the loopback port of the shadowsocks inbound of a
+// Shadowsocks-Plugin node, the transport inbound keeps the node port
+func pluginPort(nodeInfo *api.NodeInfo) (uint32, error) {
+	port, err := strconv.ParseUint(nodeInfo.ListeningPort, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("Shadowsocks-Plugin node %d needs a single listening port: %w", nodeInfo.NodeID, err)
+	}
+	if port >= 65535 {
+		return 0, fmt.Errorf("Shadowsocks-Plugin node %d has no port after %d", nodeInfo.NodeID, port)
+	}
+	return uint32(port) + 1, nil
+}
+
+// addPlugin adds the transport inbound of a Shadowsocks-Plugin node. Like the
+// v2ray-plugin server, a dokodemo-door inbound decodes the mux.cool streams of
+// the ws, grpc or xhttp transport and a freedom outbound redirects them to the
+// shadowsocks inbound on the loopback port. The client address is passed on
+// with a proxy protocol header for the device limit.
+func (m *Manager) addPlugin(nodeInfo *api.NodeInfo, tag string, config *Config) error {
+	port, err := pluginPort(nodeInfo)
+	if err != nil {
+		return err
+	}
+	
+	transportInfo := *nodeInfo
+	transportInfo.NodeType = "dokodemo-door"
+	transportInfo.Sniffing = false
+	if nodeInfo.XraySettings != nil {
+		// The raw protocol settings and sniffing are for the shadowsocks inbound
+		transportInfo.XraySettings = &api.XraySettings{StreamSettings: nodeInfo.XraySettings.StreamSettings}
+	}
+	
+	inboundConfig, err := InboundBuilder(config, &transportInfo, PluginTag(tag))
+	if err != nil {
+		return fmt.Errorf("failed to build plugin inbound config: %w", err)
+	}
+	
+	outboundConfig, err := PluginOutboundBuilder(PluginTag(tag), port)
+	if err != nil {
+		return fmt.Errorf("failed to build plugin outbound config: %w", err)
+	}
+	
+	if err := m.addOutbound(outboundConfig); err != nil {
+		return fmt.Errorf("failed to add plugin outbound: %w", err)
+	}
+	// Like the node inbounds, the transport inbound is routed by the
+	// dispatcher, which leaves no router rule behind
+	m.dispatcher.DefaultOutbounds.Store(PluginTag(tag), PluginTag(tag))
+	if err := m.addInbound(inboundConfig); err != nil {
+		// The inbound manager keeps the tag of a handler that failed to start
+		m.removeInbound(PluginTag(tag))
+		m.dispatcher.DefaultOutbounds.Delete(PluginTag(tag))
+		m.removeOutbound(PluginTag(tag))
+		return fmt.Errorf("failed to add plugin inbound: %w", err)
+	}
+	
+	return nil
+}
+
+// pluginShadowsocks returns the node info of the shadowsocks inbound behind
+// the transport inbound of a Shadowsocks-Plugin node
+func pluginShadowsocks(nodeInfo *api.NodeInfo) (*api.NodeInfo, error) {
+	port, err := pluginPort(nodeInfo)
+	if err != nil {
+		return nil, err
+	}
+	
+	shadowsocksInfo := *nodeInfo
+	shadowsocksInfo.ListeningPort = strconv.FormatUint(uint64(port), 10)
+	shadowsocksInfo.NetworkType = "raw"
+	shadowsocksInfo.RawSettings = &api.RawSettings{}
+	shadowsocksInfo.SecurityType = ""
+	shadowsocksInfo.AcceptProxyProtocol = true
+	withoutXrayStream(&shadowsocksInfo)
+	return &shadowsocksInfo, nil
+}
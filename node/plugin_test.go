@@ -0,0 +1,62 @@
+package node
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xtls/xray-core/app/proxyman"
+	"github.com/xtls/xray-core/app/router"
+	"github.com/xtls/xray-core/common/serial"
+	"github.com/xtls/xray-core/core"
+
+	"github.com/xmplusdev/xmplus-server/api"
+	"github.com/xmplusdev/xmplus-server/app/dispatcher"
+)
+
+func newTestManager(t *testing.T) *Manager {
+	server, err := core.New(&core.Config{
+		App: []*serial.TypedMessage{
+			serial.ToTypedMessage(&dispatcher.Config{}),
+			serial.ToTypedMessage(&proxyman.InboundConfig{}),
+			serial.ToTypedMessage(&proxyman.OutboundConfig{}),
+			serial.ToTypedMessage(&router.Config{}),
+		},
+	})
+	require.NoError(t, err)
+	return NewManager(server)
+}
+
+func TestManager_plugin(t *testing.T) {
+	m := newTestManager(t)
+	nodeInfo := &api.NodeInfo{
+		NodeType:      "Shadowsocks-Plugin",
+		NodeID:        1,
+		ListeningPort: "20000",
+		NetworkType:   "ws",
+		WsSettings:    &api.WsSettings{Path: "/"},
+		Cipher:        "aes-128-gcm",
+		RawSettings:   &api.RawSettings{},
+	}
+	tag := "Shadowsocks-Plugin_20000_1"
+
+	// A plugin node is removed and added again on every rebuild
+	for i := 0; i < 2; i++ {
+		require.NoError(t, m.AddTag(nodeInfo, tag, &Config{}))
+
+		outboundTag, ok := m.dispatcher.DefaultOutbounds.Load(PluginTag(tag))
+		require.True(t, ok)
+		assert.Equal(t, PluginTag(tag), outboundTag)
+		_, err := m.ibm.GetHandler(context.Background(), PluginTag(tag))
+		require.NoError(t, err)
+		assert.NotNil(t, m.obm.GetHandler(PluginTag(tag)))
+
+		require.NoError(t, m.RemoveTag(PluginTag(tag)))
+		require.NoError(t, m.RemoveTag(tag))
+
+		_, ok = m.dispatcher.DefaultOutbounds.Load(PluginTag(tag))
+		assert.False(t, ok)
+		assert.Nil(t, m.obm.GetHandler(PluginTag(tag)))
+	}
+}
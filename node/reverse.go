@@ -0,0 +1,204 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/xtls/xray-core/app/reverse"
+	"github.com/xtls/xray-core/app/router"
+	"github.com/xtls/xray-core/infra/conf"
+
+	"github.com/xmplusdev/xmplus-server/api"
+)
+
+// ReversePortalTag returns the outbound tag of the portal of a node
+func ReversePortalTag(tag string) string {
+	return fmt.Sprintf("%s_portal", tag)
+}
+
+// ReverseBridgeTag returns the inbound tag the bridge of a node dispatches with
+func ReverseBridgeTag(tag string) string {
+	return fmt.Sprintf("%s_bridge", tag)
+}
+
+// defaultOutbound returns the outbound of the default rule of a node, the
+// portal of a reverse relay is created here
+func (m *Manager) defaultOutbound(nodeInfo *api.NodeInfo, tag string) (string, error) {
+	switch nodeInfo.RelayType {
+		case api.RelayTypeOutbound:
+			if nodeInfo.RelayOutbound == "" {
+				return "", fmt.Errorf("relay outbound of node %d is empty", nodeInfo.NodeID)
+			}
+			if m.obm.GetHandler(nodeInfo.RelayOutbound) == nil {
+				return "", fmt.Errorf("relay outbound %s not found, it must be defined in OutboundConfigPath", nodeInfo.RelayOutbound)
+			}
+			return nodeInfo.RelayOutbound, nil
+		case api.RelayTypePortal:
+			if StaticInbound(nodeInfo.NodeType) {
+				return "", fmt.Errorf("reverse portal is not supported by %s nodes", nodeInfo.NodeType)
+			}
+			if nodeInfo.ReversePasswd == "" {
+				return "", fmt.Errorf("reverse portal of node %d has no reverse password, the bridge cannot connect", nodeInfo.NodeID)
+			}
+			if err := m.addPortal(nodeInfo.ReverseDomain, tag); err != nil {
+				return "", err
+			}
+			return ReversePortalTag(tag), nil
+	}
+	return tag, nil
+}
+
+// ReverseSubscription returns the user the bridge dials the portal with, the
+// portal node adds it to its inbound next to the subscriptions
+func ReverseSubscription(nodeInfo *api.NodeInfo) *api.SubscriptionInfo {
+	return &api.SubscriptionInfo{
+		Email:  "reverse",
+		Passwd: nodeInfo.ReversePasswd,
+	}
+}
+
+// addPortal adds the reverse portal of a node. The bridge connects through the
+// node inbound as the ReverseSubscription user, the portal recognizes its
+// connections by the reverse domain and tunnels the node traffic back through
+// them.
+func (m *Manager) addPortal(domain string, tag string) error {
+	portal, err := reverse.NewPortal(&reverse.PortalConfig{
+		Tag:    ReversePortalTag(tag),
+		Domain: domain,
+	}, m.obm)
+	if err != nil {
+		return fmt.Errorf("failed to create reverse portal: %w", err)
+	}
+	if err := portal.Start(); err != nil {
+		return fmt.Errorf("failed to start reverse portal: %w", err)
+	}
+
+	m.access.Lock()
+	m.portals[tag] = portal
+	m.access.Unlock()
+	return nil
+}
+
+func (m *Manager) removePortal(tag string) {
+	m.access.Lock()
+	portal, ok := m.portals[tag]
+	delete(m.portals, tag)
+	m.access.Unlock()
+
+	if ok {
+		portal.Close()
+	}
+}
+
+// AddReverseBridge connects the node to the portal on the transit server. The
+// tunnel is dialed with the reverse user, the traffic coming back through it
+// leaves through the node outbound.
+func (m *Manager) AddReverseBridge(relayNodeInfo *api.RelayNodeInfo, nodeInfo *api.NodeInfo, tag string) error {
+	bridgeTag := ReverseBridgeTag(tag)
+
+	reverseUser := ReverseSubscription(nodeInfo)
+	key, err := relayKey(relayNodeInfo, reverseUser.Passwd)
+	if err != nil {
+		return fmt.Errorf("failed to build reverse key: %w", err)
+	}
+
+	outboundConfig, err := OutboundRelayBuilder(relayNodeInfo, bridgeTag, reverseUser, key, "")
+	if err != nil {
+		return fmt.Errorf("failed to build reverse outbound: %w", err)
+	}
+	if err := m.addOutbound(outboundConfig); err != nil {
+		return fmt.Errorf("failed to add reverse outbound: %w", err)
+	}
+
+	routerConfig, err := bridgeRouterBuilder(nodeInfo.ReverseDomain, tag, outboundConfig.Tag)
+	if err != nil {
+		m.removeOutbound(outboundConfig.Tag)
+		return err
+	}
+	if err := m.addRouterRule(routerConfig, true); err != nil {
+		m.removeOutbound(outboundConfig.Tag)
+		return err
+	}
+
+	bridge, err := reverse.NewBridge(&reverse.BridgeConfig{
+		Tag:    bridgeTag,
+		Domain: nodeInfo.ReverseDomain,
+	}, m.dispatcher)
+	if err == nil {
+		err = bridge.Start()
+	}
+	if err != nil {
+		m.removeBridgeRoute(tag)
+		return fmt.Errorf("failed to start reverse bridge: %w", err)
+	}
+
+	m.access.Lock()
+	m.bridges[tag] = bridge
+	m.access.Unlock()
+	return nil
+}
+
+// RemoveReverseBridge closes the bridge of a node and removes its routing
+func (m *Manager) RemoveReverseBridge(tag string) {
+	m.access.Lock()
+	bridge, ok := m.bridges[tag]
+	delete(m.bridges, tag)
+	m.access.Unlock()
+
+	if ok {
+		bridge.Close()
+	}
+	m.removeBridgeRoute(tag)
+}
+
+func (m *Manager) removeBridgeRoute(tag string) {
+	bridgeTag := ReverseBridgeTag(tag)
+	m.removeRouterRule(fmt.Sprintf("%s_tunnel", bridgeTag))
+	m.removeRouterRule(fmt.Sprintf("%s_default", bridgeTag))
+	m.removeOutbound(fmt.Sprintf("%s_0", bridgeTag))
+}
+
+// bridgeRouterBuilder sends the tunnel connections of the bridge to the portal
+// and the traffic coming back through the tunnel to the node outbound
+func bridgeRouterBuilder(domain string, tag string, tunnelOutboundTag string) (*router.Config, error) {
+	bridgeTag := ReverseBridgeTag(tag)
+	InboundTag := conf.StringList{bridgeTag}
+	Domain := conf.StringList{fmt.Sprintf("full:%s", domain)}
+
+	tunnelRule := struct {
+		Type        string           `json:"type"`
+		RuleTag     string           `json:"ruleTag"`
+		InboundTag  *conf.StringList `json:"inboundTag"`
+		Domain      *conf.StringList `json:"domain"`
+		OutboundTag string           `json:"outboundTag"`
+	}{
+		Type:        "field",
+		RuleTag:     fmt.Sprintf("%s_tunnel", bridgeTag),
+		InboundTag:  &InboundTag,
+		Domain:      &Domain,
+		OutboundTag: tunnelOutboundTag,
+	}
+	defaultRule := struct {
+		Type        string           `json:"type"`
+		RuleTag     string           `json:"ruleTag"`
+		InboundTag  *conf.StringList `json:"inboundTag"`
+		OutboundTag string           `json:"outboundTag"`
+	}{
+		Type:        "field",
+		RuleTag:     fmt.Sprintf("%s_default", bridgeTag),
+		InboundTag:  &InboundTag,
+		OutboundTag: tag,
+	}
+
+	RuleList := []json.RawMessage{}
+	for _, rule := range []any{tunnelRule, defaultRule} {
+		data, err := json.Marshal(rule)
+		if err != nil {
+			return nil, fmt.Errorf("Marshal reverse bridge rule config failed: %s", err)
+		}
+		RuleList = append(RuleList, data)
+	}
+
+	routerConfig := &conf.RouterConfig{RuleList: RuleList}
+	return routerConfig.Build()
+}
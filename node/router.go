@@ -9,41 +9,11 @@ import (
 	"github.com/xtls/xray-core/app/router"
 	"github.com/xtls/xray-core/infra/conf"
 	"github.com/xmplusdev/xmplus-server/api"
+	"github.com/xmplusdev/xmplus-server/app/dispatcher"
 )
 
-func RelayRouterBuilder(tag string, relayTag string, subscription *api.SubscriptionInfo) (*router.Config, error) {
-	routerConfig := &conf.RouterConfig{}
-	var ruleList any
-	
-	User := conf.StringList{fmt.Sprintf("%s|%s|%d", tag, subscription.Email, subscription.Id)}
-	InboundTag := conf.StringList{tag}
-	
-	ruleList = struct {
-		RuleTag     string           `json:"ruleTag"`
-		Type        string           `json:"type"`
-		InboundTag  *conf.StringList `json:"inboundTag"`
-		OutboundTag string           `json:"outboundTag"`
-		User        *conf.StringList `json:"user"`
-	}{
-		RuleTag:     fmt.Sprintf("%s_%d", relayTag, subscription.Id),
-		Type:        "field",
-		InboundTag:  &InboundTag,
-		OutboundTag: fmt.Sprintf("%s_%d", relayTag, subscription.Id),
-		User:        &User,
-	}
-		
-	rule, err := json.Marshal(ruleList)
-	if err != nil {
-		return nil, fmt.Errorf("Marshal Rule list %s config failed: %s", ruleList, err)
-	}
-		
-	RuleList := []json.RawMessage{}
-	RuleList = append(RuleList, rule)
-	routerConfig.RuleList = RuleList
-	return routerConfig.Build()
-}
-
-func DefaultRouterBuilder(tag string) (*router.Config, error) {
+// DefaultRouterBuilder routes all the traffic of an inbound to outboundTag
+func DefaultRouterBuilder(tag string, outboundTag string) (*router.Config, error) {
 	routerConfig := &conf.RouterConfig{}
 	RuleList := []json.RawMessage{}
 	
@@ -62,7 +32,7 @@ func DefaultRouterBuilder(tag string) (*router.Config, error) {
 		Type:        "field",
 		RuleTag:     fmt.Sprintf("%s_default", tag),
 		InboundTag:  &InboundTag,
-		OutboundTag: tag,
+		OutboundTag: outboundTag,
 		//Network:     &network,
 	}
 		
@@ -78,84 +48,200 @@ func DefaultRouterBuilder(tag string) (*router.Config, error) {
 }
 
 func RouterBuilder(nodeInfo *api.NodeInfo, tag string) (*router.Config, error) {
+	return BlockingRouterBuilder(nodeInfo.BlockingRules, tag)
+}
+
+// BlockingRouterBuilder builds the <tag>_blackhole rule followed by one rule per
+// rule action, the rule list is empty when no rule is defined. Rule sets are
+// matched by the dispatcher, see RuleSetBuilder.
+func BlockingRouterBuilder(blockingRules *api.BlockingRules, tag string) (*router.Config, error) {
 	routerConfig := &conf.RouterConfig{}
 	RuleList := []json.RawMessage{}
 	
-	InboundTag := conf.StringList{tag}
+	if blockingRules == nil {
+		blockingRules = &api.BlockingRules{}
+	}
 	
 	// Only add blocking rule if there are actual blocking rules defined
-	hasBlockingRules := false
-	if (nodeInfo.BlockingRules.Port != "" && nodeInfo.BlockingRules.Port != "0") ||
-	   (nodeInfo.BlockingRules.Domain != nil && len(nodeInfo.BlockingRules.Domain) > 0) ||
-	   (nodeInfo.BlockingRules.IP != nil && len(nodeInfo.BlockingRules.IP) > 0) ||
-	   (nodeInfo.BlockingRules.Protocol != nil && len(nodeInfo.BlockingRules.Protocol) > 0) {
-		hasBlockingRules = true
-	}
-	
-	if hasBlockingRules {
-		// Parse port string into PortRange slice
-		var portRanges []conf.PortRange
-		var err error
-		if nodeInfo.BlockingRules.Port != "" && nodeInfo.BlockingRules.Port != "0" {
-			portRanges, err = parsePortString(nodeInfo.BlockingRules.Port)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse port string: %w", err)
-			}
+	rule, err := matchRuleBuilder(
+		fmt.Sprintf("%s_blackhole", tag),
+		tag,
+		fmt.Sprintf("%s_blackhole", tag),
+		blockingRules.Domain,
+		blockingRules.IP,
+		blockingRules.Port,
+		blockingRules.Protocol,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Marshal blocking rule config failed: %s", err)
+	}
+	if rule != nil {
+		RuleList = append(RuleList, rule)
+	}
+	
+	for i, ruleAction := range blockingRules.Actions {
+		rule, err := ruleActionBuilder(&ruleAction, tag, RuleActionTag(tag, i))
+		if err != nil {
+			return nil, err
 		}
-		
-		var domain *conf.StringList
-		if nodeInfo.BlockingRules.Domain != nil && len(nodeInfo.BlockingRules.Domain) > 0 {
-			d := conf.StringList(nodeInfo.BlockingRules.Domain)
-			domain = &d
+		if rule != nil {
+			RuleList = append(RuleList, rule)
 		}
+	}
+	
+	routerConfig.RuleList = RuleList
+	return routerConfig.Build()
+}
 
-		var ip *conf.StringList
-		if nodeInfo.BlockingRules.IP != nil && len(nodeInfo.BlockingRules.IP) > 0 {
-			i := conf.StringList(nodeInfo.BlockingRules.IP)
-			ip = &i
-		}
+// RuleActionTag returns the rule tag of the i-th rule action of a node
+func RuleActionTag(tag string, i int) string {
+	return fmt.Sprintf("%s_rule_%d", tag, i)
+}
+
+// RuleSetTag returns the rule tag of a rule set of a node
+func RuleSetTag(tag string, id int) string {
+	return fmt.Sprintf("%s_ruleset_%d", tag, id)
+}
+
+// RuleSetGroupTag returns the tag the subscriptions of a plan group look up
+// their rule sets with
+func RuleSetGroupTag(tag string, group int) string {
+	return fmt.Sprintf("%s_group_%d", tag, group)
+}
+
+// RuleActionOutboundTag returns the outbound the traffic matched by a rule
+// action is sent to
+func RuleActionOutboundTag(ruleAction *api.RuleAction, tag string, ruleTag string) (string, error) {
+	switch ruleAction.Action {
+		case api.RuleActionBlock:
+			return fmt.Sprintf("%s_blackhole", tag), nil
+		case api.RuleActionRedirect:
+			if ruleAction.Outbound == "" {
+				return "", fmt.Errorf("redirect rule %s has no outbound", ruleTag)
+			}
+			return ruleAction.Outbound, nil
+		case api.RuleActionThrottle, api.RuleActionAudit:
+			// Traffic keeps using the node outbound, the dispatcher applies the action
+			return tag, nil
+		case api.RuleActionDNS:
+			if ruleAction.DomainStrategy == "" {
+				return "", fmt.Errorf("dns rule %s has no dns strategy", ruleTag)
+			}
+			return ruleTag, nil
+		default:
+			return "", fmt.Errorf("unsupported rule action: %s", ruleAction.Action)
+	}
+}
 
-		var protocols *conf.StringList
-		if nodeInfo.BlockingRules.Protocol != nil && len(nodeInfo.BlockingRules.Protocol) > 0 {
-			p := conf.StringList(nodeInfo.BlockingRules.Protocol)
-			protocols = &p
+func ruleActionBuilder(ruleAction *api.RuleAction, tag string, ruleTag string) (json.RawMessage, error) {
+	outboundTag, err := RuleActionOutboundTag(ruleAction, tag, ruleTag)
+	if err != nil {
+		return nil, err
+	}
+	
+	rule, err := matchRuleBuilder(
+		ruleTag,
+		tag,
+		outboundTag,
+		ruleAction.Domain,
+		ruleAction.IP,
+		ruleAction.Port,
+		ruleAction.Protocol,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Marshal %s rule config failed: %s", ruleAction.Action, err)
+	}
+	
+	return rule, nil
+}
+
+// RuleSetBuilder builds the rule set the dispatcher applies to the
+// subscriptions using it. Unlike a router rule, a rule set without condition
+// matches every destination of its subscriptions.
+func RuleSetBuilder(ruleAction *api.RuleAction, tag string, ruleTag string) (*dispatcher.RuleSet, error) {
+	rule, err := ruleActionBuilder(ruleAction, tag, ruleTag)
+	if err != nil {
+		return nil, err
+	}
+	
+	ruleSet := &dispatcher.RuleSet{}
+	ruleSet.OutboundTag, _ = RuleActionOutboundTag(ruleAction, tag, ruleTag)
+	if rule == nil {
+		return ruleSet, nil
+	}
+	
+	routerConfig := &conf.RouterConfig{RuleList: []json.RawMessage{rule}}
+	config, err := routerConfig.Build()
+	if err != nil {
+		return nil, fmt.Errorf("build rule set %s failed: %s", ruleTag, err)
+	}
+	ruleSet.Condition, err = config.Rule[0].BuildCondition()
+	if err != nil {
+		return nil, fmt.Errorf("build rule set %s failed: %s", ruleTag, err)
+	}
+	return ruleSet, nil
+}
+
+// matchRuleBuilder builds a field rule of the inbound, it returns nil when
+// there is nothing to match
+func matchRuleBuilder(ruleTag string, tag string, outboundTag string, domains []string, ips []string, port string, protocols []string) (json.RawMessage, error) {
+	if (port == "" || port == "0") && len(domains) == 0 && len(ips) == 0 && len(protocols) == 0 {
+		return nil, nil
+	}
+	
+	InboundTag := conf.StringList{tag}
+	
+	// Parse port string into PortRange slice
+	var portList *conf.PortList
+	if port != "" && port != "0" {
+		portRanges, err := parsePortString(port)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse port string: %w", err)
 		}
-		
-		var portList *conf.PortList
 		if len(portRanges) > 0 {
 			portList = &conf.PortList{Range: portRanges}
 		}
-		
-		blockingRule := struct {
-			Type        string           `json:"type"`
-			RuleTag     string           `json:"ruleTag"`
-			InboundTag  *conf.StringList `json:"inboundTag"`
-			OutboundTag string           `json:"outboundTag"`
-			Domain      *conf.StringList `json:"domain,omitempty"`
-			IP          *conf.StringList `json:"ip,omitempty"`
-			Port        *conf.PortList   `json:"port,omitempty"`
-			Protocols   *conf.StringList `json:"protocol,omitempty"`
-		}{
-			Type:        "field",
-			RuleTag:     fmt.Sprintf("%s_blackhole", tag),
-		    InboundTag:  &InboundTag,
-			OutboundTag: fmt.Sprintf("%s_blackhole", tag),
-			Domain:      domain,
-			IP:          ip,
-			Protocols:   protocols,
-			Port:        portList,
-		}
-		
-		rule, err := json.Marshal(blockingRule)
-		if err != nil {
-			return nil, fmt.Errorf("Marshal blocking rule config failed: %s", err)
-		}
-		
-		RuleList = append(RuleList, rule)
 	}
 	
-	routerConfig.RuleList = RuleList
-	return routerConfig.Build()
+	var domain *conf.StringList
+	if len(domains) > 0 {
+		d := conf.StringList(domains)
+		domain = &d
+	}
+
+	var ip *conf.StringList
+	if len(ips) > 0 {
+		i := conf.StringList(ips)
+		ip = &i
+	}
+
+	var protocol *conf.StringList
+	if len(protocols) > 0 {
+		p := conf.StringList(protocols)
+		protocol = &p
+	}
+	
+	matchRule := struct {
+		Type        string           `json:"type"`
+		RuleTag     string           `json:"ruleTag"`
+		InboundTag  *conf.StringList `json:"inboundTag"`
+		OutboundTag string           `json:"outboundTag"`
+		Domain      *conf.StringList `json:"domain,omitempty"`
+		IP          *conf.StringList `json:"ip,omitempty"`
+		Port        *conf.PortList   `json:"port,omitempty"`
+		Protocols   *conf.StringList `json:"protocol,omitempty"`
+	}{
+		Type:        "field",
+		RuleTag:     ruleTag,
+		InboundTag:  &InboundTag,
+		OutboundTag: outboundTag,
+		Domain:      domain,
+		IP:          ip,
+		Protocols:   protocol,
+		Port:        portList,
+	}
+	
+	return json.Marshal(matchRule)
 }
 
 // parsePortString parses a port string like "53,443,1000-2000" into PortRange slices
@@ -0,0 +1,107 @@
+package node
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xmplusdev/xmplus-server/api"
+)
+
+func Test_matchRuleBuilder(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		domains   []string
+		ips       []string
+		port      string
+		protocols []string
+		expected  string
+	}{
+		{
+			desc: "nothing to match",
+		},
+		{
+			desc: "port zero",
+			port: "0",
+		},
+		{
+			desc:     "domain",
+			domains:  []string{"geosite:ads"},
+			expected: `{"type":"field","ruleTag":"rule","inboundTag":["node"],"outboundTag":"out","domain":["geosite:ads"]}`,
+		},
+		{
+			desc:      "every condition",
+			domains:   []string{"example.com"},
+			ips:       []string{"1.1.1.1"},
+			port:      "53,1000-2000",
+			protocols: []string{"bittorrent"},
+			expected:  `{"type":"field","ruleTag":"rule","inboundTag":["node"],"outboundTag":"out","domain":["example.com"],"ip":["1.1.1.1"],"port":"53,1000-2000","protocol":["bittorrent"]}`,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			rule, err := matchRuleBuilder("rule", "node", "out", test.domains, test.ips, test.port, test.protocols)
+			require.NoError(t, err)
+
+			if test.expected == "" {
+				assert.Nil(t, rule)
+				return
+			}
+			assert.JSONEq(t, test.expected, string(rule))
+		})
+	}
+}
+
+func Test_matchRuleBuilder_invalidPort(t *testing.T) {
+	_, err := matchRuleBuilder("rule", "node", "out", nil, nil, "http", nil)
+	assert.Error(t, err)
+}
+
+func TestRuleSetBuilder(t *testing.T) {
+	testCases := []struct {
+		desc              string
+		ruleAction        api.RuleAction
+		expectedOutbound  string
+		expectedCondition bool
+		expectedErr       bool
+	}{
+		{
+			desc:             "every destination",
+			ruleAction:       api.RuleAction{Action: api.RuleActionBlock},
+			expectedOutbound: "node_blackhole",
+		},
+		{
+			desc:              "port condition",
+			ruleAction:        api.RuleAction{Action: api.RuleActionRedirect, Outbound: "warp", Port: "443"},
+			expectedOutbound:  "warp",
+			expectedCondition: true,
+		},
+		{
+			desc:              "throttle keeps the node outbound",
+			ruleAction:        api.RuleAction{Action: api.RuleActionThrottle, IP: []string{"10.0.0.0/8"}},
+			expectedOutbound:  "node",
+			expectedCondition: true,
+		},
+		{
+			desc:        "redirect without outbound",
+			ruleAction:  api.RuleAction{Action: api.RuleActionRedirect},
+			expectedErr: true,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			ruleSet, err := RuleSetBuilder(&test.ruleAction, "node", RuleSetTag("node", 1))
+			if test.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			assert.Equal(t, test.expectedOutbound, ruleSet.OutboundTag)
+			assert.Equal(t, test.expectedCondition, ruleSet.Condition != nil)
+		})
+	}
+}
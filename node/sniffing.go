@@ -0,0 +1,84 @@
+package node
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/xtls/xray-core/infra/conf"
+
+	"github.com/xmplusdev/xmplus-server/api"
+)
+
+// defaultDestOverride is used by the nodes the panel sets no destOverride for
+var defaultDestOverride = []string{"http", "tls", "quic", "fakedns"}
+
+// sniffingBuilder builds the sniffing config of the node inbound from the
+// sniffing options of the panel
+func sniffingBuilder(nodeInfo *api.NodeInfo) (*conf.SniffingConfig, error) {
+	sniffingConfig := &conf.SniffingConfig{
+		Enabled: nodeInfo.Sniffing,
+		DestOverride: &conf.StringList{},
+	}
+	*sniffingConfig.DestOverride = append(*sniffingConfig.DestOverride, defaultDestOverride...)
+	
+	settings := nodeInfo.SniffingSettings
+	if settings == nil {
+		return sniffingConfig, nil
+	}
+	
+	if len(settings.DestOverride) > 0 {
+		destOverride := conf.StringList{}
+		seen := make(map[string]bool)
+		for _, protocol := range settings.DestOverride {
+			protocol = strings.ToLower(strings.TrimSpace(protocol))
+			switch protocol {
+				case "http", "tls", "quic", "fakedns", "fakedns+others":
+				case "https", "ssl":
+					// Aliases xray accepts for tls
+					protocol = "tls"
+				default:
+					return nil, fmt.Errorf("unknown sniffing destOverride %q", protocol)
+			}
+			if !seen[protocol] {
+				seen[protocol] = true
+				destOverride = append(destOverride, protocol)
+			}
+		}
+		sniffingConfig.DestOverride = &destOverride
+	}
+	
+	// Only the fake DNS is known from the metadata of a connection
+	if settings.MetadataOnly {
+		fakedns := false
+		for _, protocol := range *sniffingConfig.DestOverride {
+			if strings.HasPrefix(protocol, "fakedns") {
+				fakedns = true
+			}
+		}
+		if !fakedns {
+			return nil, fmt.Errorf("metadataOnly sniffing needs fakedns in destOverride")
+		}
+	}
+	
+	if len(settings.DomainsExcluded) > 0 {
+		domainsExcluded := conf.StringList{}
+		for _, domain := range settings.DomainsExcluded {
+			domain = strings.ToLower(strings.TrimSpace(domain))
+			if domain == "" || domain == "regexp:" {
+				return nil, fmt.Errorf("empty sniffing domainsExcluded entry")
+			}
+			if pattern, ok := strings.CutPrefix(domain, "regexp:"); ok {
+				if _, err := regexp.Compile(pattern); err != nil {
+					return nil, fmt.Errorf("invalid sniffing domainsExcluded %q: %w", domain, err)
+				}
+			}
+			domainsExcluded = append(domainsExcluded, domain)
+		}
+		sniffingConfig.DomainsExcluded = &domainsExcluded
+	}
+	
+	sniffingConfig.MetadataOnly = settings.MetadataOnly
+	sniffingConfig.RouteOnly = settings.RouteOnly
+	return sniffingConfig, nil
+}
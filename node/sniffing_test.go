@@ -0,0 +1,87 @@
+package node
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xmplusdev/xmplus-server/api"
+)
+
+func Test_sniffingBuilder(t *testing.T) {
+	testCases := []struct {
+		desc                    string
+		settings                *api.SniffingSettings
+		expectedDestOverride    []string
+		expectedDomainsExcluded []string
+		expectError             bool
+	}{
+		{
+			desc:                 "no settings",
+			expectedDestOverride: defaultDestOverride,
+		},
+		{
+			desc:                 "dest override",
+			settings:             &api.SniffingSettings{DestOverride: []string{" HTTP", "tls", "http"}},
+			expectedDestOverride: []string{"http", "tls"},
+		},
+		{
+			desc:                 "tls aliases",
+			settings:             &api.SniffingSettings{DestOverride: []string{"https", "SSL", "tls", "quic"}},
+			expectedDestOverride: []string{"tls", "quic"},
+		},
+		{
+			desc:        "unknown dest override",
+			settings:    &api.SniffingSettings{DestOverride: []string{"ssh"}},
+			expectError: true,
+		},
+		{
+			desc:                 "metadata only",
+			settings:             &api.SniffingSettings{DestOverride: []string{"fakedns+others"}, MetadataOnly: true},
+			expectedDestOverride: []string{"fakedns+others"},
+		},
+		{
+			desc:        "metadata only without fakedns",
+			settings:    &api.SniffingSettings{DestOverride: []string{"http"}, MetadataOnly: true},
+			expectError: true,
+		},
+		{
+			desc:                    "domains excluded",
+			settings:                &api.SniffingSettings{DomainsExcluded: []string{"Courier.Push.Apple.com", "regexp:^mijia.*$"}},
+			expectedDestOverride:    defaultDestOverride,
+			expectedDomainsExcluded: []string{"courier.push.apple.com", "regexp:^mijia.*$"},
+		},
+		{
+			desc:        "empty domain excluded",
+			settings:    &api.SniffingSettings{DomainsExcluded: []string{" "}},
+			expectError: true,
+		},
+		{
+			desc:        "invalid regexp",
+			settings:    &api.SniffingSettings{DomainsExcluded: []string{"regexp:("}},
+			expectError: true,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			sniffingConfig, err := sniffingBuilder(&api.NodeInfo{Sniffing: true, SniffingSettings: test.settings})
+			if test.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.True(t, sniffingConfig.Enabled)
+			assert.Equal(t, test.expectedDestOverride, []string(*sniffingConfig.DestOverride))
+			if test.expectedDomainsExcluded == nil {
+				assert.Nil(t, sniffingConfig.DomainsExcluded)
+			} else {
+				assert.Equal(t, test.expectedDomainsExcluded, []string(*sniffingConfig.DomainsExcluded))
+			}
+
+			_, err = sniffingConfig.Build()
+			require.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/xtls/xray-core/infra/conf"
+
+	"github.com/xmplusdev/xmplus-server/api"
+)
+
+// defaultGrpcUserAgent is sent by the grpc transports the panel sets no user agent for
+const defaultGrpcUserAgent = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_4_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/123.0.6312.52 Mobile/15E148 Safari/604.1"
+
+// The transport settings below are shared by the node inbound and the relay outbound
+
+func xhttpConfig(settings *api.XhttpSettings) (*conf.SplitHTTPConfig, error) {
+	xhttpSettings := &conf.SplitHTTPConfig{
+		Host: settings.Host,
+		Path: settings.Path,
+		Mode: settings.Mode,
+		NoSSEHeader: settings.NoSSEHeader,
+		NoGRPCHeader: settings.NoGRPCHeader,
+		Headers: settings.Headers,
+		ScMaxBufferedPosts: settings.ScMaxBufferedPosts,
+		Extra: settings.Extra,
+	}
+	
+	ranges := []struct {
+		name  string
+		value string
+		field *conf.Int32Range
+	}{
+		{"xPaddingBytes", settings.XPaddingBytes, &xhttpSettings.XPaddingBytes},
+		{"scMaxEachPostBytes", settings.ScMaxEachPostBytes, &xhttpSettings.ScMaxEachPostBytes},
+		{"scMinPostsIntervalMs", settings.ScMinPostsIntervalMs, &xhttpSettings.ScMinPostsIntervalMs},
+		{"scStreamUpServerSecs", settings.ScStreamUpServerSecs, &xhttpSettings.ScStreamUpServerSecs},
+	}
+	for _, r := range ranges {
+		if r.value == "" {
+			continue
+		}
+		if err := json.Unmarshal([]byte(strconv.Quote(r.value)), r.field); err != nil {
+			return nil, fmt.Errorf("invalid xhttp %s %s: %w", r.name, r.value, err)
+		}
+	}
+	
+	if len(settings.Xmux) > 0 {
+		if err := json.Unmarshal(settings.Xmux, &xhttpSettings.Xmux); err != nil {
+			return nil, fmt.Errorf("invalid xhttp xmux: %w", err)
+		}
+	}
+	if len(settings.DownloadSettings) > 0 {
+		xhttpSettings.DownloadSettings = &conf.StreamConfig{}
+		if err := json.Unmarshal(settings.DownloadSettings, xhttpSettings.DownloadSettings); err != nil {
+			return nil, fmt.Errorf("invalid xhttp downloadSettings: %w", err)
+		}
+	}
+	return xhttpSettings, nil
+}
+
+func grpcConfig(settings *api.GrpcSettings) *conf.GRPCConfig {
+	userAgent := settings.UserAgent
+	if userAgent == "" {
+		userAgent = defaultGrpcUserAgent
+	}
+	
+	return &conf.GRPCConfig{
+		ServiceName: settings.ServiceName,
+		Authority: settings.Authority,
+		MultiMode: settings.MultiMode,
+		IdleTimeout: settings.IdleTimeout,
+		HealthCheckTimeout: settings.HealthCheckTimeout,
+		PermitWithoutStream: settings.PermitWithoutStream,
+		InitialWindowsSize: settings.InitialWindowsSize,
+		UserAgent: userAgent,
+	}
+}
+
+func kcpConfig(settings *api.KcpSettings) *conf.KCPConfig {
+	kcpSettings := &conf.KCPConfig{
+		HeaderConfig: settings.Header,
+		Congestion: &settings.Congestion,
+		Seed: &settings.Seed,
+	}
+	
+	// Unset sizes keep the xray defaults
+	sizes := []struct {
+		value uint32
+		field **uint32
+	}{
+		{settings.Mtu, &kcpSettings.Mtu},
+		{settings.Tti, &kcpSettings.Tti},
+		{settings.UplinkCapacity, &kcpSettings.UpCap},
+		{settings.DownlinkCapacity, &kcpSettings.DownCap},
+		{settings.ReadBufferSize, &kcpSettings.ReadBufferSize},
+		{settings.WriteBufferSize, &kcpSettings.WriteBufferSize},
+	}
+	for _, size := range sizes {
+		if size.value > 0 {
+			value := size.value
+			*size.field = &value
+		}
+	}
+	return kcpSettings
+}
@@ -0,0 +1,62 @@
+package node
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xmplusdev/xmplus-server/api"
+)
+
+func Test_xhttpConfig(t *testing.T) {
+	testCases := []struct {
+		desc             string
+		settings         *api.XhttpSettings
+		expectedDownload bool
+		expectError      bool
+	}{
+		{
+			desc:     "no download settings",
+			settings: &api.XhttpSettings{Path: "/xhttp", Mode: "auto", XPaddingBytes: "100-1000"},
+		},
+		{
+			desc: "download settings",
+			settings: &api.XhttpSettings{
+				Path:             "/xhttp",
+				Mode:             "packet-up",
+				DownloadSettings: json.RawMessage(`{"address":"download.example.com","port":443,"network":"xhttp","security":"tls","xhttpSettings":{"path":"/xhttp"}}`),
+			},
+			expectedDownload: true,
+		},
+		{
+			desc: "invalid download settings",
+			settings: &api.XhttpSettings{
+				DownloadSettings: json.RawMessage(`{"port":"none"}`),
+			},
+			expectError: true,
+		},
+		{
+			desc:        "invalid range",
+			settings:    &api.XhttpSettings{XPaddingBytes: "a-b"},
+			expectError: true,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			xhttpSettings, err := xhttpConfig(test.settings)
+			if test.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedDownload, xhttpSettings.DownloadSettings != nil)
+
+			config, err := xhttpSettings.Build()
+			require.NoError(t, err)
+			assert.NotNil(t, config)
+		})
+	}
+}
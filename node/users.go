@@ -0,0 +1,190 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/inbound"
+
+	"github.com/xmplusdev/xmplus-server/api"
+)
+
+// inboundUser is a subscription of an inbound without user manager, Key is
+// the username of a socks or http account or the tunnel IP of a wireguard peer
+type inboundUser struct {
+	Key       string
+	Secret    string
+	Email     string
+	Addresses []net.IP // tunnel IPs of a wireguard peer, Key is the first one
+}
+
+// StaticInbound reports whether the inbound of a node type has no user
+// manager, its users are set with UpdateInboundUsers
+func StaticInbound(nodeType string) bool {
+	switch nodeType {
+		case "wireguard", "socks", "http":
+			return true
+	}
+	return false
+}
+
+// UpdateInboundUsers sets the users of a socks, http or wireguard node. The
+// accounts of a socks or http inbound are swapped at runtime. A wireguard
+// inbound cannot change its peers and is rebuilt with one peer per
+// subscription, its clients handshake again.
+func (m *Manager) UpdateInboundUsers(nodeInfo *api.NodeInfo, tag string, config *Config, subscriptionInfo *[]api.SubscriptionInfo) error {
+	var users []*inboundUser
+	if nodeInfo.NodeType == "wireguard" {
+		wireguardUsers, err := m.wireguardUsers(nodeInfo, tag, subscriptionInfo)
+		if err != nil {
+			return err
+		}
+		users = wireguardUsers
+
+		inboundConfig, err := inboundBuilder(config, nodeInfo, tag, users)
+		if err != nil {
+			return fmt.Errorf("failed to build %s inbound: %w", nodeInfo.NodeType, err)
+		}
+		if err := m.replaceInbound(inboundConfig); err != nil {
+			return fmt.Errorf("failed to update %s inbound: %w", nodeInfo.NodeType, err)
+		}
+	} else {
+		users = make([]*inboundUser, 0, len(*subscriptionInfo))
+		for _, subscription := range *subscriptionInfo {
+			users = append(users, &inboundUser{
+				Key:    subscription.Email,
+				Secret: subscription.Passwd,
+				Email:  fmt.Sprintf("%s|%s|%d", tag, subscription.Email, subscription.Id),
+			})
+		}
+		if err := m.setInboundAccounts(tag, users); err != nil {
+			return fmt.Errorf("failed to update %s accounts: %w", nodeInfo.NodeType, err)
+		}
+	}
+
+	// The dispatcher maps the username or tunnel IP back to the subscription
+	keys := make(map[string]*protocol.MemoryUser, len(users))
+	for _, user := range users {
+		memoryUser := &protocol.MemoryUser{Email: user.Email}
+		keys[fmt.Sprintf("%s|%s", tag, user.Key)] = memoryUser
+		for _, ip := range user.Addresses {
+			keys[fmt.Sprintf("%s|%s", tag, ip)] = memoryUser
+		}
+	}
+
+	m.access.Lock()
+	defer m.access.Unlock()
+	for _, key := range m.inboundUsers[tag] {
+		if _, ok := keys[key]; !ok {
+			m.dispatcher.InboundUsers.Delete(key)
+		}
+	}
+	m.inboundUsers[tag] = make([]string, 0, len(keys))
+	for key, memoryUser := range keys {
+		m.dispatcher.InboundUsers.Store(key, memoryUser)
+		m.inboundUsers[tag] = append(m.inboundUsers[tag], key)
+	}
+
+	log.Printf("Updated %d %s users of tag %s", len(users), nodeInfo.NodeType, tag)
+	return nil
+}
+
+// wireguardUsers returns a peer per subscription, with the tunnel addresses
+// allocated from the pool of the node
+func (m *Manager) wireguardUsers(nodeInfo *api.NodeInfo, tag string, subscriptionInfo *[]api.SubscriptionInfo) ([]*inboundUser, error) {
+	settings := nodeInfo.WireguardSettings
+	if settings == nil {
+		return nil, fmt.Errorf("wireguardSettings missing for node %d", nodeInfo.NodeID)
+	}
+
+	m.access.Lock()
+	defer m.access.Unlock()
+
+	// A changed peer network starts a new pool
+	pool, ok := m.wireguardPools[tag]
+	if !ok || pool.peerNetwork != settings.PeerNetwork {
+		newPool, err := newWireguardPool(settings.PeerNetwork, settings.Address)
+		if err != nil {
+			return nil, err
+		}
+		pool = newPool
+		m.wireguardPools[tag] = pool
+	}
+
+	ids := make([]int, len(*subscriptionInfo))
+	for i, subscription := range *subscriptionInfo {
+		ids[i] = subscription.Id
+	}
+	pool.update(ids)
+
+	users := make([]*inboundUser, 0, len(*subscriptionInfo))
+	for _, subscription := range *subscriptionInfo {
+		publicKey := subscription.PublicKey
+		if publicKey == "" {
+			var err error
+			if _, publicKey, err = WireguardKeys(settings.SecretKey, subscription.Passwd); err != nil {
+				log.Printf("Skip wireguard peer of UID %d: %s", subscription.Id, err)
+				continue
+			}
+		}
+
+		offset, ok := pool.allocate(subscription.Id)
+		if !ok {
+			log.Printf("Skip wireguard peer of UID %d: no free address in %s", subscription.Id, settings.PeerNetwork)
+			continue
+		}
+		addresses := pool.addresses(offset)
+
+		users = append(users, &inboundUser{
+			Key:       addresses[0].String(),
+			Secret:    publicKey,
+			Email:     fmt.Sprintf("%s|%s|%d", tag, subscription.Email, subscription.Id),
+			Addresses: addresses,
+		})
+	}
+	return users, nil
+}
+
+// replaceInbound swaps the inbound of a tag. The new inbound is created
+// before the old one is removed, and the old one is added back when the new
+// one cannot start, so that a failed update leaves the node serving.
+func (m *Manager) replaceInbound(config *core.InboundHandlerConfig) error {
+	rawHandler, err := core.CreateObject(m.server, config)
+	if err != nil {
+		return err
+	}
+	handler, ok := rawHandler.(inbound.Handler)
+	if !ok {
+		return fmt.Errorf("not an InboundHandler: %s", config.Tag)
+	}
+
+	oldHandler, _ := m.ibm.GetHandler(context.Background(), config.Tag)
+	m.removeInbound(config.Tag)
+	if err := m.ibm.AddHandler(context.Background(), handler); err != nil {
+		// The manager keeps the tag of a handler that failed to start
+		m.removeInbound(config.Tag)
+		if oldHandler != nil {
+			if errr := m.ibm.AddHandler(context.Background(), oldHandler); errr != nil {
+				m.removeInbound(config.Tag)
+				return fmt.Errorf("%s, restoring the previous inbound failed: %s", err, errr)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// removeInboundUsers forgets the users of an inbound without user manager
+func (m *Manager) removeInboundUsers(tag string) {
+	m.access.Lock()
+	defer m.access.Unlock()
+	for _, key := range m.inboundUsers[tag] {
+		m.dispatcher.InboundUsers.Delete(key)
+	}
+	delete(m.inboundUsers, tag)
+	delete(m.wireguardPools, tag)
+}
@@ -0,0 +1,187 @@
+package node
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// maxWireguardPeers bounds the offsets of a large peer network
+const maxWireguardPeers = 1 << 24
+
+// WireguardKeys derives the key pair of a subscription from its password,
+// salted with the secret key of the node. The panel, which knows both, can
+// build the client config without storing any key, while the password alone
+// does not give the key away. Changing either changes the key, a panel
+// provided public key avoids that.
+func WireguardKeys(nodeSecretKey string, passwd string) (privateKey string, publicKey string, err error) {
+	if nodeSecretKey == "" {
+		return "", "", fmt.Errorf("wireguard node has no secret key")
+	}
+	mac := hmac.New(sha256.New, []byte(nodeSecretKey))
+	mac.Write([]byte(passwd))
+	secret := mac.Sum(nil)
+	secret[0] &= 248
+	secret[31] = (secret[31] & 127) | 64
+
+	public, err := curve25519.X25519(secret, curve25519.Basepoint)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(secret), base64.StdEncoding.EncodeToString(public), nil
+}
+
+// wireguardPool allocates the tunnel addresses of the peers of a node. The
+// peer network may list an IPv4 and an IPv6 network separated by commas, a
+// peer gets the address at the same offset in each of them. A peer keeps its
+// offset while it stays on the node, offset Id+1 is preferred when it is free
+// so that the addresses do not depend on the order the peers were added in.
+type wireguardPool struct {
+	peerNetwork string
+	networks    []*net.IPNet
+	size        uint64          // offsets below size exist in every network
+	reserved    map[uint64]bool // network, server and broadcast addresses
+	offsets     map[int]uint64  // Key: subscription Id
+	used        map[uint64]int  // Key: offset, value: subscription Id
+}
+
+func newWireguardPool(peerNetwork string, serverAddresses []string) (*wireguardPool, error) {
+	p := &wireguardPool{
+		peerNetwork: peerNetwork,
+		size:        maxWireguardPeers,
+		reserved:    map[uint64]bool{0: true, 1: true},
+		offsets:     make(map[int]uint64),
+		used:        make(map[uint64]int),
+	}
+
+	for _, cidr := range strings.Split(peerNetwork, ",") {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid wireguard peer network %s: %w", peerNetwork, err)
+		}
+		ones, bits := network.Mask.Size()
+		size := uint64(maxWireguardPeers)
+		if bits-ones < 24 {
+			size = 1 << uint(bits-ones)
+			// The last IPv4 address is the broadcast address
+			if network.IP.To4() != nil {
+				size--
+			}
+		}
+		if size < p.size {
+			p.size = size
+		}
+		p.networks = append(p.networks, network)
+	}
+	if p.size <= 2 {
+		return nil, fmt.Errorf("wireguard peer network %s has no address for peers", peerNetwork)
+	}
+
+	// The addresses of the server itself are never given to a peer
+	for _, address := range serverAddresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			ip, _, _ = net.ParseCIDR(address)
+		}
+		for _, network := range p.networks {
+			if offset, ok := ipOffset(network, ip); ok {
+				p.reserved[offset] = true
+			}
+		}
+	}
+	return p, nil
+}
+
+// update frees the offsets of the peers that are not in ids anymore
+func (p *wireguardPool) update(ids []int) {
+	keep := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		keep[id] = true
+	}
+	for id, offset := range p.offsets {
+		if !keep[id] {
+			delete(p.offsets, id)
+			delete(p.used, offset)
+		}
+	}
+}
+
+// allocate returns the offset of a peer, false when the pool is exhausted
+func (p *wireguardPool) allocate(id int) (uint64, bool) {
+	if offset, ok := p.offsets[id]; ok {
+		return offset, true
+	}
+
+	offset := uint64(id) + 1
+	if id < 0 || !p.free(offset) {
+		offset = 0
+		for candidate := uint64(2); candidate < p.size; candidate++ {
+			if p.free(candidate) {
+				offset = candidate
+				break
+			}
+		}
+		if offset == 0 {
+			return 0, false
+		}
+	}
+
+	p.offsets[id] = offset
+	p.used[offset] = id
+	return offset, true
+}
+
+func (p *wireguardPool) free(offset uint64) bool {
+	if offset >= p.size || p.reserved[offset] {
+		return false
+	}
+	_, used := p.used[offset]
+	return !used
+}
+
+// addresses returns the tunnel address of an offset in every peer network
+func (p *wireguardPool) addresses(offset uint64) []net.IP {
+	ips := make([]net.IP, len(p.networks))
+	for i, network := range p.networks {
+		ips[i] = addOffset(network.IP, offset)
+	}
+	return ips
+}
+
+func addOffset(base net.IP, offset uint64) net.IP {
+	ip := make(net.IP, len(base))
+	copy(ip, base)
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	for i := len(ip) - 1; i >= 0 && offset > 0; i-- {
+		sum := uint64(ip[i]) + offset&0xff
+		ip[i] = byte(sum)
+		offset = offset>>8 + sum>>8
+	}
+	return ip
+}
+
+func ipOffset(network *net.IPNet, ip net.IP) (uint64, bool) {
+	if ip == nil || !network.Contains(ip) {
+		return 0, false
+	}
+	base := network.IP
+	if v4 := ip.To4(); v4 != nil && len(base) == net.IPv4len {
+		ip = v4
+	} else {
+		ip = ip.To16()
+		base = base.To16()
+	}
+
+	var offset uint64
+	for i := range ip {
+		offset = offset<<8 | uint64(ip[i]-base[i])
+	}
+	return offset, true
+}
@@ -0,0 +1,109 @@
+package node
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWireguardKeys(t *testing.T) {
+	privateKey, publicKey, err := WireguardKeys("node-a", "passwd")
+	require.NoError(t, err)
+	assert.Len(t, privateKey, 44)
+	assert.Len(t, publicKey, 44)
+
+	_, samePublicKey, err := WireguardKeys("node-a", "passwd")
+	require.NoError(t, err)
+	assert.Equal(t, publicKey, samePublicKey)
+
+	_, otherPublicKey, err := WireguardKeys("node-b", "passwd")
+	require.NoError(t, err)
+	assert.NotEqual(t, publicKey, otherPublicKey)
+
+	_, _, err = WireguardKeys("", "passwd")
+	assert.Error(t, err)
+}
+
+func Test_newWireguardPool(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		peerNetwork string
+		size        uint64
+		expectError bool
+	}{
+		{
+			desc:        "IPv4",
+			peerNetwork: "10.0.0.0/24",
+			size:        255,
+		},
+		{
+			desc:        "IPv4 and IPv6",
+			peerNetwork: "10.0.0.0/16, fd00::/64",
+			size:        65535,
+		},
+		{
+			desc:        "large IPv6",
+			peerNetwork: "fd00::/64",
+			size:        maxWireguardPeers,
+		},
+		{
+			desc:        "too small",
+			peerNetwork: "10.0.0.0/31",
+			expectError: true,
+		},
+		{
+			desc:        "invalid",
+			peerNetwork: "10.0.0.0",
+			expectError: true,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			pool, err := newWireguardPool(test.peerNetwork, nil)
+			if test.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.size, pool.size)
+		})
+	}
+}
+
+func Test_wireguardPool_allocate(t *testing.T) {
+	pool, err := newWireguardPool("10.0.0.0/29,fd00::/64", []string{"10.0.0.2/29", "fd00::3"})
+	require.NoError(t, err)
+
+	// Id+1 is preferred, server addresses and reserved offsets are skipped
+	testCases := []struct {
+		id       int
+		expected []string
+	}{
+		{id: 5, expected: []string{"10.0.0.6", "fd00::6"}},
+		{id: 1, expected: []string{"10.0.0.4", "fd00::4"}},
+		{id: 1000, expected: []string{"10.0.0.5", "fd00::5"}},
+	}
+	for _, test := range testCases {
+		offset, ok := pool.allocate(test.id)
+		require.True(t, ok)
+		addresses := pool.addresses(offset)
+		require.Len(t, addresses, 2)
+		assert.Equal(t, test.expected[0], addresses[0].String())
+		assert.Equal(t, test.expected[1], addresses[1].String())
+	}
+
+	// A peer keeps its address
+	offset, ok := pool.allocate(1)
+	require.True(t, ok)
+	assert.Equal(t, "10.0.0.4", pool.addresses(offset)[0].String())
+
+	// The pool is exhausted, removed peers free their address
+	_, ok = pool.allocate(2000)
+	assert.False(t, ok)
+	pool.update([]int{5, 1000})
+	offset, ok = pool.allocate(2000)
+	require.True(t, ok)
+	assert.Equal(t, "10.0.0.4", pool.addresses(offset)[0].String())
+}
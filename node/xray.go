@@ -0,0 +1,106 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/infra/conf"
+	
+	"github.com/xmplusdev/xmplus-server/api"
+)
+
+// managedSettings are the protocol settings holding the users of a node, they
+// always come from the subscriptions of the panel
+var managedSettings = []string{"clients", "users", "accounts", "peers"}
+
+// buildInbound merges the raw xray settings of the panel over the generated
+// inbound config and builds it
+func buildInbound(nodeInfo *api.NodeInfo, inboundDetourConfig *conf.InboundDetourConfig) (*core.InboundHandlerConfig, error) {
+	if nodeInfo.XraySettings == nil {
+		return inboundDetourConfig.Build()
+	}
+	
+	if err := mergeXraySettings(nodeInfo.XraySettings, inboundDetourConfig); err != nil {
+		return nil, fmt.Errorf("merge xray settings of node %d failed: %w", nodeInfo.NodeID, err)
+	}
+	
+	inboundConfig, err := inboundDetourConfig.Build()
+	if err != nil {
+		return nil, fmt.Errorf("invalid xray settings of node %d: %w", nodeInfo.NodeID, err)
+	}
+	return inboundConfig, nil
+}
+
+func mergeXraySettings(xraySettings *api.XraySettings, inboundDetourConfig *conf.InboundDetourConfig) error {
+	if len(xraySettings.Settings) > 0 {
+		settings := make(map[string]any)
+		if inboundDetourConfig.Settings != nil {
+			if err := json.Unmarshal(*inboundDetourConfig.Settings, &settings); err != nil {
+				return err
+			}
+		}
+		
+		var rawSettings map[string]any
+		if err := json.Unmarshal(xraySettings.Settings, &rawSettings); err != nil {
+			return fmt.Errorf("settings: %w", err)
+		}
+		for _, key := range managedSettings {
+			delete(rawSettings, key)
+		}
+		mergeJSON(settings, rawSettings)
+		
+		setting, err := json.Marshal(settings)
+		if err != nil {
+			return err
+		}
+		inboundDetourConfig.Settings = (*json.RawMessage)(&setting)
+	}
+	
+	// Decoding over the generated configs replaces the fields set in the raw
+	// json and keeps the others
+	if len(xraySettings.StreamSettings) > 0 {
+		if inboundDetourConfig.StreamSetting == nil {
+			inboundDetourConfig.StreamSetting = new(conf.StreamConfig)
+		}
+		if err := json.Unmarshal(xraySettings.StreamSettings, inboundDetourConfig.StreamSetting); err != nil {
+			return fmt.Errorf("streamSettings: %w", err)
+		}
+	}
+	
+	if len(xraySettings.Sniffing) > 0 {
+		if inboundDetourConfig.SniffingConfig == nil {
+			inboundDetourConfig.SniffingConfig = new(conf.SniffingConfig)
+		}
+		if err := json.Unmarshal(xraySettings.Sniffing, inboundDetourConfig.SniffingConfig); err != nil {
+			return fmt.Errorf("sniffing: %w", err)
+		}
+	}
+	
+	return nil
+}
+
+// mergeJSON merges src into dst, objects are merged key by key and any other
+// value is replaced
+func mergeJSON(dst, src map[string]any) {
+	for key, value := range src {
+		if srcObject, ok := value.(map[string]any); ok {
+			if dstObject, ok := dst[key].(map[string]any); ok {
+				mergeJSON(dstObject, srcObject)
+				continue
+			}
+		}
+		dst[key] = value
+	}
+}
+
+// withoutXrayStream drops the raw stream settings from a copy of the node info
+// whose stream is set by XMPlus
+func withoutXrayStream(nodeInfo *api.NodeInfo) {
+	if nodeInfo.XraySettings == nil {
+		return
+	}
+	xraySettings := *nodeInfo.XraySettings
+	xraySettings.StreamSettings = nil
+	nodeInfo.XraySettings = &xraySettings
+}
@@ -0,0 +1,81 @@
+package node
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xtls/xray-core/infra/conf"
+
+	"github.com/xmplusdev/xmplus-server/api"
+)
+
+func Test_mergeJSON(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		dst      string
+		src      string
+		expected string
+	}{
+		{
+			desc:     "new key",
+			dst:      `{"a":1}`,
+			src:      `{"b":2}`,
+			expected: `{"a":1,"b":2}`,
+		},
+		{
+			desc:     "replaced value",
+			dst:      `{"a":1,"b":[1,2]}`,
+			src:      `{"a":"x","b":[3]}`,
+			expected: `{"a":"x","b":[3]}`,
+		},
+		{
+			desc:     "nested objects",
+			dst:      `{"a":{"b":1,"c":{"d":2,"e":3}}}`,
+			src:      `{"a":{"c":{"e":4,"f":5}}}`,
+			expected: `{"a":{"b":1,"c":{"d":2,"e":4,"f":5}}}`,
+		},
+		{
+			desc:     "object over a value",
+			dst:      `{"a":1}`,
+			src:      `{"a":{"b":2}}`,
+			expected: `{"a":{"b":2}}`,
+		},
+		{
+			desc:     "value over an object",
+			dst:      `{"a":{"b":2}}`,
+			src:      `{"a":null}`,
+			expected: `{"a":null}`,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			var dst, src map[string]any
+			require.NoError(t, json.Unmarshal([]byte(test.dst), &dst))
+			require.NoError(t, json.Unmarshal([]byte(test.src), &src))
+
+			mergeJSON(dst, src)
+
+			merged, err := json.Marshal(dst)
+			require.NoError(t, err)
+			assert.JSONEq(t, test.expected, string(merged))
+		})
+	}
+}
+
+func Test_mergeXraySettings(t *testing.T) {
+	settings := json.RawMessage(`{"clients":[{"id":"generated"}],"decryption":"none"}`)
+	inboundDetourConfig := &conf.InboundDetourConfig{Settings: &settings}
+	xraySettings := &api.XraySettings{
+		Settings: json.RawMessage(`{"clients":[{"id":"raw"}],"fallbacks":[{"dest":80}]}`),
+	}
+
+	require.NoError(t, mergeXraySettings(xraySettings, inboundDetourConfig))
+	// The users always come from the panel subscriptions
+	assert.JSONEq(t, `{"clients":[{"id":"generated"}],"decryption":"none","fallbacks":[{"dest":80}]}`, string(*inboundDetourConfig.Settings))
+
+	xraySettings.Settings = json.RawMessage(`[]`)
+	assert.Error(t, mergeXraySettings(xraySettings, inboundDetourConfig))
+}
@@ -36,7 +36,9 @@ func NewManager(server *core.Instance, client api.API) *Manager {
 	}
 }
 
-func (m *Manager) AddNewSubscription(subscriptionInfo *[]api.SubscriptionInfo, nodeInfo *api.NodeInfo, tag string) (err error) {
+// AddNewSubscription adds the subscriptions to the inbound inboundTag, their
+// emails carry the node tag so that the extra inbounds of a node share them
+func (m *Manager) AddNewSubscription(subscriptionInfo *[]api.SubscriptionInfo, nodeInfo *api.NodeInfo, tag string, inboundTag string) (err error) {
 	if subscriptionInfo == nil || len(*subscriptionInfo) == 0 {
 		return nil
 	}
@@ -49,13 +51,16 @@ func (m *Manager) AddNewSubscription(subscriptionInfo *[]api.SubscriptionInfo, n
 		users = BuildVmessUsers(subscriptionInfo, tag)
 	case "trojan":
 		users = BuildTrojanUsers(subscriptionInfo, tag)
-	case "shadowsocks":
+	case "shadowsocks", "Shadowsocks-Plugin":
 		users = BuildShadowsocksUsers(subscriptionInfo, nodeInfo.Cipher, tag)
+	case "socks", "http", "wireguard":
+		// These inbounds have no user manager, the node manager rebuilds them
+		return fmt.Errorf("%s inbound has no user manager, rebuild it with its accounts", nodeInfo.NodeType)
 	default:
 		return fmt.Errorf("unsupported node type %s. Abort building user", nodeInfo.NodeType)
 	}
 
-	return m.Add(users, tag)
+	return m.Add(users, inboundTag)
 }
 
 // Add adds new subscriptions to an inbound tag
@@ -135,6 +140,7 @@ func Compare(old, new *[]api.SubscriptionInfo) (deleted, added, modified []api.S
 			if oldSub.SpeedLimit != newSub.SpeedLimit || 
 			   oldSub.IPLimit != newSub.IPLimit ||
 			   oldSub.Passwd != newSub.Passwd ||
+			   oldSub.PublicKey != newSub.PublicKey ||
 			   oldSub.Email != newSub.Email {
 				modified = append(modified, newSub)
 			}